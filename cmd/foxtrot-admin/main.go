@@ -0,0 +1,46 @@
+// Command foxtrot-admin administers a foxtrot database from the
+// command line, e.g. to grant the first admin role.
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"foxygo.at/foxtrot/pkg/foxtrot"
+	"github.com/alecthomas/kong"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+type roleCmd struct {
+	Name string `arg:"" help:"User name"`
+	Role string `arg:"" help:"Role: admin, owner, moderator or member" enum:"admin,owner,moderator,member"`
+	Room string `help:"Room for owner, moderator and member roles"`
+}
+
+type cli struct {
+	foxtrot.Config `embed:""`
+
+	Grant  roleCmd `cmd:"" help:"Grant a role to a user"`
+	Revoke roleCmd `cmd:"" help:"Revoke a role from a user"`
+}
+
+func main() {
+	c := &cli{}
+	kctx := kong.Parse(c, kong.Description("Foxtrot administration"))
+
+	app, err := foxtrot.NewApp(&c.Config, http.NewServeMux())
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx := context.Background()
+	switch kctx.Command() {
+	case "grant <name> <role>":
+		err = app.GrantRole(ctx, c.Grant.Name, c.Grant.Role, c.Grant.Room)
+	case "revoke <name> <role>":
+		err = app.RevokeRole(ctx, c.Revoke.Name, c.Revoke.Role, c.Revoke.Room)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"log"
+	"net"
 	"net/http"
 
 	"foxygo.at/foxtrot/pkg/foxtrot"
 	"github.com/alecthomas/kong"
-	"github.com/gorilla/websocket"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -23,27 +25,27 @@ func main() {
 	}
 	kong.Parse(cfg, kong.Description("Foxtrot Server"))
 
-	mux := http.NewServeMux()
-	mux.Handle("/", http.FileServer(http.Dir("frontend/public")))
-	if _, err := foxtrot.NewApp(cfg, mux); err != nil {
+	h, err := newHandler(cfg)
+	if err != nil {
 		log.Fatal(err)
 	}
 
 	port := ":8080"
 	log.Printf("Listening on port %s", port)
-	if err := http.ListenAndServe(port, handler(logHTTP(mux))); err != nil {
+	if err := http.ListenAndServe(port, h); err != nil {
 		log.Fatal(err)
 	}
 }
 
-func handler(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/ws" {
-			socketHandler(w, r)
-		} else {
-			h.ServeHTTP(w, r)
-		}
-	})
+// newHandler returns the logged handler of the frontend and the foxtrot
+// API as served by the binary.
+func newHandler(cfg *foxtrot.Config) (http.Handler, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("frontend/public")))
+	if _, err := foxtrot.NewApp(cfg, mux); err != nil {
+		return nil, err
+	}
+	return logHTTP(mux), nil
 }
 
 func logHTTP(h http.Handler) http.Handler {
@@ -67,30 +69,19 @@ func (w *responseWriter) WriteHeader(code int) {
 	w.ResponseWriter.WriteHeader(code)
 }
 
-// upgrader holds the websocket connection.
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-}
-
-// socketHandler echos websocket messages back to the client.
-func socketHandler(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("upgrader.Upgrade: %v", err)
-		return
+// Hijack lets WebSocket upgrades take over the underlying connection.
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
 	}
-	defer conn.Close() //nolint: errcheck
+	w.statusCode = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
 
-	for {
-		messageType, p, err := conn.ReadMessage()
-		if err != nil {
-			log.Printf("conn.ReadMessage: %v", err)
-			return
-		}
-		if err := conn.WriteMessage(messageType, p); err != nil {
-			log.Printf("conn.WriteMessage: %v", err)
-			return
-		}
+// Flush sends any buffered data to the client.
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
 	}
 }
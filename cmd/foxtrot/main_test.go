@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"foxygo.at/foxtrot/pkg/foxtrot"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandlerWebSocket(t *testing.T) {
+	h, err := newHandler(&foxtrot.Config{DSN: ":memory:"})
+	require.NoError(t, err)
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/api/login", "application/json",
+		strings.NewReader(`{"name": "$Fox", "password": "Pa$$w0rd"}`))
+	require.NoError(t, err)
+	defer resp.Body.Close() //nolint: errcheck
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	u := foxtrot.User{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&u))
+
+	header := http.Header{"Authorization": []string{"Bearer " + u.JWT}}
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/ws"
+	conn, wsResp, err := websocket.DefaultDialer.Dial(wsURL, header)
+	require.NoError(t, err)
+	require.NoError(t, wsResp.Body.Close())
+	defer conn.Close() //nolint: errcheck
+
+	require.NoError(t, conn.WriteJSON(map[string]string{"type": "subscribe", "id": "1", "room": "$Kitchen"}))
+	ack := map[string]interface{}{}
+	require.NoError(t, conn.ReadJSON(&ack))
+	require.Equal(t, "ack", ack["type"])
+}
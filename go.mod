@@ -9,4 +9,7 @@ require (
 	github.com/mattn/go-sqlite3 v1.14.4
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/crypto v0.0.0-20201016220609-9e8e0b390897
+	golang.org/x/image v0.0.0-20210628002857-a66eb6448b8d
+	golang.org/x/text v0.3.6
+	rsc.io/qr v0.2.0
 )
@@ -3,8 +3,14 @@ package foxtrot
 import (
 	"encoding/json"
 	"errors"
+	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"foxygo.at/s/errs"
 	"foxygo.at/s/httpe"
@@ -13,18 +19,75 @@ import (
 // api is a REST inspired HTTP API for accessing foxtrot data,
 // registration and authentication
 //
-// /api/login POST
+// /api/login POST # returns a second factor challenge if TOTP is enabled
+// /api/login/totp POST # complete login with challenge and TOTP or recovery code
+// /api/auth/oidc/login GET # redirect to OpenID Connect identity provider
+// /api/auth/oidc/callback?code=CODE&state=STATE GET # complete single sign-on or identity linking
+// /api/auth/oidc/link POST # returns {url} of identity provider to link an identity to the logged in user
 // /api/register POST
-// /api/history?room=NAME[&before=MESSAGE_ID|TIMESTAMP&count=N]
+// /api/history?room=NAME[&before=MESSAGE_ID|TIMESTAMP&count=N] # members only for private rooms, without replies
+// /api/message/ID PATCH # author only, within the edit window: {content}, broadcast as message-edit event
+// /api/message/ID DELETE # author, or moderator or above: keep as tombstone, broadcast as message-delete event
+// /api/message/ID/edits GET # prior versions, oldest first, members only for private rooms
+// /api/message/ID/thread[?before=MESSAGE_ID&limit=N] GET # parent and replies, newest first, as for history
+// /api/user/NAME/password POST # change with old password and TOTP code if enabled, reset token or as admin
+// /api/user/NAME/password-reset POST # admin only: create reset token
+// /api/user/NAME/totp POST # start TOTP enrolment
+// /api/user/NAME/totp DELETE # disable TOTP with TOTP or recovery code
+// /api/user/NAME/totp/confirm POST # enable TOTP, returns recovery codes
+// /api/user/NAME/roles GET # own roles or admin
+// /api/user/NAME/roles POST # grant {role, room}: admin, or room owner for member and moderator
+// /api/user/NAME/roles DELETE # revoke {role, room}, as for grant
+// /api/user/NAME/tokens GET # list personal access tokens
+// /api/user/NAME/tokens POST # create personal access token
+// /api/user/NAME/tokens/ID DELETE # revoke personal access token
 //
-// Not yet implemented:
-// /api/user/NAME/
-// /api/user/NAME/avatar
-// /api/room/NAME # create new room.
+// /api/logout POST # clear session cookies
+//
+// Authenticated requests carry the JWT or a personal access token as
+// bearer token in the Authorization header. In cookie session mode the
+// JWT is set as HttpOnly cookie on login instead of being returned and
+// state-changing requests authenticated by cookie must send the CSRF
+// cookie's value in the X-CSRF-Token header.
+//
+// /api/user/NAME GET # profile
+// /api/user/NAME PATCH # change own profile or as admin
+// /api/user/NAME?messages=anonymise|delete DELETE # delete own account
+// /api/users?prefix=PREFIX GET # search users by name or display name prefix
+// /api/user/NAME/avatar[?size=N&format=svg] GET # no authentication, identicon if none uploaded
+// /api/user/NAME/avatar POST # multipart form upload, own or as admin
+// /api/user/NAME/avatar DELETE # own or as admin
+// /api/user/NAME/export GET # ZIP archive of own personal data
+// /api/room POST # create room {name, topic, description, icon, settings, private}, creator becomes owner
+// /api/rooms[?member=true&archived=true&after=NAME&limit=N] GET # list visible active or archived rooms by name
+// /api/room/NAME GET # members only for private rooms
+// /api/room/NAME PATCH # owner or admin: change or rename, broadcast as room-update event
+// /api/room/NAME DELETE # owner or admin: delete with messages, members and invites
+// /api/room/NAME/archive POST # owner or admin: make read-only and unlisted, broadcast as room-update event
+// /api/room/NAME/restore POST # owner or admin: undo archive
+// /api/room/NAME/join POST # join public room, or private room with {invite}
+// /api/room/NAME/leave POST
+// /api/room/NAME/invites GET # moderator or above: list invites
+// /api/room/NAME/invites POST # moderator or above: create invite {expiresIn, maxUses}
+// /api/room/NAME/invites/ID DELETE # moderator or above: revoke invite
+// /api/room/NAME/moderation POST # moderator or above: {action: kick|ban|unban|mute|unmute, user, reason, duration}
+// /api/room/NAME/moderation GET # moderator or above: moderation log, newest first
+// /api/room/NAME/sanctions GET # moderator or above: current bans and mutes
+//
+// /api/conversations GET # own direct message conversations, most recently active first
+// /api/conversations POST # get or create conversation {participants}, use its ID as room
+//
+// /api/ws GET # WebSocket for subscribing to rooms, sending, editing and deleting messages and reacting, see command
 type api struct {
 	db   *db
 	auth *authenticator
 	ver  Version
+
+	sessions   *cookieSessions // nil unless cookie session mode is enabled
+	hub        *hub
+	editWindow time.Duration // after sending, for authors to edit messages, 0: no limit
+
+	trustedProxies []*net.IPNet // reverse proxies whose X-Forwarded-For header is used
 }
 
 func newAPI(db *db, auth *authenticator, version Version) *api {
@@ -32,15 +95,29 @@ func newAPI(db *db, auth *authenticator, version Version) *api {
 		db:   db,
 		auth: auth,
 		ver:  version,
+		hub:  newHub(),
 	}
 	return a
 }
 
 func (a *api) wireRoutes(basePath string, mux *http.ServeMux) {
 	mux.Handle(basePath+"/login", httpe.Must(httpe.Post, a.login))
+	mux.Handle(basePath+"/login/totp", httpe.Must(httpe.Post, a.loginTOTP))
+	mux.Handle(basePath+"/auth/oidc/login", httpe.Must(httpe.Get, a.oidcLogin))
+	mux.Handle(basePath+"/auth/oidc/callback", httpe.Must(httpe.Get, a.oidcCallback))
+	mux.Handle(basePath+"/auth/oidc/link", httpe.Must(httpe.Post, a.oidcLink))
+	mux.Handle(basePath+"/logout", httpe.Must(httpe.Post, a.logout))
 	mux.Handle(basePath+"/register", httpe.Must(httpe.Post, a.register))
 	mux.Handle(basePath+"/history", httpe.Must(httpe.Get, a.history))
+	mux.Handle(basePath+"/message/", http.StripPrefix(basePath+"/message/", httpe.Must(a.message)))
+	mux.Handle(basePath+"/room", httpe.Must(httpe.Post, a.createRoom))
+	mux.Handle(basePath+"/rooms", httpe.Must(httpe.Get, a.rooms))
+	mux.Handle(basePath+"/room/", http.StripPrefix(basePath+"/room/", httpe.Must(a.room)))
+	mux.Handle(basePath+"/conversations", httpe.Must(a.conversations))
+	mux.Handle(basePath+"/users", httpe.Must(httpe.Get, a.users))
+	mux.Handle(basePath+"/user/", http.StripPrefix(basePath+"/user/", httpe.Must(a.user)))
 	mux.Handle(basePath+"/version", httpe.Must(httpe.Get, a.version))
+	mux.Handle(basePath+"/ws", httpe.Must(httpe.Get, a.ws))
 	mux.Handle(basePath+"/_test_cleanup", httpe.Must(httpe.Delete, a.testCleanup))
 }
 
@@ -55,12 +132,220 @@ func (a *api) login(w http.ResponseWriter, r *http.Request) error {
 	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
 		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
 	}
-	u, err := a.auth.login(r.Context(), c.Name, c.Password)
+	u, err := a.auth.login(r.Context(), c.Name, c.Password, a.clientIP(r))
 	if err != nil {
-		w.Header().Set("WWW-Authenticate", `Bearer realm="Write access to foxtrot chat"`)
-		return httpe.ErrUnauthorized
+		var sfe *secondFactorError
+		if errors.As(err, &sfe) {
+			sf := secondFactor{Name: c.Name, SecondFactor: "totp", Challenge: sfe.challenge}
+			return json.NewEncoder(w).Encode(sf)
+		}
+		return loginErr(w, err)
 	}
-	return json.NewEncoder(w).Encode(u)
+	return a.writeUser(w, u)
+}
+
+// secondFactor is returned by /api/login instead of a User with JWT if
+// the user has TOTP enabled.
+type secondFactor struct {
+	Name         string `json:"name"`
+	SecondFactor string `json:"secondFactor"`
+	Challenge    string `json:"challenge"`
+}
+
+type totpLogin struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"` // TOTP or recovery code
+}
+
+func (a *api) loginTOTP(w http.ResponseWriter, r *http.Request) error {
+	tl := totpLogin{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&tl); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	u, err := a.auth.loginTOTP(r.Context(), tl.Challenge, tl.Code, a.clientIP(r))
+	if err != nil {
+		return loginErr(w, err)
+	}
+	return a.writeUser(w, u)
+}
+
+// oidcLogin redirects to the identity provider to start single
+// sign-on.
+func (a *api) oidcLogin(w http.ResponseWriter, r *http.Request) error {
+	if a.auth.oidc == nil {
+		return httpe.ErrNotFound
+	}
+	authURL, err := a.auth.startOIDC(r.Context(), "")
+	if err != nil {
+		return errs.Errorf("%v: %v", httpe.ErrInternalServerError, err)
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+	return nil
+}
+
+type oidcLinkURL struct {
+	URL string `json:"url"`
+}
+
+// oidcLink starts linking an identity provider identity to the
+// authenticated user. It returns the identity provider URL to navigate
+// to rather than redirecting, as the request carries the user's
+// credentials; the link is completed by oidcCallback.
+func (a *api) oidcLink(w http.ResponseWriter, r *http.Request) error {
+	if a.auth.oidc == nil {
+		return httpe.ErrNotFound
+	}
+	u, err := a.authenticate(r, scopeAccountWrite)
+	if err != nil {
+		return err
+	}
+	authURL, err := a.auth.startOIDC(r.Context(), u.Name)
+	if err != nil {
+		return errs.Errorf("%v: %v", httpe.ErrInternalServerError, err)
+	}
+	return json.NewEncoder(w).Encode(oidcLinkURL{URL: authURL})
+}
+
+// oidcCallback is the redirect target of the identity provider. It
+// returns the foxtrot user with JWT as /api/login does, for both single
+// sign-on and identity linking.
+func (a *api) oidcCallback(w http.ResponseWriter, r *http.Request) error {
+	if a.auth.oidc == nil {
+		return httpe.ErrNotFound
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		return errs.Errorf("%v: identity provider: %s: %s", httpe.ErrUnauthorized, e, q.Get("error_description"))
+	}
+	if q.Get("code") == "" || q.Get("state") == "" {
+		return errs.Errorf("%v: missing code or state", httpe.ErrBadRequest)
+	}
+	u, err := a.auth.loginOIDC(r.Context(), q.Get("state"), q.Get("code"))
+	if err != nil {
+		switch {
+		case errors.Is(err, errOIDCUser):
+			return errs.Errorf("%v: %v", httpe.ErrForbidden, err)
+		case errors.Is(err, errDBDuplicate):
+			return errs.Errorf("%v: %v", httpe.ErrConflict, err)
+		case errors.Is(err, errAuth), errors.Is(err, errOIDCExchange):
+			return errs.Errorf("%v: %v", httpe.ErrUnauthorized, err)
+		case errors.Is(err, errDBNotFound): // user deleted while linking
+			return errs.Errorf("%v: %v", httpe.ErrNotFound, err)
+		}
+		return errs.Errorf("%v: %v", httpe.ErrInternalServerError, err)
+	}
+	return a.writeUser(w, u)
+}
+
+func loginErr(w http.ResponseWriter, err error) error {
+	var te *throttleError
+	if errors.As(err, &te) {
+		w.Header().Set("Retry-After", retryAfter(te.retryAfter))
+		return httpe.ErrTooManyRequests
+	}
+	w.Header().Set("WWW-Authenticate", `Bearer realm="Write access to foxtrot chat"`)
+	return httpe.ErrUnauthorized
+}
+
+// writeUser writes u as JSON. In cookie session mode u's JWT is set as
+// session cookie instead.
+func (a *api) writeUser(w http.ResponseWriter, u *User) error {
+	if a.sessions == nil || u.JWT == "" {
+		return json.NewEncoder(w).Encode(u)
+	}
+	if err := a.sessions.setSession(w, u.JWT, jwtExpiry(time.Now())); err != nil {
+		return errs.Errorf("%v: %v", httpe.ErrInternalServerError, err)
+	}
+	withoutJWT := *u
+	withoutJWT.JWT = ""
+	return json.NewEncoder(w).Encode(withoutJWT)
+}
+
+func (a *api) logout(w http.ResponseWriter, _ *http.Request) error {
+	if a.sessions != nil {
+		a.sessions.clearSession(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// clientIP returns the address of the client making request r. This is
+// the host part of the request's remote address, unless the request
+// comes from a trusted proxy, in which case it is the last address in
+// the X-Forwarded-For header not belonging to a trusted proxy.
+func (a *api) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !a.trustedProxy(host) {
+		return host
+	}
+	var forwarded []string
+	for _, h := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(h, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(ip) == nil {
+			break
+		}
+		host = ip
+		if !a.trustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
+
+// trustedProxy returns whether ip belongs to a trusted proxy.
+func (a *api) trustedProxy(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, n := range a.trustedProxies {
+		if n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+var errTrustedProxy = errors.New("invalid trusted proxy")
+
+// parseTrustedProxies parses IP addresses and CIDR ranges of trusted
+// proxies.
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, p := range proxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, errs.Errorf("%v: '%s'", errTrustedProxy, p)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, errs.Errorf("%v: '%s': %v", errTrustedProxy, p, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// retryAfter formats d as Retry-After header value in whole seconds,
+// rounded up.
+func retryAfter(d time.Duration) string {
+	secs := (d + time.Second - 1) / time.Second
+	return strconv.Itoa(int(secs))
 }
 
 func (a *api) register(w http.ResponseWriter, r *http.Request) error {
@@ -71,39 +356,1486 @@ func (a *api) register(w http.ResponseWriter, r *http.Request) error {
 	}
 	u := User{Name: c.Name}
 	if err := a.auth.register(r.Context(), &u, c.Password); err != nil {
-		if errors.Is(err, errDBDuplicate) {
-			return httpe.ErrBadRequest
+		var v validationErrors
+		switch {
+		case errors.As(err, &v):
+			return writeValidationErrors(w, v)
+		case errors.Is(err, errDBDuplicate):
+			msg := "name is already taken"
+			return writeValidationErrors(w, validationErrors{{Field: "name", Code: "taken", Message: msg}})
+		}
+		return httpe.ErrInternalServerError
+	}
+	return a.writeUser(w, &u)
+}
+
+type validationResponse struct {
+	Error  string            `json:"error"`
+	Fields []validationError `json:"fields"`
+}
+
+// writeValidationErrors writes v as JSON with status 400 Bad Request.
+func writeValidationErrors(w http.ResponseWriter, v validationErrors) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	return json.NewEncoder(w).Encode(validationResponse{Error: "validation failed", Fields: v})
+}
+
+// authenticate returns the user authenticated by the request's bearer
+// token. Personal access tokens must have the given scope unless it is
+// empty.
+func (a *api) authenticate(r *http.Request, scope string) (*User, error) {
+	token, err := a.requestToken(r)
+	if err != nil {
+		return nil, err
+	}
+	u, err := a.auth.authenticate(r.Context(), token)
+	if err != nil {
+		if errors.Is(err, errAuth) {
+			return nil, errs.Errorf("%v: %v", httpe.ErrUnauthorized, err)
+		}
+		return nil, errs.Errorf("%v: %v", httpe.ErrInternalServerError, err)
+	}
+	if !u.hasScope(scope) {
+		return nil, errs.Errorf("%v: %v '%s'", httpe.ErrForbidden, errScope, scope)
+	}
+	return u, nil
+}
+
+// requestToken returns the request's bearer token or, in cookie session
+// mode, the JWT of its session cookie.
+func (a *api) requestToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if token := strings.TrimPrefix(header, "Bearer "); token != header && token != "" {
+		return token, nil
+	}
+	if a.sessions != nil {
+		token, err := a.sessions.sessionToken(r)
+		if err != nil {
+			return "", errs.Errorf("%v: %v", httpe.ErrForbidden, err)
+		}
+		if token != "" {
+			return token, nil
+		}
+	}
+	return "", httpe.ErrUnauthorized
+}
+
+// pathSegments splits the request's URL path at '/' and unescapes each
+// segment, so that segments such as user names may contain an escaped
+// '/'.
+func pathSegments(r *http.Request) ([]string, error) {
+	segments := strings.Split(r.URL.EscapedPath(), "/")
+	for i, seg := range segments {
+		s, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, errs.Errorf("%v: invalid path: %v", httpe.ErrBadRequest, err)
+		}
+		segments[i] = s
+	}
+	return segments, nil
+}
+
+// user dispatches requests to /api/user/NAME/... with the /api/user/
+// prefix stripped.
+func (a *api) user(w http.ResponseWriter, r *http.Request) error {
+	segments, err := pathSegments(r)
+	if err != nil {
+		return err
+	}
+	if segments[0] == "" {
+		return httpe.ErrNotFound
+	}
+	name := segments[0]
+	if len(segments) == 1 || (len(segments) == 2 && segments[1] == "") {
+		switch r.Method {
+		case http.MethodGet:
+			return a.profile(w, r, name)
+		case http.MethodPatch:
+			return a.updateProfile(w, r, name)
+		case http.MethodDelete:
+			return a.deleteAccount(w, r, name)
+		}
+		return httpe.ErrMethodNotAllowed
+	}
+	if len(segments) == 3 && segments[1] == "tokens" {
+		if r.Method != http.MethodDelete {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.deleteAccessToken(w, r, name, segments[2])
+	}
+	switch strings.Join(segments[1:], "/") {
+	case "password":
+		if r.Method != http.MethodPost {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.changePassword(w, r, name)
+	case "password-reset":
+		if r.Method != http.MethodPost {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.createPasswordReset(w, r, name)
+	case "totp":
+		switch r.Method {
+		case http.MethodPost:
+			return a.enrolTOTP(w, r, name)
+		case http.MethodDelete:
+			return a.disableTOTP(w, r, name)
+		}
+		return httpe.ErrMethodNotAllowed
+	case "totp/confirm":
+		if r.Method != http.MethodPost {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.confirmTOTP(w, r, name)
+	case "avatar":
+		switch r.Method {
+		case http.MethodGet:
+			return a.avatar(w, r, name)
+		case http.MethodPost:
+			return a.uploadAvatar(w, r, name)
+		case http.MethodDelete:
+			return a.deleteAvatar(w, r, name)
+		}
+		return httpe.ErrMethodNotAllowed
+	case "export":
+		if r.Method != http.MethodGet {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.export(w, r, name)
+	case "roles":
+		switch r.Method {
+		case http.MethodGet:
+			return a.roles(w, r, name)
+		case http.MethodPost, http.MethodDelete:
+			return a.changeRole(w, r, name)
+		}
+		return httpe.ErrMethodNotAllowed
+	case "tokens":
+		switch r.Method {
+		case http.MethodGet:
+			return a.accessTokens(w, r, name)
+		case http.MethodPost:
+			return a.createAccessToken(w, r, name)
+		}
+		return httpe.ErrMethodNotAllowed
+	}
+	return httpe.ErrNotFound
+}
+
+// authorize returns the user authenticated by the request if they have
+// at least role min in room, see authenticator.authorize.
+func (a *api) authorize(r *http.Request, scope, room string, min role) (*User, error) {
+	u, err := a.authenticate(r, scope)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.auth.authorize(r.Context(), u, room, min); err != nil {
+		return nil, authzErr(err)
+	}
+	return u, nil
+}
+
+// authzErr maps authorization errors to HTTP errors.
+func authzErr(err error) error {
+	if errors.Is(err, errPermission) {
+		return errs.Errorf("%v: %v", httpe.ErrForbidden, err)
+	}
+	return errs.Errorf("%v: %v", httpe.ErrInternalServerError, err)
+}
+
+// profile returns the public profile of user name to authenticated
+// users.
+func (a *api) profile(w http.ResponseWriter, r *http.Request, name string) error {
+	if _, err := a.authenticate(r, ""); err != nil {
+		return err
+	}
+	u, err := a.db.getUser(r.Context(), name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
 		}
 		return httpe.ErrInternalServerError
 	}
 	return json.NewEncoder(w).Encode(u)
 }
 
-func (a *api) history(w http.ResponseWriter, r *http.Request) error {
+// updateProfile changes the profile of user name, for the user
+// themselves or an admin. Only fields present in the request are
+// changed.
+func (a *api) updateProfile(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateSelfOrAdmin(r, name); err != nil {
+		return err
+	}
+	p := profileUpdate{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	if err := p.validate(); err != nil {
+		var v validationErrors
+		errors.As(err, &v)
+		return writeValidationErrors(w, v)
+	}
+	if err := a.db.updateProfile(r.Context(), name, p); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	return a.profile(w, r, name)
+}
+
+// deleteAccount deletes the account of the authenticated user name.
+// The messages query parameter selects whether authored messages are
+// kept and attributed to a tombstone user ("anonymise") or deleted
+// ("delete"). All tokens of the user become invalid.
+func (a *api) deleteAccount(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateAs(r, name); err != nil {
+		return err
+	}
+	var deleteMessages bool
+	switch m := r.URL.Query().Get("messages"); m {
+	case "anonymise":
+	case "delete":
+		deleteMessages = true
+	default:
+		return errs.Errorf("%v: messages must be 'anonymise' or 'delete', got '%s'", httpe.ErrBadRequest, m)
+	}
+	if err := a.db.deleteUser(r.Context(), name, deleteMessages); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	if a.sessions != nil {
+		a.sessions.clearSession(w)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// export streams a ZIP archive of everything stored about the
+// authenticated user name: profile, avatar, authored messages, roles,
+// access token metadata and failed login attempts.
+func (a *api) export(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateAs(r, name); err != nil {
+		return err
+	}
+	e, err := a.db.newUserExport(r.Context(), name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	filename := "foxtrot-export-" + time.Now().UTC().Format("20060102") + ".zip"
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	// Errors after the first write cannot change the response status,
+	// the client gets a truncated, invalid archive.
+	return e.write(r.Context(), a.db, w)
+}
+
+// users returns up to maxUserSearch users whose name or display name
+// starts with the prefix query parameter, case-insensitively, e.g. for
+// mention autocompletion.
+func (a *api) users(w http.ResponseWriter, r *http.Request) error {
+	if _, err := a.authenticate(r, ""); err != nil {
+		return err
+	}
+	users, err := a.db.queryUsers(r.Context(), r.URL.Query().Get("prefix"), maxUserSearch)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(users)
+}
+
+// authenticateAs returns an error if the request is not authenticated
+// as user name with account:write scope.
+func (a *api) authenticateAs(r *http.Request, name string) error {
+	u, err := a.authenticate(r, scopeAccountWrite)
+	if err != nil {
+		return err
+	}
+	if u.Name != name {
+		return httpe.ErrForbidden
+	}
+	return nil
+}
+
+// authenticateSelfOrAdmin returns an error if the request is not
+// authenticated with account:write scope as user name or an admin.
+func (a *api) authenticateSelfOrAdmin(r *http.Request, name string) error {
+	u, err := a.authenticate(r, scopeAccountWrite)
+	if err != nil {
+		return err
+	}
+	if u.Name != name {
+		if err := a.auth.authorize(r.Context(), u, "", roleAdmin); err != nil {
+			return authzErr(err)
+		}
+	}
+	return nil
+}
+
+// avatar serves the avatar of user name without authentication so that
+// it can be used in img tags. Users without uploaded avatar get a
+// generated identicon. The optional size query parameter selects one of
+// avatarSizes, format=svg selects SVG for identicons. Uploaded avatars
+// are always served as PNG.
+func (a *api) avatar(w http.ResponseWriter, r *http.Request, name string) error {
 	q := r.URL.Query()
-	room := q.Get("room")
-	before := q.Get("before")
-	beforeID := -1
-	if before != "" {
-		var err error
-		if beforeID, err = strconv.Atoi(before); err != nil {
-			return httpe.ErrBadRequest
+	size := parseAvatarSize(q.Get("size"))
+	if size == 0 {
+		return errs.Errorf("%v: invalid avatar size '%s'", httpe.ErrBadRequest, q.Get("size"))
+	}
+	format := q.Get("format")
+	if format != "" && format != "png" && format != "svg" {
+		return errs.Errorf("%v: invalid avatar format '%s'", httpe.ErrBadRequest, format)
+	}
+	if _, err := a.db.getUser(r.Context(), name); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
 		}
+		return httpe.ErrInternalServerError
 	}
-	limit := 200
-	messages, err := a.db.queryMessages(r.Context(), room, beforeID, limit)
+	avatar, err := a.db.getAvatar(r.Context(), name, size)
 	if err != nil {
 		return httpe.ErrInternalServerError
 	}
-	return json.NewEncoder(w).Encode(messages)
+	if avatar == nil {
+		return serveIdenticon(w, r, name, size, format == "svg")
+	}
+	return serveAvatar(w, r, avatarETag(avatar, size), func() ([]byte, error) { return avatar, nil })
 }
 
-func (a *api) version(w http.ResponseWriter, r *http.Request) error {
-	return json.NewEncoder(w).Encode(a.ver)
+func serveIdenticon(w http.ResponseWriter, r *http.Request, name string, size int, svg bool) error {
+	ic := newIdenticon(name)
+	if svg {
+		etag := avatarETag([]byte("identicon:svg:"+name), size)
+		w.Header().Set("Content-Type", "image/svg+xml")
+		return serveAvatar(w, r, etag, func() ([]byte, error) { return ic.svg(size), nil })
+	}
+	etag := avatarETag([]byte("identicon:png:"+name), size)
+	return serveAvatar(w, r, etag, func() ([]byte, error) { return ic.png(size) })
 }
 
-const testUser = "$user"
+// serveAvatar writes the image returned by render with caching headers
+// for etag, or only the headers if the client's copy is up to date. The
+// Content-Type defaults to image/png.
+func serveAvatar(w http.ResponseWriter, r *http.Request, etag string, render func() ([]byte, error)) error {
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "public, max-age=3600")
+	if strings.Contains(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	b, err := render()
+	if err != nil {
+		return errs.Errorf("%v: %v", httpe.ErrInternalServerError, err)
+	}
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", "image/png")
+	}
+	h.Set("X-Content-Type-Options", "nosniff")
+	_, err = w.Write(b)
+	return err
+}
 
-func (a *api) testCleanup(_ http.ResponseWriter, r *http.Request) error {
-	return a.db.deleteUser(r.Context(), testUser)
+// uploadAvatar sets the avatar of user name from the avatar field of a
+// multipart form, for the user themselves or an admin. The image is
+// cropped, scaled and re-encoded, see newAvatar.
+func (a *api) uploadAvatar(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateSelfOrAdmin(r, name); err != nil {
+		return err
+	}
+	const maxFormBytes = maxAvatarBytes + 64<<10 // allow for multipart headers
+	if r.ContentLength > maxFormBytes {
+		return httpe.ErrRequestEntityTooLarge
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBytes)
+	f, _, err := r.FormFile("avatar")
+	if err != nil {
+		return errs.Errorf("%v: cannot read avatar form field: %v", httpe.ErrBadRequest, err)
+	}
+	defer r.MultipartForm.RemoveAll() //nolint: errcheck
+	defer f.Close()                   //nolint: errcheck
+	b, err := io.ReadAll(io.LimitReader(f, maxAvatarBytes+1))
+	if err != nil {
+		return errs.Errorf("%v: cannot read avatar: %v", httpe.ErrBadRequest, err)
+	}
+	avatar, err := newAvatar(b)
+	if err != nil {
+		switch {
+		case errors.Is(err, errAvatarSize):
+			return errs.Errorf("%v: %v", httpe.ErrRequestEntityTooLarge, err)
+		case errors.Is(err, errAvatarFormat):
+			return errs.Errorf("%v: %v", httpe.ErrUnsupportedMediaType, err)
+		}
+		return errs.Errorf("%v: %v", httpe.ErrInternalServerError, err)
+	}
+	return a.setAvatar(w, r, name, avatar)
+}
+
+// deleteAvatar removes the avatar of user name, for the user themselves
+// or an admin.
+func (a *api) deleteAvatar(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateSelfOrAdmin(r, name); err != nil {
+		return err
+	}
+	return a.setAvatar(w, r, name, nil)
+}
+
+func (a *api) setAvatar(w http.ResponseWriter, r *http.Request, name string, avatar avatarImages) error {
+	if err := a.db.setAvatar(r.Context(), name, avatar); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	return a.profile(w, r, name)
+}
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type recoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+// enrolTOTP creates a new TOTP secret for the authenticated user name.
+// TOTP is not enforced until confirmed with a valid code.
+func (a *api) enrolTOTP(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateAs(r, name); err != nil {
+		return err
+	}
+	e, err := a.auth.enrolTOTP(r.Context(), name)
+	if err != nil {
+		return totpErr(err)
+	}
+	return json.NewEncoder(w).Encode(e)
+}
+
+// confirmTOTP enables TOTP for the authenticated user name and returns
+// single use recovery codes. They are not retrievable later.
+func (a *api) confirmTOTP(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateAs(r, name); err != nil {
+		return err
+	}
+	tc := totpCodeRequest{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&tc); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	codes, err := a.auth.confirmTOTP(r.Context(), name, tc.Code)
+	if err != nil {
+		return totpErr(err)
+	}
+	return json.NewEncoder(w).Encode(recoveryCodes{RecoveryCodes: codes})
+}
+
+// disableTOTP disables TOTP for the authenticated user name given a
+// valid TOTP or recovery code.
+func (a *api) disableTOTP(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateAs(r, name); err != nil {
+		return err
+	}
+	tc := totpCodeRequest{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&tc); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	if err := a.auth.disableTOTP(r.Context(), name, tc.Code); err != nil {
+		return totpErr(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// accessTokens lists the personal access tokens of the authenticated
+// user name without the tokens themselves.
+func (a *api) accessTokens(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateAs(r, name); err != nil {
+		return err
+	}
+	tokens, err := a.db.queryAccessTokens(r.Context(), name)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(tokens)
+}
+
+type accessTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+// createAccessToken creates a personal access token for the
+// authenticated user name. The token is only returned once.
+func (a *api) createAccessToken(w http.ResponseWriter, r *http.Request, name string) error {
+	if err := a.authenticateAs(r, name); err != nil {
+		return err
+	}
+	req := accessTokenRequest{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	t, err := a.auth.createAccessToken(r.Context(), name, req.Name, req.Scopes)
+	if err != nil {
+		var v validationErrors
+		switch {
+		case errors.As(err, &v):
+			return writeValidationErrors(w, v)
+		case errors.Is(err, errDBDuplicate):
+			msg := "name is already taken"
+			return writeValidationErrors(w, validationErrors{{Field: "name", Code: "taken", Message: msg}})
+		}
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(t)
+}
+
+// deleteAccessToken revokes the personal access token with given ID of
+// the authenticated user name.
+func (a *api) deleteAccessToken(w http.ResponseWriter, r *http.Request, name, idStr string) error {
+	if err := a.authenticateAs(r, name); err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpe.ErrNotFound
+	}
+	if err := a.db.deleteAccessToken(r.Context(), name, id); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// roles lists the roles of user name, for the user themselves or an
+// admin.
+func (a *api) roles(w http.ResponseWriter, r *http.Request, name string) error {
+	u, err := a.authenticate(r, scopeAccountWrite)
+	if err != nil {
+		return err
+	}
+	if u.Name != name {
+		if err := a.auth.authorize(r.Context(), u, "", roleAdmin); err != nil {
+			return authzErr(err)
+		}
+	}
+	roles, err := a.db.queryRoles(r.Context(), name)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(roles)
+}
+
+// changeRole grants (POST) or revokes (DELETE) a role of user name.
+// Admins may change any role, room owners may change member and
+// moderator roles in their room.
+func (a *api) changeRole(w http.ResponseWriter, r *http.Request, name string) error {
+	u, err := a.authenticate(r, scopeAccountWrite)
+	if err != nil {
+		return err
+	}
+	role := Role{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&role); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	if err := a.auth.canGrant(r.Context(), u, role); err != nil {
+		if errors.Is(err, errRole) {
+			return errs.Errorf("%v: %v", httpe.ErrBadRequest, err)
+		}
+		return authzErr(err)
+	}
+	if r.Method == http.MethodPost {
+		err = a.auth.grantRole(r.Context(), name, role)
+	} else {
+		err = a.auth.revokeRole(r.Context(), name, role)
+	}
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return errs.Errorf("%v: %v", httpe.ErrNotFound, err)
+		}
+		return httpe.ErrInternalServerError
+	}
+	if r.Method == http.MethodDelete && role.Room != "" {
+		if room, err := a.db.getRoom(r.Context(), role.Room); err == nil && room.Private {
+			a.unsubscribeRevoked(r.Context(), room)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func totpErr(err error) error {
+	switch {
+	case errors.Is(err, errTOTPEnrolled):
+		return errs.Errorf("%v: %v", httpe.ErrConflict, err)
+	case errors.Is(err, errTOTPNotEnabled):
+		return errs.Errorf("%v: %v", httpe.ErrNotFound, err)
+	case errors.Is(err, errTOTPCode):
+		return errs.Errorf("%v: %v", httpe.ErrForbidden, err)
+	}
+	return httpe.ErrInternalServerError
+}
+
+type passwordChange struct {
+	OldPassword string `json:"oldPassword,omitempty"`
+	Code        string `json:"code,omitempty"` // TOTP or recovery code with old password if TOTP is enabled
+	ResetToken  string `json:"resetToken,omitempty"`
+	NewPassword string `json:"newPassword"`
+}
+
+// changePassword changes the password of user name. The request must
+// contain either the old password, plus a TOTP or recovery code if TOTP
+// is enabled, a valid reset token or be authenticated as admin. Only
+// reset token requests receive a new JWT for the user, after changing
+// with the old password the user has to log in again.
+func (a *api) changePassword(w http.ResponseWriter, r *http.Request, name string) error {
+	pc := passwordChange{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&pc); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	if pc.NewPassword == "" {
+		return errs.Errorf("%v: empty new password", httpe.ErrBadRequest)
+	}
+	var u *User
+	var err error
+	switch {
+	case pc.ResetToken != "":
+		u, err = a.auth.resetPassword(r.Context(), name, pc.ResetToken, pc.NewPassword)
+	case pc.OldPassword != "":
+		err := a.auth.changePassword(r.Context(), name, pc.OldPassword, pc.Code, pc.NewPassword, a.clientIP(r))
+		if err != nil {
+			return passwordErr(w, err)
+		}
+		if a.sessions != nil {
+			a.sessions.clearSession(w)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	default:
+		if _, err := a.authorize(r, scopeAccountWrite, "", roleAdmin); err != nil {
+			return err
+		}
+		if _, err := a.auth.setPassword(r.Context(), name, pc.NewPassword); err != nil {
+			return passwordErr(w, err)
+		}
+		return json.NewEncoder(w).Encode(User{Name: name})
+	}
+	if err != nil {
+		return passwordErr(w, err)
+	}
+	return a.writeUser(w, u)
+}
+
+func passwordErr(w http.ResponseWriter, err error) error {
+	var te *throttleError
+	switch {
+	case errors.As(err, &te):
+		w.Header().Set("Retry-After", retryAfter(te.retryAfter))
+		return httpe.ErrTooManyRequests
+	case errors.Is(err, errAuth), errors.Is(err, errResetToken):
+		return httpe.ErrForbidden
+	case errors.Is(err, errDBNotFound):
+		return httpe.ErrNotFound
+	}
+	var v validationErrors
+	if errors.As(err, &v) {
+		return writeValidationErrors(w, v)
+	}
+	return httpe.ErrInternalServerError
+}
+
+type passwordReset struct {
+	ResetToken string `json:"resetToken"`
+	ExpiresAt  string `json:"expiresAt"`
+}
+
+// createPasswordReset creates a single use password reset token for
+// user name to be handed to the user out of band. Admin only.
+func (a *api) createPasswordReset(w http.ResponseWriter, r *http.Request, name string) error {
+	if _, err := a.authorize(r, scopeAccountWrite, "", roleAdmin); err != nil {
+		return err
+	}
+	token, expiresAt, err := a.auth.newResetToken(r.Context(), name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	pr := passwordReset{ResetToken: token, ExpiresAt: expiresAt.UTC().Format(time.RFC3339)}
+	return json.NewEncoder(w).Encode(pr)
+}
+
+// createRoom creates a new room owned by the authenticated user.
+func (a *api) createRoom(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.authenticate(r, scopeRoomsWrite)
+	if err != nil {
+		return err
+	}
+	ru := roomUpdate{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&ru); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	if ru.Name == nil {
+		ru.Name = new(string)
+	}
+	if err := ru.validate(); err != nil {
+		var v validationErrors
+		errors.As(err, &v)
+		return writeValidationErrors(w, v)
+	}
+	room := Room{Name: *ru.Name, CreatedBy: u.Name, CreatedAt: now()}
+	for _, f := range []struct{ dst, src *string }{
+		{&room.Topic, ru.Topic}, {&room.Description, ru.Description}, {&room.Icon, ru.Icon},
+	} {
+		if f.src != nil {
+			*f.dst = *f.src
+		}
+	}
+	if ru.Settings != nil {
+		room.Settings = *ru.Settings
+	}
+	if ru.Private != nil {
+		room.Private = *ru.Private
+	}
+	if err := a.db.createRoom(r.Context(), &room); err != nil {
+		if errors.Is(err, errDBDuplicate) {
+			msg := "name is already taken"
+			return writeValidationErrors(w, validationErrors{{Field: "name", Code: "taken", Message: msg}})
+		}
+		return httpe.ErrInternalServerError
+	}
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(room)
+}
+
+// rooms lists active rooms ordered by name, archived rooms instead if
+// archived=true and only those the authenticated user is a member of if
+// member=true. Private rooms are only listed for their members and
+// admins. Pages of up to limit rooms are continued with after set to
+// the last room name of the previous page.
+func (a *api) rooms(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.authenticate(r, "")
+	if err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	limit := defaultRooms
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxRooms {
+			return errs.Errorf("%v: limit must be between 1 and %d", httpe.ErrBadRequest, maxRooms)
+		}
+	}
+	f := roomFilter{viewer: u.Name, archived: q.Get("archived") == "true"}
+	if q.Get("member") == "true" {
+		f.member = u.Name
+	}
+	admin, err := a.auth.isAdmin(r.Context(), u.Name)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	if admin {
+		f.viewer = ""
+	}
+	rooms, err := a.db.queryRooms(r.Context(), f, q.Get("after"), limit)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(rooms)
+}
+
+// room dispatches /api/room/NAME/... requests with the /api/room/
+// prefix stripped.
+func (a *api) room(w http.ResponseWriter, r *http.Request) error {
+	segments, err := pathSegments(r)
+	if err != nil {
+		return err
+	}
+	if segments[0] == "" || isConversation(segments[0]) {
+		return httpe.ErrNotFound
+	}
+	name := segments[0]
+	if len(segments) == 1 || (len(segments) == 2 && segments[1] == "") {
+		switch r.Method {
+		case http.MethodGet:
+			return a.getRoom(w, r, name)
+		case http.MethodPatch:
+			return a.updateRoom(w, r, name)
+		case http.MethodDelete:
+			return a.deleteRoom(w, r, name)
+		}
+		return httpe.ErrMethodNotAllowed
+	}
+	if len(segments) == 3 && segments[1] == "invites" {
+		if r.Method != http.MethodDelete {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.deleteInvite(w, r, name, segments[2])
+	}
+	switch strings.Join(segments[1:], "/") {
+	case "join":
+		if r.Method != http.MethodPost {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.joinRoom(w, r, name)
+	case "leave":
+		if r.Method != http.MethodPost {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.leaveRoom(w, r, name)
+	case "archive", "restore":
+		if r.Method != http.MethodPost {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.archiveRoom(w, r, name, segments[1] == "archive")
+	case "invites":
+		switch r.Method {
+		case http.MethodGet:
+			return a.invites(w, r, name)
+		case http.MethodPost:
+			return a.createInvite(w, r, name)
+		}
+		return httpe.ErrMethodNotAllowed
+	case "moderation":
+		switch r.Method {
+		case http.MethodGet:
+			return a.moderationLog(w, r, name)
+		case http.MethodPost:
+			return a.moderate(w, r, name)
+		}
+		return httpe.ErrMethodNotAllowed
+	case "sanctions":
+		if r.Method != http.MethodGet {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.sanctions(w, r, name)
+	}
+	return httpe.ErrNotFound
+}
+
+// getRoom returns room name, private rooms only to members and admins.
+func (a *api) getRoom(w http.ResponseWriter, r *http.Request, name string) error {
+	u, err := a.authenticate(r, "")
+	if err != nil {
+		return err
+	}
+	room, err := a.db.getRoom(r.Context(), name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	if err := a.auth.canAccess(r.Context(), u, room); err != nil {
+		return authzErr(err)
+	}
+	return json.NewEncoder(w).Encode(room)
+}
+
+// updateRoom changes the metadata or name of a room for its owners and
+// admins and broadcasts the updated room to its subscribers.
+func (a *api) updateRoom(w http.ResponseWriter, r *http.Request, name string) error {
+	if _, err := a.authorize(r, scopeRoomsWrite, name, roleOwner); err != nil {
+		return err
+	}
+	ru := roomUpdate{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&ru); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	if err := ru.validate(); err != nil {
+		var v validationErrors
+		errors.As(err, &v)
+		return writeValidationErrors(w, v)
+	}
+	if err := a.db.updateRoom(r.Context(), name, ru); err != nil {
+		switch {
+		case errors.Is(err, errDBNotFound):
+			return httpe.ErrNotFound
+		case errors.Is(err, errDBDuplicate):
+			msg := "name is already taken"
+			return writeValidationErrors(w, validationErrors{{Field: "name", Code: "taken", Message: msg}})
+		}
+		return httpe.ErrInternalServerError
+	}
+	newName := name
+	if ru.Name != nil {
+		newName = *ru.Name
+	}
+	room, err := a.db.getRoom(r.Context(), newName)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	a.hub.broadcast(name, &event{Type: eventRoomUpdate, Room: name, Data: room})
+	if newName != name {
+		a.hub.renameRoom(name, newName)
+	}
+	if room.Private {
+		a.unsubscribeRevoked(r.Context(), room)
+	}
+	return json.NewEncoder(w).Encode(room)
+}
+
+// archiveRoom archives or restores a room for its owners and admins and
+// broadcasts the updated room to its subscribers.
+func (a *api) archiveRoom(w http.ResponseWriter, r *http.Request, name string, archive bool) error {
+	if _, err := a.authorize(r, scopeRoomsWrite, name, roleOwner); err != nil {
+		return err
+	}
+	archivedAt := ""
+	if archive {
+		archivedAt = now()
+	}
+	if err := a.db.setRoomArchived(r.Context(), name, archivedAt); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	room, err := a.db.getRoom(r.Context(), name)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	a.hub.broadcast(name, &event{Type: eventRoomUpdate, Room: name, Data: room})
+	return json.NewEncoder(w).Encode(room)
+}
+
+// deleteRoom deletes a room with all its messages for its owners and
+// admins and unsubscribes its subscribers.
+func (a *api) deleteRoom(w http.ResponseWriter, r *http.Request, name string) error {
+	if _, err := a.authorize(r, scopeRoomsWrite, name, roleOwner); err != nil {
+		return err
+	}
+	if err := a.db.deleteRoom(r.Context(), name); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	a.hub.closeRoom(name)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// history returns the latest top-level messages of a room with their
+// reactions and thread reply counts. Private rooms require
+// authentication as member or admin. Reactions of authenticated users
+// are flagged.
+func (a *api) history(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	room := q.Get("room")
+	if err := a.authorizeHistory(r, room); err != nil {
+		return err
+	}
+	before := q.Get("before")
+	beforeID := -1
+	if before != "" {
+		var err error
+		if beforeID, err = strconv.Atoi(before); err != nil {
+			return httpe.ErrBadRequest
+		}
+	}
+	limit := 200
+	messages, err := a.db.queryMessages(r.Context(), room, beforeID, limit)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	if err := a.db.setReactions(r.Context(), messages, a.viewerName(r)); err != nil {
+		return httpe.ErrInternalServerError
+	}
+	if err := a.db.setThreadStats(r.Context(), messages); err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(messages)
+}
+
+// viewerName returns the name of the user authenticated by the request,
+// or "" for anonymous requests and requests failing authentication.
+func (a *api) viewerName(r *http.Request) string {
+	u, err := a.authenticate(r, "")
+	if err != nil {
+		return ""
+	}
+	return u.Name
+}
+
+// authorizeHistory checks that the request may read the history of
+// room. Unknown rooms have no history and are not an error.
+func (a *api) authorizeHistory(r *http.Request, name string) error {
+	room, err := a.db.getRoom(r.Context(), name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil
+		}
+		return httpe.ErrInternalServerError
+	}
+	if !room.Private {
+		return nil
+	}
+	u, err := a.authenticate(r, scopeHistoryRead)
+	if err != nil {
+		return err
+	}
+	if err := a.auth.canAccess(r.Context(), u, room); err != nil {
+		return authzErr(err)
+	}
+	return nil
+}
+
+// message dispatches requests to /api/message/ID/... with the
+// /api/message/ prefix stripped.
+func (a *api) message(w http.ResponseWriter, r *http.Request) error {
+	segments, err := pathSegments(r)
+	if err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(segments[0])
+	if err != nil {
+		return httpe.ErrNotFound
+	}
+	if len(segments) == 1 || (len(segments) == 2 && segments[1] == "") {
+		switch r.Method {
+		case http.MethodPatch:
+			return a.patchMessage(w, r, id)
+		case http.MethodDelete:
+			return a.removeMessage(w, r, id)
+		}
+		return httpe.ErrMethodNotAllowed
+	}
+	switch strings.Join(segments[1:], "/") {
+	case "edits":
+		if r.Method != http.MethodGet {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.messageEdits(w, r, id)
+	case "thread":
+		if r.Method != http.MethodGet {
+			return httpe.ErrMethodNotAllowed
+		}
+		return a.thread(w, r, id)
+	}
+	return httpe.ErrNotFound
+}
+
+// patchMessage replaces the content of the authenticated user's message
+// id, see api.editMessage.
+func (a *api) patchMessage(w http.ResponseWriter, r *http.Request, id int) error {
+	u, err := a.authenticate(r, scopeMessagesWrite)
+	if err != nil {
+		return err
+	}
+	req := messageRequest{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	m, err := a.editMessage(r.Context(), u, id, req.Content)
+	if err != nil {
+		var v validationErrors
+		switch {
+		case errors.As(err, &v):
+			return writeValidationErrors(w, v)
+		case errors.Is(err, errDBNotFound):
+			return httpe.ErrNotFound
+		}
+		return authzErr(err)
+	}
+	return json.NewEncoder(w).Encode(m)
+}
+
+// removeMessage deletes message id, see api.deleteMessage.
+func (a *api) removeMessage(w http.ResponseWriter, r *http.Request, id int) error {
+	u, err := a.authenticate(r, scopeMessagesWrite)
+	if err != nil {
+		return err
+	}
+	if _, err := a.deleteMessage(r.Context(), u, id); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return authzErr(err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// messageEdits returns the prior versions of message id to users who
+// may read the history of its room.
+func (a *api) messageEdits(w http.ResponseWriter, r *http.Request, id int) error {
+	m, err := a.db.getMessage(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	if err := a.authorizeHistory(r, m.Room); err != nil {
+		return err
+	}
+	edits, err := a.db.queryMessageEdits(r.Context(), id)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(edits)
+}
+
+// thread returns the message id starting a thread with a page of its
+// replies, newest first. Pages of up to limit replies are continued
+// with before set to the last reply ID of the previous page.
+func (a *api) thread(w http.ResponseWriter, r *http.Request, id int) error {
+	ctx := r.Context()
+	parent, err := a.db.getMessage(ctx, id)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	if parent.Parent != 0 {
+		return errs.Errorf("%v: message %d is a reply", httpe.ErrNotFound, id)
+	}
+	if err := a.authorizeHistory(r, parent.Room); err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	beforeID := -1
+	if before := q.Get("before"); before != "" {
+		if beforeID, err = strconv.Atoi(before); err != nil {
+			return httpe.ErrBadRequest
+		}
+	}
+	limit := defaultReplies
+	if l := q.Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxReplies {
+			return errs.Errorf("%v: limit must be between 1 and %d", httpe.ErrBadRequest, maxReplies)
+		}
+	}
+	replies, err := a.db.queryReplies(ctx, id, beforeID, limit)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	if err := a.db.setThreadStats(ctx, []*Message{parent}); err != nil {
+		return httpe.ErrInternalServerError
+	}
+	if err := a.db.setReactions(ctx, append([]*Message{parent}, replies...), a.viewerName(r)); err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(Thread{Parent: parent, Replies: replies})
+}
+
+type joinRequest struct {
+	Invite string `json:"invite"`
+}
+
+// joinRoom makes the authenticated user a member of room name. Private
+// rooms can only be joined with an invite.
+func (a *api) joinRoom(w http.ResponseWriter, r *http.Request, name string) error {
+	u, err := a.authenticate(r, scopeRoomsWrite)
+	if err != nil {
+		return err
+	}
+	req := joinRequest{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	room, err := a.db.getRoom(r.Context(), name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	if err := a.auth.checkBanned(r.Context(), u, name); err != nil {
+		return authzErr(err)
+	}
+	switch {
+	case req.Invite != "":
+		err = a.db.joinRoomWithInvite(r.Context(), name, u.Name, hashToken(req.Invite), now(), time.Now().Unix())
+		if errors.Is(err, errDBNotFound) {
+			return errs.Errorf("%v: invalid invite: %v", httpe.ErrForbidden, err)
+		}
+	case room.Private:
+		if err := a.auth.canAccess(r.Context(), u, room); err != nil {
+			return authzErr(err)
+		}
+		err = a.db.joinRoom(r.Context(), name, u.Name, now()) // admins need no invite
+	default:
+		err = a.db.joinRoom(r.Context(), name, u.Name, now())
+	}
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(room)
+}
+
+// leaveRoom removes the authenticated user from the members of room
+// name. They lose any role in the room and, for private rooms, their
+// subscriptions.
+func (a *api) leaveRoom(w http.ResponseWriter, r *http.Request, name string) error {
+	u, err := a.authenticate(r, scopeRoomsWrite)
+	if err != nil {
+		return err
+	}
+	if err := a.db.leaveRoom(r.Context(), name, u.Name); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	if room, err := a.db.getRoom(r.Context(), name); err == nil && room.Private {
+		a.unsubscribeRevoked(r.Context(), room)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// invites lists the invites to room name without the tokens
+// themselves.
+func (a *api) invites(w http.ResponseWriter, r *http.Request, name string) error {
+	if _, err := a.authorize(r, scopeRoomsWrite, name, roleModerator); err != nil {
+		return err
+	}
+	invites, err := a.db.queryInvites(r.Context(), name)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(invites)
+}
+
+// createInvite creates an invite to room name. The token is only
+// returned once.
+func (a *api) createInvite(w http.ResponseWriter, r *http.Request, name string) error {
+	u, err := a.authorize(r, scopeRoomsWrite, name, roleModerator)
+	if err != nil {
+		return err
+	}
+	req := inviteRequest{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	if err := req.validate(); err != nil {
+		var v validationErrors
+		errors.As(err, &v)
+		return writeValidationErrors(w, v)
+	}
+	token, err := newRandomToken()
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	inv := &Invite{Room: name, CreatedBy: u.Name, CreatedAt: now(), MaxUses: req.MaxUses, Token: token}
+	if err := a.db.createInvite(r.Context(), hashToken(token), req.expiresAt(time.Now()), inv); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(inv)
+}
+
+// deleteInvite revokes the invite with given ID to room name.
+func (a *api) deleteInvite(w http.ResponseWriter, r *http.Request, name, idStr string) error {
+	if _, err := a.authorize(r, scopeRoomsWrite, name, roleModerator); err != nil {
+		return err
+	}
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpe.ErrNotFound
+	}
+	if err := a.db.deleteInvite(r.Context(), name, id); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// moderate kicks, bans, unbans, mutes or unmutes a user in room name
+// and records it in the moderation log. Moderators can only act on
+// users with a lower role than their own.
+func (a *api) moderate(w http.ResponseWriter, r *http.Request, name string) error {
+	u, err := a.authorize(r, scopeRoomsWrite, name, roleModerator)
+	if err != nil {
+		return err
+	}
+	req := moderationRequest{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	if err := req.validate(); err != nil {
+		var v validationErrors
+		errors.As(err, &v)
+		return writeValidationErrors(w, v)
+	}
+	ctx := r.Context()
+	if _, err := a.db.getUser(ctx, req.User); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	modRole, err := a.auth.roleOf(ctx, u, name)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	userRole, err := a.auth.roleOf(ctx, &User{Name: req.User}, name)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	if userRole >= modRole {
+		return errs.Errorf("%v: %s role cannot %s %s", httpe.ErrForbidden, modRole, req.Action, userRole)
+	}
+	e := &ModerationEntry{
+		Room:      name,
+		Moderator: u.Name,
+		User:      req.User,
+		Action:    req.Action,
+		Reason:    req.Reason,
+		CreatedAt: now(),
+	}
+	if err := a.db.moderate(ctx, e, req.expiresAt(time.Now())); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return errs.Errorf("%v: %v", httpe.ErrNotFound, err)
+		}
+		return httpe.ErrInternalServerError
+	}
+	if req.Action == actionKick || req.Action == actionBan {
+		a.hub.unsubscribeUser(name, req.User)
+	}
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(e)
+}
+
+// moderationLog returns the latest moderation log entries of room name.
+func (a *api) moderationLog(w http.ResponseWriter, r *http.Request, name string) error {
+	if _, err := a.authorize(r, scopeRoomsWrite, name, roleModerator); err != nil {
+		return err
+	}
+	entries, err := a.db.queryModerationLog(r.Context(), name, moderationLogLimit)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// sanctions returns the current bans and mutes in room name.
+func (a *api) sanctions(w http.ResponseWriter, r *http.Request, name string) error {
+	if _, err := a.authorize(r, scopeRoomsWrite, name, roleModerator); err != nil {
+		return err
+	}
+	sanctions, err := a.db.querySanctions(r.Context(), name, time.Now().Unix())
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(sanctions)
+}
+
+func (a *api) conversations(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+		return a.listConversations(w, r)
+	case http.MethodPost:
+		return a.createConversation(w, r)
+	}
+	return httpe.ErrMethodNotAllowed
+}
+
+// listConversations lists the authenticated user's conversations with
+// their latest message, most recently active first.
+func (a *api) listConversations(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.authenticate(r, scopeHistoryRead)
+	if err != nil {
+		return err
+	}
+	conversations, err := a.db.queryConversations(r.Context(), u.Name)
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	return json.NewEncoder(w).Encode(conversations)
+}
+
+// createConversation returns the conversation of the authenticated user
+// with the requested participants, creating it if there is none yet.
+func (a *api) createConversation(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.authenticate(r, scopeMessagesWrite)
+	if err != nil {
+		return err
+	}
+	req := conversationRequest{}
+	defer r.Body.Close() //nolint: errcheck
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errs.Errorf("%v: JSON parse error: %v", httpe.ErrBadRequest, err)
+	}
+	participants, err := req.participants(u.Name)
+	if err != nil {
+		var v validationErrors
+		errors.As(err, &v)
+		return writeValidationErrors(w, v)
+	}
+	token, err := newRandomToken()
+	if err != nil {
+		return httpe.ErrInternalServerError
+	}
+	c, created, err := a.db.getOrCreateConversation(r.Context(), participants, conversationPrefix+token, u.Name, now())
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			msg := "participants must be existing users"
+			return writeValidationErrors(w, validationErrors{{Field: "participants", Code: "invalid", Message: msg}})
+		}
+		return httpe.ErrInternalServerError
+	}
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	return json.NewEncoder(w).Encode(c)
+}
+
+func (a *api) version(w http.ResponseWriter, r *http.Request) error {
+	return json.NewEncoder(w).Encode(a.ver)
+}
+
+const testUser = "$user"
+
+// testCleanup deletes the test user created by API tests. It can only
+// be called by the test user itself or an admin.
+func (a *api) testCleanup(_ http.ResponseWriter, r *http.Request) error {
+	u, err := a.authenticate(r, scopeAccountWrite)
+	if err != nil {
+		return err
+	}
+	if u.Name != testUser {
+		if err := a.auth.authorize(r.Context(), u, "", roleAdmin); err != nil {
+			return authzErr(err)
+		}
+	}
+	if err := a.db.deleteUser(r.Context(), testUser, true); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return httpe.ErrNotFound
+		}
+		return httpe.ErrInternalServerError
+	}
+	return nil
 }
@@ -1,16 +1,25 @@
 package foxtrot
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -105,7 +114,7 @@ func (s *APITestSuite) TestLogin() {
 	u := User{}
 	err := json.Unmarshal([]byte(body), &u)
 	require.NoError(t, err, body)
-	want := User{Name: "$Fox", JWT: u.JWT}
+	want := User{Name: "$Fox", AvatarURL: "/api/user/$Fox/avatar", JWT: u.JWT}
 	require.Equal(t, want, u)
 	require.NotEmpty(t, u.JWT)
 	require.Equal(t, 2, strings.Count(u.JWT, "."))
@@ -136,13 +145,15 @@ func (s *APITestSuite) TestRegister() {
 	u := User{}
 	err := json.Unmarshal([]byte(body), &u)
 	require.NoError(t, err, body)
-	want := User{Name: testUser, JWT: u.JWT}
+	want := User{Name: testUser, AvatarURL: avatarURL(testUser), JWT: u.JWT}
 	require.Equal(t, want, u)
 	require.NotEmpty(t, u.JWT)
 	require.Equal(t, 2, strings.Count(u.JWT, "."))
 
 	relURL = "/api/_test_cleanup"
 	_, status = httpDelete(t, s.baseURL+relURL)
+	require.Equal(t, http.StatusUnauthorized, status)
+	_, status = httpDoAuth(t, http.MethodDelete, s.baseURL+relURL, "", u.JWT)
 	require.Equal(t, http.StatusOK, status)
 }
 
@@ -175,6 +186,112 @@ func (s *APITestSuite) TestRegisterErr() {
 	payload = `{"BAD_JSON`
 	body, status = httpPost(t, s.baseURL+relURL, payload)
 	require.Equal(t, http.StatusBadRequest, status, body)
+
+	payload = `{"name": "$FOX", "password": "Pa$$w0rd"}` // case-insensitive duplicate
+	body, status = httpPost(t, s.baseURL+relURL, payload)
+	require.Equal(t, http.StatusBadRequest, status, body)
+	want := `{"error": "validation failed", "fields": [
+	  {"field": "name", "code": "taken", "message": "name is already taken"}
+	]}`
+	require.JSONEq(t, want, body)
+
+	payload = `{"name": "$user\u0007", "password": ""}`
+	body, status = httpPost(t, s.baseURL+relURL, payload)
+	require.Equal(t, http.StatusBadRequest, status, body)
+	v := validationResponse{}
+	require.NoError(t, json.Unmarshal([]byte(body), &v), body)
+	require.Equal(t, 2, len(v.Fields), body)
+	require.Equal(t, "invalid_characters", v.Fields[0].Code)
+	require.Equal(t, "password", v.Fields[1].Field)
+	require.Equal(t, "too_short", v.Fields[1].Code)
+}
+
+func (s *APITestSuite) TestChangePassword() {
+	t := s.T()
+	payload := fmt.Sprintf(`{"name": "%s", "password": "Pa$$w0rd"}`, testUser)
+	body, status := httpPost(t, s.baseURL+"/api/register", payload)
+	require.Equal(t, http.StatusOK, status, body)
+	u := User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	defer func() {
+		_, status := httpDoAuth(t, http.MethodDelete, s.baseURL+"/api/_test_cleanup", "", u.JWT)
+		require.Equal(t, http.StatusOK, status)
+	}()
+
+	relURL := "/api/user/" + url.PathEscape(testUser) + "/password"
+	payload = `{"oldPassword": "WRONG_PASSWORD", "newPassword": "n3w-Pa$$w0rd"}`
+	_, status = httpPost(t, s.baseURL+relURL, payload)
+	require.Equal(t, http.StatusForbidden, status)
+
+	payload = `{"oldPassword": "Pa$$w0rd"}`
+	_, status = httpPost(t, s.baseURL+relURL, payload)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	payload = `{"newPassword": "n3w-Pa$$w0rd"}`
+	_, status = httpPost(t, s.baseURL+relURL, payload)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	payload = `{"oldPassword": "Pa$$w0rd", "newPassword": "n3w-Pa$$w0rd"}`
+	body, status = httpPost(t, s.baseURL+relURL, payload)
+	require.Equal(t, http.StatusNoContent, status, body)
+	require.Empty(t, body)
+
+	payload = fmt.Sprintf(`{"name": "%s", "password": "n3w-Pa$$w0rd"}`, testUser)
+	body, status = httpPost(t, s.baseURL+"/api/login", payload)
+	require.Equal(t, http.StatusOK, status)
+	u = User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+}
+
+func TestAdminPasswordReset(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}, PasswordResetTTL: time.Hour}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+
+	relURL := "/api/user/$Fox/password-reset"
+	_, status := httpDoAuth(t, http.MethodPost, server.URL+relURL, "", foxJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/user/$MISSING/password-reset", "", goatJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+relURL, "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	pr := passwordReset{}
+	require.NoError(t, json.Unmarshal([]byte(body), &pr), body)
+	require.NotEmpty(t, pr.ResetToken)
+
+	relURL = "/api/user/$Fox/password"
+	payload := fmt.Sprintf(`{"resetToken": "%s", "newPassword": "n3w-Pa$$w0rd"}`, pr.ResetToken)
+	body, status = httpPost(t, server.URL+relURL, payload)
+	require.Equal(t, http.StatusOK, status, body)
+	_, status = httpPost(t, server.URL+relURL, payload)
+	require.Equal(t, http.StatusForbidden, status) // single use
+
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+relURL, `{"newPassword": "Pa$$w0rd"}`, foxJWT)
+	require.Equal(t, http.StatusUnauthorized, status) // revoked by password change
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+relURL, `{"newPassword": "Pa$$w0rd"}`, goatJWT)
+	require.Equal(t, http.StatusOK, status)
+	login(t, server.URL, "$Fox", "Pa$$w0rd")
+
+	_, status = httpGet(t, server.URL+relURL)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+	_, status = httpPost(t, server.URL+"/api/user/$Fox/MISSING", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func login(t *testing.T, baseURL, name, password string) string {
+	t.Helper()
+	payload := fmt.Sprintf(`{"name": "%s", "password": "%s"}`, name, password)
+	body, status := httpPost(t, baseURL+"/api/login", payload)
+	require.Equal(t, http.StatusOK, status, body)
+	u := User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	return u.JWT
 }
 
 func httpGet(t *testing.T, url string) (string, int) {
@@ -193,6 +310,12 @@ func httpDelete(t *testing.T, url string) (string, int) {
 }
 
 func httpDo(t *testing.T, method, url, body string) (string, int) {
+	t.Helper()
+	return httpDoAuth(t, method, url, body, "")
+}
+
+// httpDoAuth is like httpDo but sets jwt as bearer token if not empty.
+func httpDoAuth(t *testing.T, method, url, body, jwt string) (string, int) {
 	t.Helper()
 	var bodyReader io.Reader
 	if body != "" {
@@ -200,6 +323,9 @@ func httpDo(t *testing.T, method, url, body string) (string, int) {
 	}
 	req, err := http.NewRequestWithContext(context.Background(), method, url, bodyReader)
 	require.NoError(t, err)
+	if jwt != "" {
+		req.Header.Set("Authorization", "Bearer "+jwt)
+	}
 
 	resp, err := http.DefaultClient.Do(req) //nolint:gosec, noctx
 	require.NoErrorf(t, err, "cannot %s %s", method, url)
@@ -211,3 +337,1034 @@ func httpDo(t *testing.T, method, url, body string) (string, int) {
 	require.NoError(t, err, "cannot read body "+url)
 	return string(b), resp.StatusCode
 }
+
+func TestLoginThrottled(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", LoginLockout: time.Minute, LoginMaxFailures: 1}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	payload := `{"name": "$Fox", "password": "WRONG_PASSWORD"}`
+	_, status := httpPost(t, server.URL+"/api/login", payload)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	payload = `{"name": "$Fox", "password": "Pa$$w0rd"}`
+	loginURL := server.URL + "/api/login"
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, loginURL, strings.NewReader(payload))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "60", resp.Header.Get("Retry-After"))
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	require.NoError(t, err)
+	a := &api{trustedProxies: proxies}
+	tests := map[string]struct {
+		remoteAddr string
+		forwarded  []string
+		want       string
+	}{
+		"direct":              {remoteAddr: "1.2.3.4:5000", want: "1.2.3.4"},
+		"untrusted forwarded": {remoteAddr: "1.2.3.4:5000", forwarded: []string{"5.6.7.8"}, want: "1.2.3.4"},
+		"trusted forwarded":   {remoteAddr: "10.1.1.1:5000", forwarded: []string{"5.6.7.8"}, want: "5.6.7.8"},
+		"trusted ip":          {remoteAddr: "192.168.1.1:5000", forwarded: []string{"5.6.7.8"}, want: "5.6.7.8"},
+		"untrusted ip":        {remoteAddr: "192.168.1.2:5000", forwarded: []string{"5.6.7.8"}, want: "192.168.1.2"},
+		"trusted no header":   {remoteAddr: "10.1.1.1:5000", want: "10.1.1.1"},
+		"chain":               {remoteAddr: "10.1.1.1:5000", forwarded: []string{"5.6.7.8, 10.2.2.2"}, want: "5.6.7.8"},
+		"multiple headers":    {remoteAddr: "10.1.1.1:5000", forwarded: []string{"6.6.6.6", "5.6.7.8"}, want: "5.6.7.8"},
+		"all trusted":         {remoteAddr: "10.1.1.1:5000", forwarded: []string{"10.3.3.3, 10.2.2.2"}, want: "10.3.3.3"},
+		"garbage":             {remoteAddr: "10.1.1.1:5000", forwarded: []string{"5.6.7.8, garbage"}, want: "10.1.1.1"},
+		"ipv6":                {remoteAddr: "[fd00::1]:5000", forwarded: []string{"2001:db8::1"}, want: "2001:db8::1"},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/login", nil)
+			r.RemoteAddr = tc.remoteAddr
+			for _, f := range tc.forwarded {
+				r.Header.Add("X-Forwarded-For", f)
+			}
+			require.Equal(t, tc.want, a.clientIP(r))
+		})
+	}
+
+	_, err = parseTrustedProxies([]string{"10.0.0.0/33"})
+	requireErrIs(t, err, errTrustedProxy)
+	_, err = parseTrustedProxies([]string{"proxy.local"})
+	requireErrIs(t, err, errTrustedProxy)
+}
+
+func TestTOTPLoginAPI(t *testing.T) {
+	mux := http.NewServeMux()
+	_, err := NewApp(&Config{DSN: ":memory:"}, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	relURL := "/api/user/$Fox/totp"
+	_, status := httpDoAuth(t, http.MethodPost, server.URL+relURL, "", goatJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+relURL, "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	e := totpEnrolment{}
+	require.NoError(t, json.Unmarshal([]byte(body), &e), body)
+	require.NotEmpty(t, e.QRCode)
+
+	payload := fmt.Sprintf(`{"code": "%s"}`, currentTOTP(t, e.Secret, 0))
+	body, status = httpDoAuth(t, http.MethodPost, server.URL+relURL+"/confirm", payload, foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	rc := recoveryCodes{}
+	require.NoError(t, json.Unmarshal([]byte(body), &rc), body)
+	require.Len(t, rc.RecoveryCodes, recoveryCodeCount)
+
+	body, status = httpPost(t, server.URL+"/api/login", `{"name": "$Fox", "password": "Pa$$w0rd"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	sf := secondFactor{}
+	require.NoError(t, json.Unmarshal([]byte(body), &sf), body)
+	require.Equal(t, secondFactor{Name: "$Fox", SecondFactor: "totp", Challenge: sf.Challenge}, sf)
+	require.NotContains(t, body, "jwt")
+
+	payload = fmt.Sprintf(`{"challenge": "%s", "code": "000000"}`, sf.Challenge)
+	_, status = httpPost(t, server.URL+"/api/login/totp", payload)
+	require.Equal(t, http.StatusUnauthorized, status)
+	payload = fmt.Sprintf(`{"challenge": "%s", "code": "%s"}`, sf.Challenge, rc.RecoveryCodes[0])
+	body, status = httpPost(t, server.URL+"/api/login/totp", payload)
+	require.Equal(t, http.StatusOK, status, body)
+	u := User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	require.NotEmpty(t, u.JWT)
+
+	// changing the password with the old one requires a second factor
+	pwURL := server.URL + "/api/user/$Fox/password"
+	payload = `{"oldPassword": "Pa$$w0rd", "newPassword": "n3w-Pa$$w0rd"}`
+	_, status = httpPost(t, pwURL, payload)
+	require.Equal(t, http.StatusForbidden, status)
+	payload = `{"oldPassword": "Pa$$w0rd", "code": "000000", "newPassword": "n3w-Pa$$w0rd"}`
+	_, status = httpPost(t, pwURL, payload)
+	require.Equal(t, http.StatusForbidden, status)
+	payload = fmt.Sprintf(`{"oldPassword": "Pa$$w0rd", "code": "%s", "newPassword": "n3w-Pa$$w0rd"}`, rc.RecoveryCodes[2])
+	body, status = httpPost(t, pwURL, payload)
+	require.Equal(t, http.StatusNoContent, status, body)
+	require.NotContains(t, body, "jwt")
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/user/$Fox/roles", "", u.JWT)
+	require.Equal(t, http.StatusUnauthorized, status)
+	body, status = httpPost(t, server.URL+"/api/login", `{"name": "$Fox", "password": "n3w-Pa$$w0rd"}`)
+	require.Equal(t, http.StatusOK, status, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &sf), body)
+	payload = fmt.Sprintf(`{"challenge": "%s", "code": "%s"}`, sf.Challenge, rc.RecoveryCodes[3])
+	body, status = httpPost(t, server.URL+"/api/login/totp", payload)
+	require.Equal(t, http.StatusOK, status, body)
+	u = User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+
+	payload = fmt.Sprintf(`{"code": "%s"}`, rc.RecoveryCodes[1])
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+relURL, payload, u.JWT)
+	require.Equal(t, http.StatusNoContent, status)
+	login(t, server.URL, "$Fox", "n3w-Pa$$w0rd")
+	_, status = httpDoAuth(t, http.MethodPut, server.URL+relURL, "", u.JWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+}
+
+func TestAccessTokensAPI(t *testing.T) {
+	mux := http.NewServeMux()
+	_, err := NewApp(&Config{DSN: ":memory:"}, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	tokensURL := server.URL + "/api/user/$Fox/tokens"
+	payload := `{"name": "bot", "scopes": ["history:read"]}`
+	body, status := httpDoAuth(t, http.MethodPost, tokensURL, payload, foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	readTok := AccessToken{}
+	require.NoError(t, json.Unmarshal([]byte(body), &readTok), body)
+	require.NotEmpty(t, readTok.Token)
+
+	body, status = httpDoAuth(t, http.MethodPost, tokensURL, payload, foxJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, `"taken"`)
+	body, status = httpDoAuth(t, http.MethodPost, tokensURL, `{"name": "x", "scopes": ["root"]}`, foxJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, `"invalid"`)
+
+	_, status = httpDoAuth(t, http.MethodGet, tokensURL, "", readTok.Token)
+	require.Equal(t, http.StatusForbidden, status) // missing account:write scope
+	payload = `{"name": "admin-bot", "scopes": ["account:write"]}`
+	body, status = httpDoAuth(t, http.MethodPost, tokensURL, payload, foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	accountTok := AccessToken{}
+	require.NoError(t, json.Unmarshal([]byte(body), &accountTok), body)
+
+	body, status = httpDoAuth(t, http.MethodGet, tokensURL, "", accountTok.Token)
+	require.Equal(t, http.StatusOK, status, body)
+	tokens := []AccessToken{}
+	require.NoError(t, json.Unmarshal([]byte(body), &tokens), body)
+	require.Len(t, tokens, 2)
+	require.Empty(t, tokens[0].Token)
+	require.NotEmpty(t, tokens[0].LastUsedAt) // authenticated, though lacking scope
+	require.NotEmpty(t, tokens[1].LastUsedAt)
+
+	tokenURL := fmt.Sprintf("%s/%d", tokensURL, accountTok.ID)
+	_, status = httpDoAuth(t, http.MethodDelete, tokenURL, "", foxJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodGet, tokensURL, "", accountTok.Token)
+	require.Equal(t, http.StatusUnauthorized, status) // revoked
+	_, status = httpDoAuth(t, http.MethodDelete, tokenURL, "", foxJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/user/$Goat/tokens", "", foxJWT)
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestCookieSession(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", CookieSession: true, CookieSameSite: "strict", CookieInsecure: true}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+	do := func(method, relURL, body, csrf string) (string, int) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(context.Background(), method, server.URL+relURL, strings.NewReader(body))
+		require.NoError(t, err)
+		if csrf != "" {
+			req.Header.Set(csrfHeader, csrf)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close() //nolint:errcheck
+		b, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(b), resp.StatusCode
+	}
+
+	body, status := do(http.MethodPost, "/api/login", `{"name": "$Fox", "password": "Pa$$w0rd"}`, "")
+	require.Equal(t, http.StatusOK, status, body)
+	require.NotContains(t, body, "jwt")
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	csrf := ""
+	for _, c := range jar.Cookies(serverURL) {
+		if c.Name == csrfCookie {
+			csrf = c.Value
+		}
+	}
+	require.NotEmpty(t, csrf)
+
+	body, status = do(http.MethodGet, "/api/user/$Fox/tokens", "", "")
+	require.Equal(t, http.StatusOK, status, body)
+	payload := `{"name": "bot", "scopes": ["history:read"]}`
+	_, status = do(http.MethodPost, "/api/user/$Fox/tokens", payload, "")
+	require.Equal(t, http.StatusForbidden, status) // missing CSRF token
+	_, status = do(http.MethodPost, "/api/user/$Fox/tokens", payload, "WRONG")
+	require.Equal(t, http.StatusForbidden, status)
+	body, status = do(http.MethodPost, "/api/user/$Fox/tokens", payload, csrf)
+	require.Equal(t, http.StatusOK, status, body)
+
+	_, status = do(http.MethodPost, "/api/logout", "", "")
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = do(http.MethodGet, "/api/user/$Fox/tokens", "", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37") // bearer tokens are not returned in cookie mode
+	require.Empty(t, goatJWT)
+}
+
+func TestRolesAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	app, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	rolesURL := server.URL + "/api/user/$Fox/roles"
+	payload := `{"role": "owner", "room": "$Kitchen"}`
+	_, status := httpDoAuth(t, http.MethodPost, rolesURL, payload, foxJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodPost, rolesURL, payload, goatJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodPost, rolesURL, `{"role": "owner", "room": "$MISSING"}`, goatJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodPost, rolesURL, `{"role": "admin", "room": "$Kitchen"}`, goatJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// Room owners manage moderators and members of their room.
+	require.NoError(t, app.GrantRole(context.Background(), "$Cat", "member", "$Shed"))
+	payload = `{"role": "moderator", "room": "$Kitchen"}`
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/user/$Goat/roles", payload, foxJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	payload = `{"role": "moderator", "room": "$Shed"}`
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/user/$Goat/roles", payload, foxJWT)
+	require.Equal(t, http.StatusForbidden, status)
+
+	body, status := httpDoAuth(t, http.MethodGet, server.URL+"/api/user/$Goat/roles", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	roles := []Role{}
+	require.NoError(t, json.Unmarshal([]byte(body), &roles), body)
+	require.Equal(t, []Role{{Role: "moderator", Room: "$Kitchen"}}, roles) // config admins are not stored
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/user/$Goat/roles", "", foxJWT)
+	require.Equal(t, http.StatusForbidden, status)
+
+	_, status = httpDoAuth(t, http.MethodDelete, rolesURL, `{"role": "owner", "room": "$Kitchen"}`, goatJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodDelete, rolesURL, `{"role": "owner", "room": "$Kitchen"}`, goatJWT)
+	require.Equal(t, http.StatusNotFound, status)
+
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/_test_cleanup", "", foxJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/_test_cleanup", "", goatJWT)
+	require.Equal(t, http.StatusNotFound, status) // no test user
+}
+
+func TestProfileAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	profileURL := server.URL + "/api/user/$Fox"
+	_, status := httpGet(t, profileURL)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	payload := `{"displayName": "Mr. Fox", "bio": "Cunning.", "timezone": "Europe/London"}`
+	body, status := httpDoAuth(t, http.MethodPatch, profileURL, payload, foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	want := User{Name: "$Fox", DisplayName: "Mr. Fox", Bio: "Cunning.", Timezone: "Europe/London",
+		AvatarURL: "/api/user/$Fox/avatar"}
+	u := User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	require.Equal(t, want, u)
+
+	_, status = httpDoAuth(t, http.MethodPatch, profileURL, `{"status": "away"}`, catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	body, status = httpDoAuth(t, http.MethodPatch, profileURL, `{"status": "away"}`, goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	body, status = httpDoAuth(t, http.MethodPatch, profileURL, `{"timezone": "Nowhere"}`, foxJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, `"timezone"`)
+
+	body, status = httpDoAuth(t, http.MethodGet, profileURL+"/", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	u = User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	want.Status = "away"
+	require.Equal(t, want, u)
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/user/$MISSING", "", catJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodPatch, server.URL+"/api/user/$MISSING", "{}", goatJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodPut, profileURL, "{}", foxJWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+
+	_, status = httpGet(t, server.URL+"/api/users?prefix=mr")
+	require.Equal(t, http.StatusUnauthorized, status)
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/users?prefix=mr", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	users := []User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &users), body)
+	require.Equal(t, []User{want}, users)
+}
+
+func uploadAvatar(t *testing.T, url, filename string, content []byte, jwt string) (string, int) {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, err := mw.CreateFormFile("avatar", filename)
+	require.NoError(t, err)
+	_, err = fw.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, mw.Close())
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, body)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	resp, err := http.DefaultClient.Do(req) //nolint:gosec, noctx
+	require.NoError(t, err)
+	defer resp.Body.Close() //nolint:errcheck
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(b), resp.StatusCode
+}
+
+func TestAvatarAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	avatarURL := server.URL + "/api/user/$Fox/avatar"
+	identicon, status := httpGet(t, avatarURL)
+	require.Equal(t, http.StatusOK, status)
+	_, status = httpGet(t, server.URL+"/api/user/$MISSING/avatar")
+	require.Equal(t, http.StatusNotFound, status)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, jpeg.Encode(buf, testImage(400, 300), nil))
+	body, status := uploadAvatar(t, avatarURL, "fox.jpg", buf.Bytes(), foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	u := User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	require.Equal(t, "/api/user/$Fox/avatar", u.AvatarURL)
+
+	_, status = uploadAvatar(t, avatarURL, "fox.jpg", buf.Bytes(), catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = uploadAvatar(t, avatarURL, "fox.svg", []byte("<svg></svg>"), foxJWT)
+	require.Equal(t, http.StatusUnsupportedMediaType, status)
+	_, status = uploadAvatar(t, avatarURL, "fox.png", make([]byte, maxAvatarBytes+1), foxJWT)
+	require.Equal(t, http.StatusRequestEntityTooLarge, status)
+
+	resp, err := http.Get(avatarURL + "?size=32") //nolint:noctx
+	require.NoError(t, err)
+	defer resp.Body.Close() //nolint:errcheck
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	etag := resp.Header.Get("ETag")
+	require.NotEmpty(t, etag)
+	require.NotEmpty(t, resp.Header.Get("Cache-Control"))
+	img, err := png.Decode(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 32, 32), img.Bounds())
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, avatarURL+"?size=32", nil)
+	require.NoError(t, err)
+	req.Header.Set("If-None-Match", etag)
+	resp2, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp2.Body.Close() //nolint:errcheck
+	require.Equal(t, http.StatusNotModified, resp2.StatusCode)
+
+	body, status = httpGet(t, avatarURL)
+	require.Equal(t, http.StatusOK, status)
+	img, err = png.Decode(strings.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, avatarSize, avatarSize), img.Bounds())
+	for _, size := range []string{"33", "1000", "-1"} {
+		_, status = httpGet(t, avatarURL+"?size="+size)
+		require.Equal(t, http.StatusBadRequest, status, size)
+	}
+
+	_, status = httpDoAuth(t, http.MethodDelete, avatarURL, "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	body, status = httpDoAuth(t, http.MethodDelete, avatarURL, "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Contains(t, body, `"avatarURL":"/api/user/$Fox/avatar"`)
+	body, status = httpGet(t, avatarURL)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, identicon, body)
+}
+
+func TestIdenticonAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:"}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	avatarURL := server.URL + "/api/user/$Fox/avatar"
+	resp, err := http.Get(avatarURL + "?size=64&format=svg") //nolint:noctx
+	require.NoError(t, err)
+	defer resp.Body.Close() //nolint:errcheck
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "image/svg+xml", resp.Header.Get("Content-Type"))
+	require.NotEmpty(t, resp.Header.Get("ETag"))
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, string(newIdenticon("$Fox").svg(64)), string(b))
+
+	body, status := httpGet(t, avatarURL+"?size=64&format=png")
+	require.Equal(t, http.StatusOK, status)
+	img, err := png.Decode(strings.NewReader(body))
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 64, 64), img.Bounds())
+	_, status = httpGet(t, avatarURL+"?format=gif")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestDeleteAccountAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:"}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	foxURL := server.URL + "/api/user/$Fox"
+	_, status := httpDoAuth(t, http.MethodDelete, foxURL+"?messages=anonymise", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodDelete, foxURL, "", foxJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	_, status = httpDoAuth(t, http.MethodDelete, foxURL+"?messages=anonymise", "", foxJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodGet, foxURL, "", foxJWT)
+	require.Equal(t, http.StatusUnauthorized, status)
+	_, status = httpDoAuth(t, http.MethodGet, foxURL, "", catJWT)
+	require.Equal(t, http.StatusNotFound, status)
+
+	body, status := httpGet(t, server.URL+"/api/history?room=$Kitchen")
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, body, `"$Fox"`)
+	require.Contains(t, body, `"author":"[deleted]"`)
+
+	// a new user of the same name does not inherit the old JWT
+	_, status = httpPost(t, server.URL+"/api/register", `{"name": "$Fox", "password": "Pa$$w0rd"}`)
+	require.Equal(t, http.StatusOK, status)
+	_, status = httpDoAuth(t, http.MethodGet, foxURL, "", foxJWT)
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/user/$Cat?messages=delete", "", catJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	body, status = httpGet(t, server.URL+"/api/history?room=$Shed")
+	require.Equal(t, http.StatusOK, status)
+	require.NotContains(t, body, `"$Cat"`)
+	_, status = httpPost(t, server.URL+"/api/login", `{"name": "[deleted]", "password": "!"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+}
+
+func TestExportAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:"}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	exportURL := server.URL + "/api/user/$Fox/export"
+	_, status := httpDoAuth(t, http.MethodGet, exportURL, "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodPost, exportURL, "", foxJWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, exportURL, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+foxJWT)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close() //nolint:errcheck
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/zip", resp.Header.Get("Content-Type"))
+	require.Contains(t, resp.Header.Get("Content-Disposition"), "attachment; filename=foxtrot-export-")
+	b, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	files := readZip(t, b)
+	require.Contains(t, string(files["profile.json"]), `"name": "$Fox"`)
+	require.NotContains(t, string(files["profile.json"]), "jwt")
+	require.Contains(t, string(files["messages.json"]), `"Yes."`)
+}
+
+func TestRoomsAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	_, status := httpPost(t, server.URL+"/api/room", `{"name": "$Attic"}`)
+	require.Equal(t, http.StatusUnauthorized, status)
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/room", `{"name": "$Attic"}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	room := decodeRoom(t, body)
+	require.Equal(t, "$Attic", room.Name)
+	require.Equal(t, "$Fox", room.CreatedBy)
+	require.NotEmpty(t, room.CreatedAt)
+	body, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room", `{"name": "$Attic"}`, catJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, `"taken"`)
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room", `{"name": "a/b"}`, catJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms?limit=2", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Attic", "$Kitchen"}, roomNames(t, body))
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms?limit=2&after=$Kitchen", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Shed"}, roomNames(t, body))
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms?member=true", "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Attic"}, roomNames(t, body))
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms?limit=0", "", foxJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	roomURL := server.URL + "/api/room/$Attic"
+	body, status = httpDoAuth(t, http.MethodGet, roomURL, "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, "$Attic", decodeRoom(t, body).Name)
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/room/$Cellar", "", catJWT)
+	require.Equal(t, http.StatusNotFound, status)
+
+	_, status = httpDoAuth(t, http.MethodPatch, roomURL, `{"name": "$Loft"}`, catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	body, status = httpDoAuth(t, http.MethodPatch, roomURL, `{"name": "$Loft"}`, foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, "$Loft", decodeRoom(t, body).Name)
+	patch := `{"topic": "Storage", "settings": {"readOnly": true, "slowMode": 10}}`
+	body, status = httpDoAuth(t, http.MethodPatch, server.URL+"/api/room/$Loft", patch, foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	room = decodeRoom(t, body)
+	require.Equal(t, "Storage", room.Topic)
+	require.Equal(t, RoomSettings{ReadOnly: true, SlowMode: 10}, room.Settings)
+	patch = `{"settings": {"slowMode": -1}}`
+	body, status = httpDoAuth(t, http.MethodPatch, server.URL+"/api/room/$Loft", patch, foxJWT)
+	require.Equal(t, http.StatusBadRequest, status, body)
+	require.Contains(t, body, `"settings.slowMode"`)
+	body, status = httpDoAuth(t, http.MethodPatch, server.URL+"/api/room/$Loft", `{"name": "$Shed"}`, foxJWT)
+	require.Equal(t, http.StatusBadRequest, status, body)
+
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/room/$Loft", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/room/$Loft", "", foxJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/room/$Kitchen", "", goatJWT)
+	require.Equal(t, http.StatusNoContent, status) // with its messages
+	body, status = httpGet(t, server.URL+"/api/history?room=$Kitchen")
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, "[]", body)
+	_, status = httpDoAuth(t, http.MethodPut, server.URL+"/api/room/$Shed", "", goatJWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/room/$Shed/x", "", goatJWT)
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestArchiveRoomAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	roomURL := server.URL + "/api/room/$Kitchen"
+	_, status := httpDoAuth(t, http.MethodPost, roomURL+"/archive", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	body, status := httpDoAuth(t, http.MethodPost, roomURL+"/archive", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.NotEmpty(t, decodeRoom(t, body).ArchivedAt)
+
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Shed"}, roomNames(t, body))
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms?archived=true", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Kitchen"}, roomNames(t, body))
+	body, status = httpGet(t, server.URL+"/api/history?room=$Kitchen")
+	require.Equal(t, http.StatusOK, status)
+	require.Contains(t, body, "Ok, bye.")
+
+	body, status = httpDoAuth(t, http.MethodPost, roomURL+"/restore", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Empty(t, decodeRoom(t, body).ArchivedAt)
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Kitchen", "$Shed"}, roomNames(t, body))
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Cellar/archive", "", goatJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodGet, roomURL+"/archive", "", goatJWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+}
+
+func decodeRoom(t *testing.T, body string) *Room {
+	t.Helper()
+	room := &Room{}
+	require.NoError(t, json.Unmarshal([]byte(body), room))
+	return room
+}
+
+func roomNames(t *testing.T, body string) []string {
+	t.Helper()
+	var rooms []*Room
+	require.NoError(t, json.Unmarshal([]byte(body), &rooms))
+	names := make([]string, len(rooms))
+	for i, r := range rooms {
+		names[i] = r.Name
+	}
+	return names
+}
+
+func TestPrivateRoomsAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/room", `{"name": "$Burrow", "private": true}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	require.True(t, decodeRoom(t, body).Private)
+
+	// hidden from and closed to non-members
+	roomURL := server.URL + "/api/room/$Burrow"
+	_, status = httpDoAuth(t, http.MethodGet, roomURL, "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Kitchen", "$Shed"}, roomNames(t, body))
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Burrow", "$Kitchen", "$Shed"}, roomNames(t, body))
+	_, status = httpGet(t, server.URL+"/api/history?room=$Burrow")
+	require.Equal(t, http.StatusUnauthorized, status)
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/history?room=$Burrow", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/history?room=$Burrow", "", foxJWT)
+	require.Equal(t, http.StatusOK, status)
+	require.JSONEq(t, "[]", body)
+	_, status = httpDoAuth(t, http.MethodPost, roomURL+"/join", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+
+	// invites
+	_, status = httpDoAuth(t, http.MethodPost, roomURL+"/invites", `{"maxUses": 1}`, catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodPost, roomURL+"/invites", `{"expiresIn": -1}`, foxJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	body, status = httpDoAuth(t, http.MethodPost, roomURL+"/invites", `{"expiresIn": 3600, "maxUses": 1}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	inv := Invite{}
+	require.NoError(t, json.Unmarshal([]byte(body), &inv))
+	require.NotEmpty(t, inv.Token)
+	require.NotEmpty(t, inv.ExpiresAt)
+	body, status = httpDoAuth(t, http.MethodGet, roomURL+"/invites", "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.NotContains(t, body, inv.Token)
+
+	_, status = httpDoAuth(t, http.MethodPost, roomURL+"/join", `{"invite": "nope"}`, catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	body, status = httpDoAuth(t, http.MethodPost, roomURL+"/join", `{"invite": "`+inv.Token+`"}`, catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	_, status = httpDoAuth(t, http.MethodGet, roomURL, "", catJWT)
+	require.Equal(t, http.StatusOK, status)
+	camelJWT := login(t, server.URL, "$Camel", "$s3cr37")
+	_, status = httpDoAuth(t, http.MethodPost, roomURL+"/join", `{"invite": "`+inv.Token+`"}`, camelJWT)
+	require.Equal(t, http.StatusForbidden, status) // used up
+	invURL := fmt.Sprintf("%s/invites/%d", roomURL, inv.ID)
+	_, status = httpDoAuth(t, http.MethodDelete, invURL, "", foxJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodDelete, invURL, "", foxJWT)
+	require.Equal(t, http.StatusNotFound, status)
+
+	// leave and join public rooms
+	_, status = httpDoAuth(t, http.MethodPost, roomURL+"/leave", "", catJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodPost, roomURL+"/leave", "", catJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodGet, roomURL, "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Kitchen/join", "", catJWT)
+	require.Equal(t, http.StatusOK, status)
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms?member=true", "", catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, []string{"$Kitchen"}, roomNames(t, body))
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Cellar/join", "", catJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodGet, roomURL+"/join", "", catJWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+}
+
+func TestConversationsAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	convURL := server.URL + "/api/conversations"
+	_, status := httpGet(t, convURL)
+	require.Equal(t, http.StatusUnauthorized, status)
+	body, status := httpDoAuth(t, http.MethodPost, convURL, `{"participants": ["$Cat"]}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	c := Conversation{}
+	require.NoError(t, json.Unmarshal([]byte(body), &c))
+	require.True(t, isConversation(c.ID))
+	require.Equal(t, []string{"$Cat", "$Fox"}, c.Participants)
+	body, status = httpDoAuth(t, http.MethodPost, convURL, `{"participants": ["$Fox", "$Cat"]}`, catJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Contains(t, body, c.ID)
+	body, status = httpDoAuth(t, http.MethodPost, convURL, `{"participants": ["$Nobody"]}`, catJWT)
+	require.Equal(t, http.StatusBadRequest, status, body)
+	_, status = httpDoAuth(t, http.MethodPost, convURL, `{"participants": []}`, catJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+
+	// participants send and read messages like in rooms
+	cat := dialWS(t, server.URL, catJWT)
+	sendCommand(t, cat, command{Type: "message", Room: c.ID, Content: "Psst"})
+	require.Equal(t, eventAck, readEvent(t, cat).Type)
+	historyURL := server.URL + "/api/history?room=" + url.QueryEscape(c.ID)
+	body, status = httpDoAuth(t, http.MethodGet, historyURL, "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Contains(t, body, "Psst")
+	body, status = httpDoAuth(t, http.MethodGet, convURL, "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	conversations := []Conversation{}
+	require.NoError(t, json.Unmarshal([]byte(body), &conversations))
+	require.Len(t, conversations, 1)
+	require.Equal(t, "Psst", conversations[0].LastMessage.Content)
+
+	// invisible to others, including admins
+	_, status = httpDoAuth(t, http.MethodGet, historyURL, "", goatJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	goat := dialWS(t, server.URL, goatJWT)
+	sendCommand(t, goat, command{Type: "subscribe", Room: c.ID})
+	require.Equal(t, eventError, readEvent(t, goat).Type)
+	body, status = httpDoAuth(t, http.MethodGet, convURL, "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.JSONEq(t, "[]", body)
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/rooms", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.NotContains(t, body, c.ID)
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/room/"+url.PathEscape(c.ID), "", foxJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodPut, convURL, "", foxJWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+
+	// participants have no roles
+	rolesURL := server.URL + "/api/user/$Fox/roles"
+	payload := fmt.Sprintf(`{"role": "owner", "room": %q}`, c.ID)
+	body, status = httpDoAuth(t, http.MethodPost, rolesURL, payload, goatJWT)
+	require.Equal(t, http.StatusBadRequest, status, body)
+	body, status = httpDoAuth(t, http.MethodGet, rolesURL, "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.NotContains(t, body, conversationPrefix)
+}
+
+func TestModerationAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/user/$Fox/roles",
+		`{"role": "moderator", "room": "$Kitchen"}`, goatJWT)
+	require.Equal(t, http.StatusNoContent, status, body)
+
+	modURL := server.URL + "/api/room/$Kitchen/moderation"
+	_, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "kick", "user": "$Fox"}`, catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "ban", "user": "$Goat"}`, foxJWT)
+	require.Equal(t, http.StatusForbidden, status) // admin outranks moderator
+	_, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "kick", "user": "$Nobody"}`, foxJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "unban", "user": "$Cat"}`, foxJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	body, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "mute", "user": "$Cat"}`, foxJWT)
+	require.Equal(t, http.StatusBadRequest, status, body)
+	require.Contains(t, body, `"duration"`)
+
+	body, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "ban", "user": "$Cat", "duration": 3600}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	e := ModerationEntry{}
+	require.NoError(t, json.Unmarshal([]byte(body), &e))
+	require.Equal(t, "$Fox", e.Moderator)
+	require.NotEmpty(t, e.ExpiresAt)
+	body, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/room/$Kitchen/sanctions", "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Contains(t, body, `"kind":"ban"`)
+	_, status = httpDoAuth(t, http.MethodGet, server.URL+"/api/room/$Kitchen/sanctions", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+
+	unban := `{"action": "unban", "user": "$Cat", "reason": "appeal"}`
+	body, status = httpDoAuth(t, http.MethodPost, modURL, unban, goatJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Kitchen/join", "", catJWT)
+	require.Equal(t, http.StatusOK, status)
+	body, status = httpDoAuth(t, http.MethodGet, modURL, "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	entries := []ModerationEntry{}
+	require.NoError(t, json.Unmarshal([]byte(body), &entries))
+	require.Len(t, entries, 2)
+	require.Equal(t, actionUnban, entries[0].Action)
+	require.Equal(t, "appeal", entries[0].Reason)
+	require.Equal(t, "$Goat", entries[0].Moderator)
+	_, status = httpDoAuth(t, http.MethodDelete, modURL, "", foxJWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+}
+
+func TestEditMessageAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	app, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	msgURL := server.URL + "/api/message/2"
+	body, status := httpDoAuth(t, http.MethodPatch, msgURL, `{"content": "Hello"}`, foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	m := Message{}
+	require.NoError(t, json.Unmarshal([]byte(body), &m))
+	require.Equal(t, "Hello", m.Content)
+	require.Equal(t, "$Fox", m.Author)
+	require.NotEmpty(t, m.EditedAt)
+
+	_, status = httpDoAuth(t, http.MethodPatch, msgURL, `{"content": "Baa"}`, goatJWT)
+	require.Equal(t, http.StatusForbidden, status) // admins cannot edit others' messages
+	body, status = httpDoAuth(t, http.MethodPatch, msgURL, `{"content": ""}`, foxJWT)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Contains(t, body, `"content"`)
+	_, status = httpDoAuth(t, http.MethodPatch, server.URL+"/api/message/1000", `{"content": "Hi"}`, foxJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodPatch, server.URL+"/api/message/x", `{"content": "Hi"}`, foxJWT)
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpDoAuth(t, http.MethodPut, msgURL, "", foxJWT)
+	require.Equal(t, http.StatusMethodNotAllowed, status)
+
+	body, status = httpGet(t, msgURL+"/edits")
+	require.Equal(t, http.StatusOK, status, body)
+	edits := []*MessageEdit{}
+	require.NoError(t, json.Unmarshal([]byte(body), &edits))
+	require.Len(t, edits, 1)
+	require.Equal(t, "Hallo", edits[0].Content)
+
+	app.api.editWindow = time.Minute
+	_, status = httpDoAuth(t, http.MethodPatch, msgURL, `{"content": "Hello!"}`, foxJWT)
+	require.Equal(t, http.StatusForbidden, status) // outside edit window
+	m = Message{Content: "Hi", CreatedAt: now(), Room: "$Kitchen", Author: "$Fox"}
+	require.NoError(t, app.db.createMessage(context.Background(), &m))
+	msgURL = server.URL + "/api/message/" + strconv.Itoa(m.ID)
+	body, status = httpDoAuth(t, http.MethodPatch, msgURL, `{"content": "Hi!"}`, foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+
+	body, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Kitchen/archive", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	_, status = httpDoAuth(t, http.MethodPatch, msgURL, `{"content": "Hi"}`, foxJWT)
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestDeleteMessageAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	_, status := httpDoAuth(t, http.MethodDelete, server.URL+"/api/message/1", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/message/2", "", foxJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/message/2", "", foxJWT)
+	require.Equal(t, http.StatusNotFound, status)
+
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/user/$Cat/roles",
+		`{"role": "moderator", "room": "$Kitchen"}`, goatJWT)
+	require.Equal(t, http.StatusNoContent, status, body)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/message/1", "", catJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/message/6", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status) // $Shed message
+
+	body, status = httpGet(t, server.URL+"/api/history?room=$Kitchen")
+	require.Equal(t, http.StatusOK, status, body)
+	messages := []*Message{}
+	require.NoError(t, json.Unmarshal([]byte(body), &messages))
+	require.Len(t, messages, 5)
+	require.Equal(t, &Message{ID: 2, CreatedAt: "2020-11-22T11:12:12Z", Room: "$Kitchen", Author: "$Fox",
+		DeletedAt: messages[3].DeletedAt, DeletedBy: "$Fox"}, messages[3])
+	require.NotEmpty(t, messages[3].DeletedAt)
+	require.Equal(t, "$Cat", messages[4].DeletedBy)
+	require.Equal(t, "Are you hungry?", messages[2].Content)
+
+	body, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Kitchen/archive", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/message/4", "", foxJWT)
+	require.Equal(t, http.StatusForbidden, status)
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/message/4", "", catJWT)
+	require.Equal(t, http.StatusNoContent, status) // moderators can clean up archived rooms
+}
+
+func TestThreadAPI(t *testing.T) {
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	app, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := context.Background()
+	for _, content := range []string{"One", "Two", "Three"} {
+		m := &Message{Content: content, CreatedAt: now(), Room: "$Kitchen", Author: "$Fox", Parent: 3}
+		require.NoError(t, app.db.createMessage(ctx, m))
+	}
+	body, status := httpGet(t, server.URL+"/api/message/3/thread?limit=2")
+	require.Equal(t, http.StatusOK, status, body)
+	thread := Thread{}
+	require.NoError(t, json.Unmarshal([]byte(body), &thread))
+	require.Equal(t, "Are you hungry?", thread.Parent.Content)
+	require.Equal(t, 3, thread.Parent.ReplyCount)
+	require.NotEmpty(t, thread.Parent.LastReplyAt)
+	require.Len(t, thread.Replies, 2)
+	require.Equal(t, "Three", thread.Replies[0].Content)
+	before := strconv.Itoa(thread.Replies[1].ID)
+	body, status = httpGet(t, server.URL+"/api/message/3/thread?before="+before)
+	require.Equal(t, http.StatusOK, status, body)
+	thread = Thread{}
+	require.NoError(t, json.Unmarshal([]byte(body), &thread))
+	require.Len(t, thread.Replies, 1)
+	require.Equal(t, "One", thread.Replies[0].Content)
+
+	_, status = httpGet(t, server.URL+"/api/message/"+before+"/thread")
+	require.Equal(t, http.StatusNotFound, status) // replies have no threads
+	_, status = httpGet(t, server.URL+"/api/message/1000/thread")
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpGet(t, server.URL+"/api/message/3/thread?limit=0")
+	require.Equal(t, http.StatusBadRequest, status)
+
+	body, status = httpGet(t, server.URL+"/api/history?room=$Kitchen")
+	require.Equal(t, http.StatusOK, status, body)
+	messages := []*Message{}
+	require.NoError(t, json.Unmarshal([]byte(body), &messages))
+	require.Len(t, messages, 5)
+	require.Equal(t, 3, messages[2].ID)
+	require.Equal(t, 3, messages[2].ReplyCount)
+	require.Zero(t, messages[1].ReplyCount)
+}
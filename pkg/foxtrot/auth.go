@@ -2,58 +2,311 @@ package foxtrot
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	"foxygo.at/s/errs"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
-	errAuth         = errors.New("user authentication error")
-	errPasswordHash = errors.New("password hash creation err")
+	errAuth          = errors.New("user authentication error")
+	errPasswordHash  = errors.New("password hash creation err")
+	errResetToken    = errors.New("invalid or expired password reset token")
+	errTokenRevoked  = fmt.Errorf("%w: token revoked", errAuth)
+	errTokenCreation = errors.New("token creation error")
 )
 
 type authenticator struct {
 	db     *db
 	secret []byte
+	jwtCfg jwtConfig
+
+	throttle         loginThrottle
+	maxFailures      int // failed logins per account before lockout, 0: no lockout
+	maxFailuresPerIP int // failed logins per client IP within lockout duration before lockout, 0: no lockout
+
+	policy credentialPolicy
+
+	totpIssuer string // shown in authenticator apps
+
+	oidc *oidcProvider // nil if single sign-on is disabled
+
+	admins   map[string]bool
+	resetTTL time.Duration // validity of password reset tokens
+
+	hasher    passwordHasher // default argon2id if nil
+	dummyOnce sync.Once
+	dummyHash string // verified against for missing users to keep login timing constant
 }
 
+// register creates a new user with given password. The user name is
+// normalised according to the credential policy and updated in u.
 func (a *authenticator) register(ctx context.Context, u *User, password string) error {
-	hashWithSalt, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	name, err := a.policy.validate(u.Name, password)
 	if err != nil {
-		return errs.New(errPasswordHash, err)
+		return err
 	}
-	u.passwordHash = string(hashWithSalt)
+	u.Name = name
+	hash, err := a.passwordHasher().hash(password)
+	if err != nil {
+		return err
+	}
+	u.passwordHash = hash
 	if err := a.db.createUser(ctx, u); err != nil {
 		return err
 	}
-	u.JWT = a.newJWT(u.Name)
+	u.AvatarURL = avatarURL(u.Name)
+	u.JWT = a.newJWT(u)
 	return nil
 }
 
-func (a *authenticator) login(ctx context.Context, name, password string) (*User, error) {
+func (a *authenticator) passwordHasher() passwordHasher {
+	if a.hasher == nil {
+		return argon2Hasher{}.withDefaults()
+	}
+	return a.hasher
+}
+
+// dummyVerify verifies password against a hash created with the
+// current hasher so that logins for missing users take as long as for
+// existing ones.
+func (a *authenticator) dummyVerify(password string) {
+	a.dummyOnce.Do(func() {
+		a.dummyHash, _ = a.passwordHasher().hash("")
+	})
+	_ = verifyPassword(a.dummyHash, password)
+}
+
+// login authenticates user name with password. ip is the client
+// address used to throttle failed attempts across accounts; it may be
+// empty. For users with TOTP enabled a secondFactorError holding a
+// login challenge is returned instead of the user, see loginTOTP.
+func (a *authenticator) login(ctx context.Context, name, password, ip string) (*User, error) {
+	u, err := a.checkPassword(ctx, name, password, ip)
+	if err != nil {
+		return nil, err
+	}
+	enabled, err := a.totpEnabled(ctx, u.Name)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		challenge, err := a.newChallenge(ctx, u.Name)
+		if err != nil {
+			return nil, err
+		}
+		return nil, &secondFactorError{challenge: challenge}
+	}
+	a.throttle.reset("name:" + u.Name)
+	u.JWT = a.newJWT(u)
+	return u, nil
+}
+
+// checkPassword verifies password for user name with throttling and
+// auditing of failed attempts. name is normalised like on registration
+// so that all spellings of a name share one account and throttle.
+func (a *authenticator) checkPassword(ctx context.Context, name, password, ip string) (*User, error) {
+	name = normaliseName(name)
+	keys := []string{"name:" + name}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	if wait := a.throttle.wait(time.Now(), keys...); wait > 0 {
+		return nil, &throttleError{retryAfter: wait}
+	}
 	u, err := a.db.getUser(ctx, name)
 	if err != nil {
-		_ = bcrypt.CompareHashAndPassword([]byte(""), []byte(password))
+		a.dummyVerify(password)
 		if errors.Is(err, errDBNotFound) {
-			return nil, errs.New(errAuth, err)
+			return nil, a.loginFailed(ctx, name, ip, err)
 		}
 		return nil, err
 	}
-	if err := bcrypt.CompareHashAndPassword([]byte(u.passwordHash), []byte(password)); err != nil {
-		return nil, errs.New(errAuth, err)
+	if err := verifyPassword(u.passwordHash, password); err != nil {
+		return nil, a.loginFailed(ctx, name, ip, err)
 	}
-	u.JWT = a.newJWT(u.Name)
+	a.rehash(ctx, u, password)
 	return u, nil
 }
 
-func (a *authenticator) newJWT(sub string) string {
-	// Arbitrarily chosen expiry of three months
-	exp := time.Now().AddDate(0, 3, 0).Unix()
-	return newJWT(sub, exp, a.secret)
+// rehash updates the stored password hash of u if it was created with
+// an outdated algorithm or parameters. Errors are ignored as the login
+// has succeeded regardless and rehashing is retried on next login.
+func (a *authenticator) rehash(ctx context.Context, u *User, password string) {
+	hasher := a.passwordHasher()
+	if hasher.upToDate(u.passwordHash) {
+		return
+	}
+	hash, err := hasher.hash(password)
+	if err != nil {
+		return
+	}
+	if err := a.db.updatePasswordHash(ctx, u.Name, u.passwordHash, hash); err != nil {
+		return
+	}
+	u.passwordHash = hash
+}
+
+// loginFailed records a failed login attempt for throttling and audit
+// and returns an errAuth error wrapping err.
+func (a *authenticator) loginFailed(ctx context.Context, name, ip string, err error) error {
+	t := time.Now()
+	a.throttle.fail(t, "name:"+name, a.maxFailures)
+	if ip != "" {
+		a.throttle.count(t, "ip:"+ip, a.maxFailuresPerIP)
+	}
+	if dbErr := a.db.createLoginFailure(ctx, name, ip, t.UTC().Format(time.RFC3339)); dbErr != nil {
+		return dbErr
+	}
+	return errs.New(errAuth, err)
+}
+
+// jwtExpiry returns the expiry time of a JWT issued at t, an
+// arbitrarily chosen three months.
+func jwtExpiry(t time.Time) time.Time {
+	return t.AddDate(0, 3, 0)
+}
+
+func (a *authenticator) newJWT(u *User) string {
+	t := time.Now()
+	payload := jwtPayload{
+		Sub: u.Name,
+		Gen: u.sessionGen,
+		Exp: jwtExpiry(t).Unix(),
+		Iat: t.Unix(),
+		Nbf: t.Unix(),
+		Iss: a.jwtCfg.issuer,
+	}
+	if a.jwtCfg.audience != "" {
+		payload.Aud = audience{a.jwtCfg.audience}
+	}
+	return newJWT(payload, a.secret)
 }
 
 func (a *authenticator) validateJWT(jwt string) error {
-	return validateJWT(jwt, a.secret)
+	return validateJWT(jwt, a.secret, a.jwtCfg, time.Now())
+}
+
+// authenticate validates the given JWT or personal access token and
+// returns the user it was issued to. JWTs issued before the user's last
+// password change are rejected.
+func (a *authenticator) authenticate(ctx context.Context, jwt string) (*User, error) {
+	if isAccessToken(jwt) {
+		return a.authenticateAccessToken(ctx, jwt)
+	}
+	p, err := parseJWT(jwt, a.secret, a.jwtCfg, time.Now())
+	if err != nil {
+		return nil, errs.New(errAuth, err)
+	}
+	u, err := a.db.getUser(ctx, p.Sub)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil, errs.New(errAuth, err)
+		}
+		return nil, err
+	}
+	if p.Gen != u.sessionGen {
+		return nil, errTokenRevoked
+	}
+	return u, nil
+}
+
+// changePassword sets a new password for user name after verifying the
+// old one and, for users with TOTP enabled, code as TOTP or recovery
+// code, with throttling and auditing of failed attempts. All previously
+// issued tokens are revoked and no new token is issued, the user has to
+// log in again.
+func (a *authenticator) changePassword(ctx context.Context, name, oldPassword, code, newPassword, ip string) error {
+	// Validate before verifying so that no code is used up in vain.
+	if err := a.policy.validatePassword(newPassword); err != nil {
+		return err
+	}
+	u, err := a.checkPassword(ctx, name, oldPassword, ip)
+	if err != nil {
+		return err
+	}
+	enabled, err := a.totpEnabled(ctx, u.Name)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		if err := a.verifySecondFactor(ctx, u.Name, code); err != nil {
+			if !errors.Is(err, errTOTP) {
+				return err
+			}
+			return a.loginFailed(ctx, u.Name, ip, err)
+		}
+	}
+	_, err = a.setPassword(ctx, u.Name, newPassword)
+	return err
+}
+
+// resetPassword sets a new password for user name if resetToken is a
+// valid, unexpired reset token for the user. Reset tokens can only be
+// used once.
+func (a *authenticator) resetPassword(ctx context.Context, name, resetToken, newPassword string) (*User, error) {
+	err := a.db.deletePasswordReset(ctx, name, hashToken(resetToken), time.Now().Unix())
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil, errs.New(errResetToken, err)
+		}
+		return nil, err
+	}
+	return a.setPassword(ctx, name, newPassword)
+}
+
+// setPassword unconditionally sets a new password for user name,
+// revokes all previously issued tokens and outstanding reset tokens and
+// returns the user with a new JWT.
+func (a *authenticator) setPassword(ctx context.Context, name, password string) (*User, error) {
+	if err := a.policy.validatePassword(password); err != nil {
+		return nil, err
+	}
+	hash, err := a.passwordHasher().hash(password)
+	if err != nil {
+		return nil, err
+	}
+	u, err := a.db.updatePassword(ctx, name, hash)
+	if err != nil {
+		return nil, err
+	}
+	u.JWT = a.newJWT(u)
+	return u, nil
+}
+
+// newResetToken creates a single use password reset token for user
+// name. Only the token's hash is stored.
+func (a *authenticator) newResetToken(ctx context.Context, name string) (string, time.Time, error) {
+	token, err := newRandomToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(a.resetTTL)
+	if err := a.db.createPasswordReset(ctx, name, hashToken(token), expiresAt.Unix()); err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// newRandomToken returns a random, URL safe token of 256 bits.
+func newRandomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errs.New(errTokenCreation, err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken hashes a random, high entropy token for storage. Unlike
+// passwords such tokens cannot be brute forced, so a fast hash is
+// sufficient.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
 }
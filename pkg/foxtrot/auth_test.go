@@ -2,7 +2,10 @@ package foxtrot
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -17,13 +20,13 @@ func TestRegisterLogin(t *testing.T) {
 	err := a.register(context.Background(), u, "Pa$$w0rd")
 	require.NoError(t, err)
 
-	u2, err := a.login(context.Background(), "Alice", "Pa$$w0rd")
+	u2, err := a.login(context.Background(), "Alice", "Pa$$w0rd", "")
 	u.JWT = u2.JWT
 	require.NoError(t, err)
 	require.Equal(t, u, u2)
 	require.NoError(t, a.validateJWT(u.JWT))
 
-	_, err = a.login(context.Background(), "Alice", "WRONG-PASS")
+	_, err = a.login(context.Background(), "Alice", "WRONG-PASS", "")
 	require.Error(t, err)
 	requireErrIs(t, err, errAuth)
 }
@@ -48,7 +51,225 @@ func TestLoginErr(t *testing.T) {
 	defer db.close()
 
 	a := authenticator{db: db}
-	_, err := a.login(context.Background(), "Alice", "Pa$$w0rd")
+	_, err := a.login(context.Background(), "Alice", "Pa$$w0rd", "")
 	require.Error(t, err) // missing user
 	requireErrIs(t, err, errAuth)
 }
+
+func TestJWTIssuerAudience(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	secret := []byte("$$$$$hhh!")
+	a := authenticator{db: db, secret: secret, jwtCfg: jwtConfig{issuer: "foxtrot-a", audience: "chat"}}
+	b := authenticator{db: db, secret: secret, jwtCfg: jwtConfig{issuer: "foxtrot-b", audience: "chat"}}
+
+	j := a.newJWT(&User{Name: "Alice"})
+	require.NoError(t, a.validateJWT(j))
+	requireErrIs(t, b.validateJWT(j), errJWTIssuer)
+
+	b.jwtCfg = jwtConfig{issuer: "foxtrot-a", audience: "other"}
+	requireErrIs(t, b.validateJWT(j), errJWTAudience)
+}
+
+func TestLoginLockout(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	a := authenticator{
+		db:               db,
+		throttle:         loginThrottle{lockout: time.Minute},
+		maxFailures:      2,
+		maxFailuresPerIP: 3,
+	}
+	ctx := context.Background()
+	require.NoError(t, a.register(ctx, &User{Name: "Alice"}, "Pa$$w0rd"))
+	require.NoError(t, a.register(ctx, &User{Name: "Bob"}, "Pa$$w0rd"))
+
+	_, err := a.login(ctx, "Alice", "WRONG-PASS", "10.0.0.1")
+	requireErrIs(t, err, errAuth)
+	_, err = a.login(ctx, "Alice", "WRONG-PASS", "10.0.0.2")
+	requireErrIs(t, err, errAuth)
+	_, err = a.login(ctx, "Alice", "Pa$$w0rd", "10.0.0.3")
+	requireErrIs(t, err, errLoginThrottled)
+	var te *throttleError
+	require.True(t, errors.As(err, &te))
+	require.InDelta(t, time.Minute, te.retryAfter, float64(time.Second))
+
+	_, err = a.login(ctx, "Bob", "WRONG-PASS", "10.0.0.1")
+	requireErrIs(t, err, errAuth)
+	_, err = a.login(ctx, "MISSING", "WRONG-PASS", "10.0.0.1")
+	requireErrIs(t, err, errAuth)
+	_, err = a.login(ctx, "Bob", "Pa$$w0rd", "10.0.0.1")
+	requireErrIs(t, err, errLoginThrottled)
+	_, err = a.login(ctx, "Bob", "Pa$$w0rd", "10.0.0.4")
+	require.NoError(t, err)
+
+	cnt := 0
+	row := db.conn.QueryRow("SELECT COUNT(*) FROM login_failures WHERE name = 'Alice'")
+	require.NoError(t, row.Scan(&cnt))
+	require.Equal(t, 2, cnt)
+}
+
+func TestLoginBackoffPerAccount(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	a := authenticator{
+		db:               db,
+		throttle:         loginThrottle{backoff: time.Minute, lockout: time.Hour},
+		maxFailuresPerIP: 3,
+	}
+	ctx := context.Background()
+	require.NoError(t, a.register(ctx, &User{Name: "Alice"}, "Pa$$w0rd"))
+	require.NoError(t, a.register(ctx, &User{Name: "Bob"}, "Pa$$w0rd"))
+
+	// a failure backs off the account, not the shared client IP
+	_, err := a.login(ctx, "Alice", "WRONG-PASS", "10.0.0.1")
+	requireErrIs(t, err, errAuth)
+	_, err = a.login(ctx, "Alice", "Pa$$w0rd", "10.0.0.2")
+	requireErrIs(t, err, errLoginThrottled)
+	_, err = a.login(ctx, "Bob", "Pa$$w0rd", "10.0.0.1")
+	require.NoError(t, err)
+}
+
+func TestLoginNormalisedName(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	a := authenticator{
+		db:          db,
+		secret:      []byte("$$$$$hhh!"),
+		throttle:    loginThrottle{lockout: time.Minute},
+		maxFailures: 2,
+	}
+	ctx := context.Background()
+	u := &User{Name: "Zoe\u0301"} // decomposed
+	require.NoError(t, a.register(ctx, u, "Pa$$w0rd"))
+	require.Equal(t, "Zo\u00e9", u.Name)
+
+	u2, err := a.login(ctx, "Zoe\u0301", "Pa$$w0rd", "")
+	require.NoError(t, err)
+	require.Equal(t, "Zo\u00e9", u2.Name)
+	_, err = a.login(ctx, "\uff3a\uff4f\u00e9", "Pa$$w0rd", "") // fullwidth
+	require.NoError(t, err)
+
+	// all spellings share one throttle
+	_, err = a.login(ctx, "Zoe\u0301", "WRONG-PASS", "")
+	requireErrIs(t, err, errAuth)
+	_, err = a.login(ctx, "Zo\u00e9", "WRONG-PASS", "")
+	requireErrIs(t, err, errAuth)
+	_, err = a.login(ctx, "\uff3a\uff4f\u00e9", "Pa$$w0rd", "")
+	requireErrIs(t, err, errLoginThrottled)
+}
+
+func TestChangePassword(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	a := authenticator{db: db, secret: []byte("$$$$$hhh!")}
+	ctx := context.Background()
+	u := &User{Name: "Alice"}
+	require.NoError(t, a.register(ctx, u, "Pa$$w0rd"))
+	u2, err := a.authenticate(ctx, u.JWT)
+	require.NoError(t, err)
+	require.Equal(t, "Alice", u2.Name)
+
+	err = a.changePassword(ctx, "Alice", "WRONG-PASS", "", "n3w-Pa$$w0rd", "")
+	requireErrIs(t, err, errAuth)
+
+	require.NoError(t, a.changePassword(ctx, "Alice", "Pa$$w0rd", "", "n3w-Pa$$w0rd", ""))
+	_, err = a.authenticate(ctx, u.JWT)
+	requireErrIs(t, err, errTokenRevoked)
+
+	_, err = a.login(ctx, "Alice", "Pa$$w0rd", "")
+	requireErrIs(t, err, errAuth)
+	_, err = a.login(ctx, "Alice", "n3w-Pa$$w0rd", "")
+	require.NoError(t, err)
+}
+
+func TestResetPassword(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	a := authenticator{db: db, secret: []byte("$$$$$hhh!"), resetTTL: time.Hour}
+	ctx := context.Background()
+	u := &User{Name: "Alice"}
+	require.NoError(t, a.register(ctx, u, "Pa$$w0rd"))
+
+	token, expiresAt, err := a.newResetToken(ctx, "Alice")
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Second)
+
+	_, err = a.resetPassword(ctx, "Bob", token, "n3w-Pa$$w0rd")
+	requireErrIs(t, err, errResetToken)
+	_, err = a.resetPassword(ctx, "Alice", "WRONG-TOKEN", "n3w-Pa$$w0rd")
+	requireErrIs(t, err, errResetToken)
+
+	u2, err := a.resetPassword(ctx, "Alice", token, "n3w-Pa$$w0rd")
+	require.NoError(t, err)
+	_, err = a.authenticate(ctx, u2.JWT)
+	require.NoError(t, err)
+	_, err = a.authenticate(ctx, u.JWT)
+	requireErrIs(t, err, errTokenRevoked)
+
+	_, err = a.resetPassword(ctx, "Alice", token, "0ther-Pa$$w0rd")
+	requireErrIs(t, err, errResetToken) // single use
+
+	a.resetTTL = -time.Second
+	token, _, err = a.newResetToken(ctx, "Alice")
+	require.NoError(t, err)
+	_, err = a.resetPassword(ctx, "Alice", token, "0ther-Pa$$w0rd")
+	requireErrIs(t, err, errResetToken) // expired
+
+	_, _, err = a.newResetToken(ctx, "MISSING")
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestAuthenticateErr(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	a := authenticator{db: db, secret: []byte("$$$$$hhh!")}
+	ctx := context.Background()
+	_, err := a.authenticate(ctx, "NOT-A-JWT")
+	requireErrIs(t, err, errAuth)
+
+	_, err = a.authenticate(ctx, a.newJWT(&User{Name: "MISSING"}))
+	requireErrIs(t, err, errAuth)
+}
+
+func TestLoginRehash(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	a := authenticator{db: db, hasher: bcryptHasher{cost: 4}}
+	require.NoError(t, a.register(ctx, &User{Name: "Alice"}, "Pa$$w0rd"))
+	u, err := db.getUser(ctx, "Alice")
+	require.NoError(t, err)
+	bcryptHash := u.passwordHash
+
+	_, err = a.login(ctx, "Alice", "Pa$$w0rd", "")
+	require.NoError(t, err)
+	u, err = db.getUser(ctx, "Alice")
+	require.NoError(t, err)
+	require.Equal(t, bcryptHash, u.passwordHash) // up to date, unchanged
+
+	a.hasher = fastArgon2.withDefaults()
+	_, err = a.login(ctx, "Alice", "WRONG-PASS", "")
+	requireErrIs(t, err, errAuth)
+	u, err = db.getUser(ctx, "Alice")
+	require.NoError(t, err)
+	require.Equal(t, bcryptHash, u.passwordHash) // no rehash on failed login
+
+	_, err = a.login(ctx, "Alice", "Pa$$w0rd", "")
+	require.NoError(t, err)
+	u, err = db.getUser(ctx, "Alice")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(u.passwordHash, "$argon2id$v=19$m=64,t=1,p=1$"), u.passwordHash)
+	require.Equal(t, int64(0), u.sessionGen) // rehash does not revoke sessions
+
+	_, err = a.login(ctx, "Alice", "Pa$$w0rd", "")
+	require.NoError(t, err)
+}
@@ -0,0 +1,136 @@
+package foxtrot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"  //nolint:golint // register GIF decoder
+	_ "image/jpeg" //nolint:golint // register JPEG decoder
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"foxygo.at/s/errs"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" //nolint:golint // register WebP decoder
+)
+
+const (
+	maxAvatarBytes  = 2 << 20     // uploaded file size
+	maxAvatarPixels = 4096 * 4096 // decoded image size, guards against decompression bombs
+	avatarSize      = 256         // stored avatar size, width and height in pixels
+)
+
+// avatarSizes are the sizes avatars are served at with
+// /api/user/NAME/avatar?size=N, the largest is the default. Uploaded
+// avatars are scaled to all sizes on upload so that serving them,
+// without authentication, does not decode or scale images.
+var avatarSizes = []int{32, 64, 128, avatarSize}
+
+// avatarImages are the PNG encoded images of an avatar by size.
+type avatarImages map[int][]byte
+
+var (
+	errAvatarFormat = errors.New("unsupported avatar image format")
+	errAvatarSize   = errors.New("avatar image too large")
+)
+
+// avatarFormats are the accepted image types as sniffed by
+// http.DetectContentType.
+var avatarFormats = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// newAvatar decodes a PNG, JPEG, GIF or WebP image, crops it to a
+// centered square and scales it to all avatarSizes. The results are
+// encoded as PNG, which drops EXIF and all other metadata of the upload.
+func newAvatar(b []byte) (avatarImages, error) {
+	if len(b) > maxAvatarBytes {
+		return nil, errs.Errorf("%v: %d bytes", errAvatarSize, len(b))
+	}
+	if contentType := http.DetectContentType(b); !avatarFormats[contentType] {
+		return nil, errs.Errorf("%v: '%s'", errAvatarFormat, contentType)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		return nil, errs.New(errAvatarFormat, err)
+	}
+	if cfg.Width*cfg.Height > maxAvatarPixels {
+		return nil, errs.Errorf("%v: %dx%d pixels", errAvatarSize, cfg.Width, cfg.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, errs.New(errAvatarFormat, err)
+	}
+	img = centerSquare(img)
+	images := avatarImages{}
+	for _, size := range avatarSizes {
+		if images[size], err = encodeAvatar(scaleAvatar(img, size)); err != nil {
+			return nil, err
+		}
+	}
+	return images, nil
+}
+
+// centerSquare returns the largest centered square of img.
+func centerSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	r := image.Rect(x0, y0, x0+side, y0+side)
+	if s, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	}); ok {
+		return s.SubImage(r)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, r.Min, draw.Src)
+	return dst
+}
+
+func scaleAvatar(img image.Image, size int) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Src, nil)
+	return dst
+}
+
+func encodeAvatar(img image.Image) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		return nil, errs.New(errAvatarFormat, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// parseAvatarSize parses the size query parameter of avatar requests.
+// It returns avatarSize for "" and 0 for sizes not in avatarSizes.
+func parseAvatarSize(s string) int {
+	if s == "" {
+		return avatarSize
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil {
+		return 0
+	}
+	for _, valid := range avatarSizes {
+		if size == valid {
+			return size
+		}
+	}
+	return 0
+}
+
+// avatarETag returns a strong entity tag for avatar served at size.
+func avatarETag(avatar []byte, size int) string {
+	sum := sha256.Sum256(avatar)
+	return `"` + hex.EncodeToString(sum[:8]) + "-" + strconv.Itoa(size) + `"`
+}
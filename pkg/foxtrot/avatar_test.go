@@ -0,0 +1,104 @@
+package foxtrot
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// testImage returns a w x h image, red in its centered square and blue
+// outside.
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	side, x0, y0 := w, 0, (h-w)/2
+	if h < w {
+		side, x0, y0 = h, (w-h)/2, 0
+	}
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			c := color.RGBA{B: 255, A: 255}
+			if x >= x0 && x < x0+side && y >= y0 && y < y0+side {
+				c = color.RGBA{R: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	return img
+}
+
+func decodePNG(t *testing.T, b []byte) image.Image {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+	return img
+}
+
+func TestNewAvatar(t *testing.T) {
+	img := testImage(300, 100)
+	encoders := map[string]func(*bytes.Buffer) error{
+		"png":  func(b *bytes.Buffer) error { return png.Encode(b, img) },
+		"jpeg": func(b *bytes.Buffer) error { return jpeg.Encode(b, img, nil) },
+		"gif":  func(b *bytes.Buffer) error { return gif.Encode(b, img, nil) },
+	}
+	for name, encode := range encoders {
+		encode := encode
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			require.NoError(t, encode(buf))
+			images, err := newAvatar(buf.Bytes())
+			require.NoError(t, err)
+			require.Len(t, images, len(avatarSizes))
+			for _, size := range avatarSizes {
+				avatar := decodePNG(t, images[size])
+				require.Equal(t, image.Rect(0, 0, size, size), avatar.Bounds())
+				for _, p := range []image.Point{{0, 0}, {size - 1, size - 1}, {size / 2, 0}} {
+					r, g, b, _ := avatar.At(p.X, p.Y).RGBA()
+					require.Greater(t, r, uint32(0xe000), p)
+					require.Less(t, g, uint32(0x2000), p)
+					require.Less(t, b, uint32(0x2000), p)
+				}
+			}
+		})
+	}
+}
+
+func TestNewAvatarStripsEXIF(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, jpeg.Encode(buf, testImage(20, 20), nil))
+	exif := []byte("\xff\xe1\x00\x10Exif\x00\x00GPS-DATA")
+	b := append(append([]byte{}, buf.Bytes()[:2]...), exif...)
+	b = append(b, buf.Bytes()[2:]...)
+	images, err := newAvatar(b)
+	require.NoError(t, err)
+	for _, avatar := range images {
+		require.NotContains(t, string(avatar), "GPS-DATA")
+		require.NotContains(t, string(avatar), "Exif")
+	}
+}
+
+func TestNewAvatarErr(t *testing.T) {
+	_, err := newAvatar([]byte("<svg></svg>"))
+	requireErrIs(t, err, errAvatarFormat)
+	_, err = newAvatar([]byte("\x89PNG\r\n\x1a\ntruncated"))
+	requireErrIs(t, err, errAvatarFormat)
+	_, err = newAvatar(make([]byte, maxAvatarBytes+1))
+	requireErrIs(t, err, errAvatarSize)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, 8193, 2048))))
+	_, err = newAvatar(buf.Bytes())
+	requireErrIs(t, err, errAvatarSize)
+}
+
+func TestParseAvatarSize(t *testing.T) {
+	require.Equal(t, avatarSize, parseAvatarSize(""))
+	require.Equal(t, 64, parseAvatarSize("64"))
+	require.Equal(t, 0, parseAvatarSize("65"))
+	require.Equal(t, 0, parseAvatarSize("big"))
+}
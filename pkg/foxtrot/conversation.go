@@ -0,0 +1,70 @@
+package foxtrot
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// conversationPrefix starts the room names of direct message
+	// conversations. Regular room names cannot contain '/'.
+	conversationPrefix = "dm/"
+	maxParticipants    = 10 // including the creator
+)
+
+// Conversation is a direct message conversation between two or more
+// users. Its messages are stored and sent like room messages, with ID
+// as room, but only participants can read and write them.
+type Conversation struct {
+	ID           string   `json:"id"`
+	Participants []string `json:"participants"` // sorted, including the user themselves
+	CreatedAt    string   `json:"createdAt"`
+	LastMessage  *Message `json:"lastMessage,omitempty"`
+}
+
+// conversationRequest is the request body of POST /api/conversations.
+type conversationRequest struct {
+	Participants []string `json:"participants"` // the creator is added if missing
+}
+
+// participants returns the sorted, de-duplicated participants of a new
+// conversation of creator.
+func (cr conversationRequest) participants(creator string) ([]string, error) {
+	set := map[string]bool{creator: true}
+	var v validationErrors
+	for _, name := range cr.Participants {
+		if name == deletedUser {
+			msg := fmt.Sprintf("unknown user '%s'", name)
+			v = append(v, validationError{Field: "participants", Code: "invalid", Message: msg})
+		}
+		set[name] = true
+	}
+	switch {
+	case len(set) < 2:
+		msg := "participants must include another user"
+		v = append(v, validationError{Field: "participants", Code: "too_short", Message: msg})
+	case len(set) > maxParticipants:
+		msg := fmt.Sprintf("participants must be at most %d users", maxParticipants)
+		v = append(v, validationError{Field: "participants", Code: "too_long", Message: msg})
+	}
+	if len(v) != 0 {
+		return nil, v
+	}
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// participantsKey returns the unique key of a conversation with the
+// given sorted participants.
+func participantsKey(participants []string) string {
+	return strings.Join(participants, "\n")
+}
+
+func isConversation(room string) bool {
+	return strings.HasPrefix(room, conversationPrefix)
+}
@@ -0,0 +1,35 @@
+package foxtrot
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConversationParticipants(t *testing.T) {
+	names, err := conversationRequest{Participants: []string{"$Goat", "$Fox", "$Cat", "$Goat"}}.participants("$Fox")
+	require.NoError(t, err)
+	require.Equal(t, []string{"$Cat", "$Fox", "$Goat"}, names)
+	names, err = conversationRequest{Participants: []string{"$Goat"}}.participants("$Fox")
+	require.NoError(t, err)
+	require.Equal(t, []string{"$Fox", "$Goat"}, names)
+
+	many := make([]string, maxParticipants)
+	for i := range many {
+		many[i] = string(rune('a' + i))
+	}
+	for _, participants := range [][]string{nil, {"$Fox"}, {deletedUser}, many} {
+		_, err := conversationRequest{Participants: participants}.participants("$Fox")
+		var v validationErrors
+		require.True(t, errors.As(err, &v), participants)
+		require.Equal(t, "participants", v[0].Field)
+	}
+}
+
+func TestIsConversation(t *testing.T) {
+	require.True(t, isConversation(conversationPrefix+"abc"))
+	require.False(t, isConversation("$Kitchen"))
+	_, err := validateRoomName(conversationPrefix + "abc")
+	require.Error(t, err)
+}
@@ -3,7 +3,10 @@ package foxtrot
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
+	"strings"
+	"time"
 
 	"foxygo.at/s/errs"
 	"github.com/mattn/go-sqlite3"
@@ -16,6 +19,9 @@ var (
 	errDBDuplicate      = errors.New("db: duplicate")
 )
 
+// deletedUser is the tombstone author of messages of deleted users.
+const deletedUser = "[deleted]"
+
 type db struct {
 	conn *sql.DB
 }
@@ -47,7 +53,7 @@ func (db *db) setupSchema() error {
 	selectVersionStr := "SELECT version FROM schema"
 	version := ""
 	err := db.conn.QueryRow(selectVersionStr).Scan(&version)
-	expectedVersion := "v0.0.1"
+	expectedVersion := "v0.0.11"
 	if err == nil && version != expectedVersion {
 		return errs.Errorf("%v: bad version '%s' expected '%s'", errDBInitialisation, version, expectedVersion)
 	} else if err == nil {
@@ -64,9 +70,10 @@ func (db *db) setupSchema() error {
 }
 
 func (db *db) getUser(ctx context.Context, name string) (*User, error) {
-	u := User{Name: name}
-	stmt := "SELECT password_hash FROM users WHERE name = ?"
-	err := db.conn.QueryRowContext(ctx, stmt, name).Scan(&u.passwordHash)
+	u := User{Name: name, AvatarURL: avatarURL(name)}
+	stmt := "SELECT password_hash, session_gen, display_name, bio, status, timezone FROM users WHERE name = ?"
+	err := db.conn.QueryRowContext(ctx, stmt, name).Scan(&u.passwordHash, &u.sessionGen,
+		&u.DisplayName, &u.Bio, &u.Status, &u.Timezone)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errs.Errorf("%s: getUser '%s': %v", errDBNotFound, name, err)
@@ -76,21 +83,63 @@ func (db *db) getUser(ctx context.Context, name string) (*User, error) {
 	return &u, nil
 }
 
+// createUser creates a new user. User names must be unique by their
+// nameKey, otherwise an errDBDuplicate error is returned.
 func (db *db) createUser(ctx context.Context, u *User) error {
-	stmt := "INSERT INTO users(name, password_hash, avatar) VALUES (?, ?, ?)"
-	if _, err := db.conn.ExecContext(ctx, stmt, u.Name, u.passwordHash, u.avatar); err != nil {
+	key := nameKey(u.Name)
+	var gen int64
+	stmt := "SELECT session_gen + 1 FROM deleted_users WHERE name_key = ?"
+	if err := db.conn.QueryRowContext(ctx, stmt, key).Scan(&gen); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return errs.Errorf("%v: cannot query deleted user '%s': %v", errDBInternal, u.Name, err)
+	}
+	stmt = "INSERT INTO users(name, name_key, password_hash, avatar, session_gen) VALUES (?, ?, ?, ?, ?)"
+	if _, err := db.conn.ExecContext(ctx, stmt, u.Name, key, u.passwordHash, u.avatar, gen); err != nil {
 		sqliteErr := &sqlite3.Error{}
-		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		if errors.As(err, sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique) {
 			return errs.Errorf("%v: user '%s': %v", errDBDuplicate, u.Name, err)
 		}
 		return errs.Errorf("%v: cannot create user '%s': %v", errDBInternal, u.Name, err)
 	}
+	u.sessionGen = gen
 	return nil
 }
 
-func (db *db) deleteUser(ctx context.Context, name string) error {
-	stmt := "DELETE FROM users WHERE name = ?"
-	result, err := db.conn.ExecContext(ctx, stmt, name)
+// deleteUser deletes user name with all their tokens, roles and other
+// data. Messages authored by the user are deleted or, if
+// deleteMessages is false, attributed to the deletedUser tombstone.
+func (db *db) deleteUser(ctx context.Context, name string, deleteMessages bool) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt := "UPDATE messages SET author = ? WHERE author = ?"
+	args := []interface{}{deletedUser, name}
+	if deleteMessages {
+		stmt = "DELETE FROM messages WHERE author = ?"
+		args = args[1:]
+	}
+	if _, err := tx.ExecContext(ctx, stmt, args...); err != nil {
+		return errs.Errorf("%v: cannot remove messages of user '%s': %v", errDBInternal, name, err)
+	}
+	stmt = "UPDATE messages SET deleted_by = ? WHERE deleted_by = ?"
+	if _, err := tx.ExecContext(ctx, stmt, deletedUser, name); err != nil {
+		return errs.Errorf("%v: cannot anonymise message deletions by user '%s': %v", errDBInternal, name, err)
+	}
+	// a new user of the same name must not join the user's conversations
+	stmt = `UPDATE rooms SET participants = NULL
+WHERE conversation = 1 AND name IN (SELECT room FROM room_members WHERE name = ?)`
+	if _, err := tx.ExecContext(ctx, stmt, name); err != nil {
+		return errs.Errorf("%v: cannot close conversations of user '%s': %v", errDBInternal, name, err)
+	}
+	stmt = `INSERT OR REPLACE INTO deleted_users(name_key, session_gen)
+SELECT name_key, session_gen FROM users WHERE name = ?`
+	if _, err := tx.ExecContext(ctx, stmt, name); err != nil {
+		return errs.Errorf("%v: cannot record deletion of user '%s': %v", errDBInternal, name, err)
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM users WHERE name = ?", name)
 	if err != nil {
 		return errs.Errorf("%v: cannot delete user '%s': %v", errDBInternal, name, err)
 	}
@@ -101,78 +150,1585 @@ func (db *db) deleteUser(ctx context.Context, name string) error {
 	if cnt == 0 {
 		return errs.Errorf("%v: cannot delete user '%s'", errDBNotFound, name)
 	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit deletion of user '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// updatePassword sets the password hash of user name, increments the
+// user's session generation and removes all outstanding password reset
+// tokens. It returns the updated user.
+func (db *db) updatePassword(ctx context.Context, name, passwordHash string) (*User, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt := "UPDATE users SET password_hash = ?, session_gen = session_gen + 1 WHERE name = ?"
+	result, err := tx.ExecContext(ctx, stmt, passwordHash, name)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot update password of user '%s': %v", errDBInternal, name, err)
+	}
+	if cnt, err := result.RowsAffected(); err != nil || cnt == 0 {
+		return nil, errs.Errorf("%v: cannot update password of user '%s'", errDBNotFound, name)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM password_resets WHERE name = ?", name); err != nil {
+		return nil, errs.Errorf("%v: cannot delete password resets of user '%s': %v", errDBInternal, name, err)
+	}
+	u := User{Name: name, passwordHash: passwordHash, AvatarURL: avatarURL(name)}
+	stmt = "SELECT session_gen FROM users WHERE name = ?"
+	if err := tx.QueryRowContext(ctx, stmt, name).Scan(&u.sessionGen); err != nil {
+		return nil, errs.Errorf("%v: cannot get session generation of user '%s': %v", errDBInternal, name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errs.Errorf("%v: cannot commit password update of user '%s': %v", errDBInternal, name, err)
+	}
+	return &u, nil
+}
+
+// updatePasswordHash replaces the password hash of user name with
+// newHash if it still is oldHash, e.g. when rehashing with new
+// parameters. The session generation is left as is.
+func (db *db) updatePasswordHash(ctx context.Context, name, oldHash, newHash string) error {
+	stmt := "UPDATE users SET password_hash = ? WHERE name = ? AND password_hash = ?"
+	result, err := db.conn.ExecContext(ctx, stmt, newHash, name, oldHash)
+	if err != nil {
+		return errs.Errorf("%v: cannot update password hash of user '%s': %v", errDBInternal, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm password hash update of user '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot update password hash of user '%s'", errDBNotFound, name)
+	}
+	return nil
+}
+
+// createPasswordReset stores the hash of a password reset token for
+// user name, valid until expiresAt in unix epoche seconds. Expired
+// reset tokens of all users are removed.
+func (db *db) createPasswordReset(ctx context.Context, name, tokenHash string, expiresAt int64) error {
+	stmt := "DELETE FROM password_resets WHERE expires_at <= ?"
+	if _, err := db.conn.ExecContext(ctx, stmt, time.Now().Unix()); err != nil {
+		return errs.Errorf("%v: cannot delete expired password resets: %v", errDBInternal, err)
+	}
+	stmt = "INSERT INTO password_resets(token_hash, name, expires_at) VALUES (?, ?, ?)"
+	if _, err := db.conn.ExecContext(ctx, stmt, tokenHash, name, expiresAt); err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return errs.Errorf("%v: cannot create password reset for user '%s': %v", errDBNotFound, name, err)
+		}
+		return errs.Errorf("%v: cannot create password reset for user '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// deletePasswordReset removes the password reset token with given hash
+// for user name if it has not expired by now in unix epoche seconds. It
+// returns an errDBNotFound error if there is no such token.
+func (db *db) deletePasswordReset(ctx context.Context, name, tokenHash string, now int64) error {
+	stmt := "DELETE FROM password_resets WHERE token_hash = ? AND name = ? AND expires_at > ?"
+	result, err := db.conn.ExecContext(ctx, stmt, tokenHash, name, now)
+	if err != nil {
+		return errs.Errorf("%v: cannot delete password reset for user '%s': %v", errDBInternal, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm deletion of password reset for user '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: password reset for user '%s'", errDBNotFound, name)
+	}
 	return nil
 }
 
+const roomColumns = `name, topic, description, icon, COALESCE(created_by, ''), created_at, settings, private,
+archived_at`
+
+// scanRoom scans a row of roomColumns.
+func scanRoom(row interface{ Scan(...interface{}) error }) (*Room, error) {
+	r := Room{}
+	settings := ""
+	err := row.Scan(&r.Name, &r.Topic, &r.Description, &r.Icon, &r.CreatedBy, &r.CreatedAt, &settings, &r.Private,
+		&r.ArchivedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(settings), &r.Settings); err != nil {
+		return nil, errs.Errorf("%v: invalid settings of room '%s': %v", errDBInternal, r.Name, err)
+	}
+	return &r, nil
+}
+
 func (db *db) getRoom(ctx context.Context, name string) (*Room, error) {
-	r := Room{Name: name}
-	stmt := "SELECT name FROM rooms WHERE name = ?"
-	err := db.conn.QueryRowContext(ctx, stmt, name).Scan(&r.Name)
+	stmt := "SELECT " + roomColumns + " FROM rooms WHERE name = ?"
+	r, err := scanRoom(db.conn.QueryRowContext(ctx, stmt, name))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errs.Errorf("%s: getRoom '%s': %v", errDBNotFound, name, err)
 		}
 		return nil, errs.New(errDBInternal, err)
 	}
-	return &r, nil
+	return r, nil
 }
 
+// createRoom creates a new room. If r.CreatedBy is set, that user
+// becomes a member of the new room with the owner role. Room names must
+// be unique by their nameKey, otherwise an errDBDuplicate error is
+// returned.
 func (db *db) createRoom(ctx context.Context, r *Room) error {
-	stmt := "INSERT INTO rooms(name) VALUES (?)"
-	if _, err := db.conn.ExecContext(ctx, stmt, r.Name); err != nil {
+	settings, err := json.Marshal(r.Settings)
+	if err != nil {
+		return errs.Errorf("%v: cannot encode settings of room '%s': %v", errDBInternal, r.Name, err)
+	}
+	createdBy := sql.NullString{String: r.CreatedBy, Valid: r.CreatedBy != ""}
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt := `INSERT INTO rooms(name, name_key, topic, description, icon, created_by, created_at, settings, private)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	args := []interface{}{
+		r.Name, nameKey(r.Name), r.Topic, r.Description, r.Icon, createdBy, r.CreatedAt, string(settings), r.Private,
+	}
+	_, err = tx.ExecContext(ctx, stmt, args...)
+	if err != nil {
 		sqliteErr := &sqlite3.Error{}
-		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		if errors.As(err, sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique) {
 			return errs.Errorf("%v: room '%s': %v", errDBDuplicate, r.Name, err)
 		}
 		return errs.Errorf("%v: cannot create room '%s': %v", errDBInternal, r.Name, err)
 	}
+	if r.CreatedBy != "" {
+		stmt := "INSERT INTO room_members(room, name, role, joined_at) VALUES (?, ?, ?, ?)"
+		if _, err := tx.ExecContext(ctx, stmt, r.Name, r.CreatedBy, roleOwner.String(), r.CreatedAt); err != nil {
+			return errs.Errorf("%v: cannot make '%s' owner of room '%s': %v", errDBInternal, r.CreatedBy, r.Name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit room '%s': %v", errDBInternal, r.Name, err)
+	}
 	return nil
 }
 
-// queryMessages returns a list Messages for given room. A maximum of
-// limit messages is returned, or all messages if limit is set to -1
-// Only messages the came before given beforeID are returned or messages
-// up until the most recent one if beforeID is -1.
-func (db *db) queryMessages(ctx context.Context, room string, beforeID, limit int) ([]*Message, error) {
-	stmt := `SELECT id, content, created_at, room, author FROM messages WHERE room = ?`
-	args := []interface{}{room}
-	if beforeID != -1 {
-		stmt += " AND id < ?"
-		args = append(args, beforeID)
+// updateRoom changes the non-nil fields of room name. On rename,
+// messages, members and invites move with the room. Room names must be
+// unique by their nameKey, otherwise an errDBDuplicate error is
+// returned.
+func (db *db) updateRoom(ctx context.Context, name string, ru roomUpdate) error {
+	var sets []string
+	var args []interface{}
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{
+		{"name", ru.Name},
+		{"topic", ru.Topic},
+		{"description", ru.Description},
+		{"icon", ru.Icon},
+	} {
+		if f.value != nil {
+			sets = append(sets, f.column+" = ?")
+			args = append(args, *f.value)
+		}
 	}
-	stmt += " ORDER BY id DESC"
-	if limit != -1 {
-		stmt += " LIMIT ?"
-		args = append(args, limit)
+	if ru.Name != nil {
+		sets = append(sets, "name_key = ?")
+		args = append(args, nameKey(*ru.Name))
 	}
-	rows, err := db.conn.QueryContext(ctx, stmt, args...)
+	if ru.Settings != nil {
+		settings, err := json.Marshal(ru.Settings)
+		if err != nil {
+			return errs.Errorf("%v: cannot encode settings of room '%s': %v", errDBInternal, name, err)
+		}
+		sets = append(sets, "settings = ?")
+		args = append(args, string(settings))
+	}
+	if ru.Private != nil {
+		sets = append(sets, "private = ?")
+		args = append(args, *ru.Private)
+	}
+	if len(sets) == 0 {
+		_, err := db.getRoom(ctx, name)
+		return err
+	}
+	stmt := "UPDATE rooms SET " + strings.Join(sets, ", ") + " WHERE name = ?"
+	result, err := db.conn.ExecContext(ctx, stmt, append(args, name)...)
+	if err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && (sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey ||
+			sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique) {
+			return errs.Errorf("%v: room '%s': %v", errDBDuplicate, *ru.Name, err)
+		}
+		return errs.Errorf("%v: cannot update room '%s': %v", errDBInternal, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm update of room '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot update room '%s'", errDBNotFound, name)
+	}
+	return nil
+}
+
+// roomFilter selects the rooms returned by queryRooms.
+type roomFilter struct {
+	member   string // if not empty, only rooms member is a member of
+	viewer   string // if not empty, no private rooms viewer is not a member of
+	archived bool   // archived instead of active rooms
+}
+
+// queryRooms returns up to limit rooms selected by f ordered by name
+// with names after the given name, for pagination. Conversations are
+// never returned.
+func (db *db) queryRooms(ctx context.Context, f roomFilter, after string, limit int) ([]*Room, error) {
+	stmt := "SELECT " + roomColumns + " FROM rooms WHERE conversation = 0 AND name > ?"
+	args := []interface{}{after}
+	if f.member != "" {
+		stmt += " AND name IN (SELECT room FROM room_members WHERE name = ?)"
+		args = append(args, f.member)
+	}
+	if f.viewer != "" {
+		stmt += " AND (private = 0 OR name IN (SELECT room FROM room_members WHERE name = ?))"
+		args = append(args, f.viewer)
+	}
+	if f.archived {
+		stmt += " AND archived_at <> ''"
+	} else {
+		stmt += " AND archived_at = ''"
+	}
+	stmt += " ORDER BY name LIMIT ?"
+	rows, err := db.conn.QueryContext(ctx, stmt, append(args, limit)...)
 	if err != nil {
-		return nil, errs.Errorf("%v: QueryContext messages for room '%s' before '%d': %v", errDBInternal, room, beforeID, err)
+		return nil, errs.Errorf("%v: cannot query rooms: %v", errDBInternal, err)
 	}
 	defer rows.Close() //nolint:errcheck
-	messages, err := rowsToMessages(rows)
+	rooms := []*Room{}
+	for rows.Next() {
+		r, err := scanRoom(rows)
+		if err != nil {
+			return nil, errs.Errorf("%v: cannot scan room: %v", errDBInternal, err)
+		}
+		rooms = append(rooms, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate rooms: %v", errDBInternal, err)
+	}
+	return rooms, nil
+}
+
+// setRoomArchived archives room name at archivedAt or, if archivedAt
+// is empty, restores it.
+func (db *db) setRoomArchived(ctx context.Context, name, archivedAt string) error {
+	result, err := db.conn.ExecContext(ctx, "UPDATE rooms SET archived_at = ? WHERE name = ?", archivedAt, name)
 	if err != nil {
-		return nil, errs.Errorf("%v: rowsToMessages for room '%s' before '%d': %v", errDBInternal, room, beforeID, err)
+		return errs.Errorf("%v: cannot archive or restore room '%s': %v", errDBInternal, name, err)
 	}
-	return messages, nil
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm archiving or restoring room '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot archive or restore room '%s'", errDBNotFound, name)
+	}
+	return nil
 }
 
-func rowsToMessages(rows *sql.Rows) ([]*Message, error) {
-	messages := []*Message{}
+// deleteRoom deletes room name. Its messages, members and invites are
+// deleted with it in the same transaction by foreign key cascades.
+func (db *db) deleteRoom(ctx context.Context, name string) error {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM rooms WHERE name = ?", name)
+	if err != nil {
+		return errs.Errorf("%v: cannot delete room '%s': %v", errDBInternal, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm deletion of room '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot delete room '%s'", errDBNotFound, name)
+	}
+	return nil
+}
+
+// joinRoom makes user name a member of room. Existing members keep
+// their role.
+func (db *db) joinRoom(ctx context.Context, room, name, joinedAt string) error {
+	stmt := "INSERT OR IGNORE INTO room_members(room, name, role, joined_at) VALUES (?, ?, ?, ?)"
+	if _, err := db.conn.ExecContext(ctx, stmt, room, name, roleMember.String(), joinedAt); err != nil {
+		return joinErr(err, room, name)
+	}
+	return nil
+}
+
+// joinRoomWithInvite makes user name a member of room if tokenHash is
+// the hash of a valid invite to room. The invite is only used up by
+// users who are not members yet. Invalid, expired and used up invites
+// return an errDBNotFound error.
+func (db *db) joinRoomWithInvite(ctx context.Context, room, name, tokenHash, joinedAt string, now int64) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	id := 0
+	stmt := `SELECT id FROM room_invites WHERE room = ? AND token_hash = ?
+AND (expires_at = 0 OR expires_at > ?) AND (max_uses = 0 OR uses < max_uses)`
+	if err := tx.QueryRowContext(ctx, stmt, room, tokenHash, now).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errs.Errorf("%v: no valid invite to room '%s': %v", errDBNotFound, room, err)
+		}
+		return errs.New(errDBInternal, err)
+	}
+	stmt = "INSERT OR IGNORE INTO room_members(room, name, role, joined_at) VALUES (?, ?, ?, ?)"
+	result, err := tx.ExecContext(ctx, stmt, room, name, roleMember.String(), joinedAt)
+	if err != nil {
+		return joinErr(err, room, name)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm '%s' joining room '%s': %v", errDBInternal, name, room, err)
+	}
+	if cnt != 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE room_invites SET uses = uses + 1 WHERE id = ?", id); err != nil {
+			return errs.Errorf("%v: cannot use invite %d: %v", errDBInternal, id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit '%s' joining room '%s': %v", errDBInternal, name, room, err)
+	}
+	return nil
+}
+
+func joinErr(err error, room, name string) error {
+	sqliteErr := &sqlite3.Error{}
+	if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+		return errs.Errorf("%v: cannot add '%s' to room '%s': %v", errDBNotFound, name, room, err)
+	}
+	return errs.Errorf("%v: cannot add '%s' to room '%s': %v", errDBInternal, name, room, err)
+}
+
+// leaveRoom removes user name from the members of room, whatever their
+// role.
+func (db *db) leaveRoom(ctx context.Context, room, name string) error {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM room_members WHERE room = ? AND name = ?", room, name)
+	if err != nil {
+		return errs.Errorf("%v: cannot remove '%s' from room '%s': %v", errDBInternal, name, room, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm removal of '%s' from room '%s': %v", errDBInternal, name, room, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: '%s' is not a member of room '%s'", errDBNotFound, name, room)
+	}
+	return nil
+}
+
+// createInvite stores inv with given token hash and expiry in unix
+// epoche seconds, 0 for never, and sets its ID.
+func (db *db) createInvite(ctx context.Context, tokenHash string, expiresAt int64, inv *Invite) error {
+	stmt := `INSERT INTO room_invites(room, token_hash, created_by, created_at, expires_at, max_uses)
+VALUES (?, ?, ?, ?, ?, ?)`
+	args := []interface{}{inv.Room, tokenHash, inv.CreatedBy, inv.CreatedAt, expiresAt, inv.MaxUses}
+	result, err := db.conn.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return errs.Errorf("%v: cannot create invite to room '%s': %v", errDBNotFound, inv.Room, err)
+		}
+		return errs.Errorf("%v: cannot create invite to room '%s': %v", errDBInternal, inv.Room, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errs.Errorf("%v: cannot get invite ID: %v", errDBInternal, err)
+	}
+	inv.ID = int(id)
+	inv.ExpiresAt = formatExpiry(expiresAt)
+	return nil
+}
+
+// queryInvites returns the invites to room ordered by creation,
+// including expired and used up ones.
+func (db *db) queryInvites(ctx context.Context, room string) ([]*Invite, error) {
+	stmt := `SELECT id, room, created_by, created_at, expires_at, max_uses, uses FROM room_invites
+WHERE room = ? ORDER BY id`
+	rows, err := db.conn.QueryContext(ctx, stmt, room)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query invites to room '%s': %v", errDBInternal, room, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	invites := []*Invite{}
 	for rows.Next() {
-		var m Message
-		if err := rows.Scan(&m.ID, &m.Content, &m.CreatedAt, &m.Room, &m.Author); err != nil {
-			return nil, errs.Errorf("scan row: %v", err)
+		inv := &Invite{}
+		var expiresAt int64
+		err := rows.Scan(&inv.ID, &inv.Room, &inv.CreatedBy, &inv.CreatedAt, &expiresAt, &inv.MaxUses, &inv.Uses)
+		if err != nil {
+			return nil, errs.Errorf("%v: cannot scan invite: %v", errDBInternal, err)
 		}
-		messages = append(messages, &m)
+		inv.ExpiresAt = formatExpiry(expiresAt)
+		invites = append(invites, inv)
 	}
-	return messages, nil
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate invites: %v", errDBInternal, err)
+	}
+	return invites, nil
 }
 
-func (db *db) createMessage(ctx context.Context, m *Message) error {
-	stmt := "INSERT INTO messages(content, created_at, room, author) VALUES (?, ?, ?, ?)"
-	if _, err := db.conn.ExecContext(ctx, stmt, m.Content, m.CreatedAt, m.Room, m.Author); err != nil {
-		return errs.Errorf("%v: cannot create message '%#v': %v", errDBInternal, m, err)
+// deleteInvite revokes the invite with given ID to room.
+func (db *db) deleteInvite(ctx context.Context, room string, id int) error {
+	result, err := db.conn.ExecContext(ctx, "DELETE FROM room_invites WHERE room = ? AND id = ?", room, id)
+	if err != nil {
+		return errs.Errorf("%v: cannot delete invite %d: %v", errDBInternal, id, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm deletion of invite %d: %v", errDBInternal, id, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot delete invite %d to room '%s'", errDBNotFound, id, room)
+	}
+	return nil
+}
+
+// getOrCreateConversation returns the conversation of the given
+// sorted participants, or creates it with ID id if there is none. It
+// reports whether the conversation was created. Unknown participants
+// return an errDBNotFound error.
+func (db *db) getOrCreateConversation(ctx context.Context, participants []string,
+	id, createdBy, createdAt string) (*Conversation, bool, error) {
+	key := participantsKey(participants)
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	c := &Conversation{Participants: participants}
+	stmt := "SELECT name, created_at FROM rooms WHERE participants = ?"
+	err = tx.QueryRowContext(ctx, stmt, key).Scan(&c.ID, &c.CreatedAt)
+	if err == nil {
+		return c, false, nil
 	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, errs.New(errDBInternal, err)
+	}
+	stmt = `INSERT INTO rooms(name, name_key, created_by, created_at, private, conversation, participants)
+VALUES (?, ?, ?, ?, 1, 1, ?)`
+	if _, err := tx.ExecContext(ctx, stmt, id, nameKey(id), createdBy, createdAt, key); err != nil {
+		return nil, false, errs.Errorf("%v: cannot create conversation: %v", errDBInternal, err)
+	}
+	stmt = "INSERT INTO room_members(room, name, role, joined_at) VALUES (?, ?, ?, ?)"
+	for _, name := range participants {
+		if _, err := tx.ExecContext(ctx, stmt, id, name, roleMember.String(), createdAt); err != nil {
+			return nil, false, joinErr(err, id, name)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, errs.Errorf("%v: cannot commit conversation: %v", errDBInternal, err)
+	}
+	c.ID, c.CreatedAt = id, createdAt
+	return c, true, nil
+}
+
+// queryConversations returns the conversations of user name with their
+// latest message, most recently active first.
+func (db *db) queryConversations(ctx context.Context, name string) ([]*Conversation, error) {
+	stmt := `SELECT r.name, r.created_at,
+  (SELECT GROUP_CONCAT(name, char(10)) FROM (SELECT name FROM room_members WHERE room = r.name ORDER BY name)),
+  m.id, m.content, m.created_at, m.author, m.edited_at, m.deleted_at, m.deleted_by
+FROM rooms r JOIN room_members rm ON rm.room = r.name AND rm.name = ?
+LEFT JOIN messages m ON m.id = (SELECT MAX(id) FROM messages WHERE room = r.name)
+WHERE r.conversation = 1
+ORDER BY COALESCE(m.created_at, r.created_at) DESC, r.name`
+	rows, err := db.conn.QueryContext(ctx, stmt, name)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query conversations of '%s': %v", errDBInternal, name, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	conversations := []*Conversation{}
+	for rows.Next() {
+		c := &Conversation{}
+		participants := ""
+		var id sql.NullInt64
+		var content, createdAt, author, editedAt, deletedAt, deletedBy sql.NullString
+		err := rows.Scan(&c.ID, &c.CreatedAt, &participants, &id, &content, &createdAt, &author, &editedAt,
+			&deletedAt, &deletedBy)
+		if err != nil {
+			return nil, errs.Errorf("%v: cannot scan conversation: %v", errDBInternal, err)
+		}
+		c.Participants = strings.Split(participants, "\n")
+		if id.Valid {
+			c.LastMessage = &Message{
+				ID:        int(id.Int64),
+				Content:   content.String,
+				CreatedAt: createdAt.String,
+				Room:      c.ID,
+				Author:    author.String,
+				EditedAt:  editedAt.String,
+				DeletedAt: deletedAt.String,
+				DeletedBy: deletedBy.String,
+			}
+		}
+		conversations = append(conversations, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate conversations: %v", errDBInternal, err)
+	}
+	return conversations, nil
+}
+
+// moderate applies the action of e to user e.User in room e.Room and
+// records it in the moderation log in one transaction. Kicks and bans
+// remove the user from the room's members, bans and mutes replace an
+// earlier sanction of the same kind. Lifting a sanction the user does
+// not have returns an errDBNotFound error. e.ID is set.
+func (db *db) moderate(ctx context.Context, e *ModerationEntry, expiresAt int64) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	if e.Action == actionKick || e.Action == actionBan {
+		stmt := "DELETE FROM room_members WHERE room = ? AND name = ?"
+		if _, err := tx.ExecContext(ctx, stmt, e.Room, e.User); err != nil {
+			return errs.Errorf("%v: cannot remove '%s' from room '%s': %v", errDBInternal, e.User, e.Room, err)
+		}
+	}
+	kind := sanctionKind(e.Action)
+	switch e.Action {
+	case actionBan, actionMute:
+		stmt := `INSERT OR REPLACE INTO room_sanctions(room, name, kind, moderator, reason, created_at, expires_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+		_, err := tx.ExecContext(ctx, stmt, e.Room, e.User, kind, e.Moderator, e.Reason, e.CreatedAt, expiresAt)
+		if err != nil {
+			sqliteErr := &sqlite3.Error{}
+			if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+				return errs.Errorf("%v: cannot %s '%s' in room '%s': %v", errDBNotFound, e.Action, e.User, e.Room, err)
+			}
+			return errs.Errorf("%v: cannot %s '%s' in room '%s': %v", errDBInternal, e.Action, e.User, e.Room, err)
+		}
+	case actionUnban, actionUnmute:
+		stmt := "DELETE FROM room_sanctions WHERE room = ? AND name = ? AND kind = ?"
+		result, err := tx.ExecContext(ctx, stmt, e.Room, e.User, kind)
+		if err != nil {
+			return errs.Errorf("%v: cannot %s '%s' in room '%s': %v", errDBInternal, e.Action, e.User, e.Room, err)
+		}
+		cnt, err := result.RowsAffected()
+		if err != nil {
+			return errs.Errorf("%v: cannot confirm %s of '%s': %v", errDBInternal, e.Action, e.User, err)
+		}
+		if cnt == 0 {
+			return errs.Errorf("%v: no %s of '%s' in room '%s'", errDBNotFound, kind, e.User, e.Room)
+		}
+	}
+	stmt := `INSERT INTO moderation_log(room, moderator, name, action, reason, created_at, expires_at)
+VALUES (?, ?, ?, ?, ?, ?, ?)`
+	result, err := tx.ExecContext(ctx, stmt, e.Room, e.Moderator, e.User, e.Action, e.Reason, e.CreatedAt, expiresAt)
+	if err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return errs.Errorf("%v: cannot log %s in room '%s': %v", errDBNotFound, e.Action, e.Room, err)
+		}
+		return errs.Errorf("%v: cannot log %s in room '%s': %v", errDBInternal, e.Action, e.Room, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errs.Errorf("%v: cannot get moderation log entry ID: %v", errDBInternal, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit %s of '%s': %v", errDBInternal, e.Action, e.User, err)
+	}
+	e.ID = int(id)
+	e.ExpiresAt = formatExpiry(expiresAt)
 	return nil
 }
+
+// getSanction returns the ban or mute of user name in room if it has
+// not expired at now, in unix epoche seconds.
+func (db *db) getSanction(ctx context.Context, room, name, kind string, now int64) (*Sanction, error) {
+	stmt := `SELECT room, name, kind, moderator, reason, created_at, expires_at FROM room_sanctions
+WHERE room = ? AND name = ? AND kind = ? AND (expires_at = 0 OR expires_at > ?)`
+	s, err := scanSanction(db.conn.QueryRowContext(ctx, stmt, room, name, kind, now))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errs.Errorf("%v: no %s of '%s' in room '%s': %v", errDBNotFound, kind, name, room, err)
+		}
+		return nil, errs.New(errDBInternal, err)
+	}
+	return s, nil
+}
+
+// querySanctions returns the bans and mutes in room that have not
+// expired at now, in unix epoche seconds, ordered by user name.
+func (db *db) querySanctions(ctx context.Context, room string, now int64) ([]*Sanction, error) {
+	stmt := `SELECT room, name, kind, moderator, reason, created_at, expires_at FROM room_sanctions
+WHERE room = ? AND (expires_at = 0 OR expires_at > ?) ORDER BY name, kind`
+	rows, err := db.conn.QueryContext(ctx, stmt, room, now)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query sanctions in room '%s': %v", errDBInternal, room, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	sanctions := []*Sanction{}
+	for rows.Next() {
+		s, err := scanSanction(rows)
+		if err != nil {
+			return nil, errs.Errorf("%v: cannot scan sanction: %v", errDBInternal, err)
+		}
+		sanctions = append(sanctions, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate sanctions: %v", errDBInternal, err)
+	}
+	return sanctions, nil
+}
+
+func scanSanction(row interface{ Scan(...interface{}) error }) (*Sanction, error) {
+	s := Sanction{}
+	var expiresAt int64
+	if err := row.Scan(&s.Room, &s.User, &s.Kind, &s.Moderator, &s.Reason, &s.CreatedAt, &expiresAt); err != nil {
+		return nil, err
+	}
+	s.ExpiresAt = formatExpiry(expiresAt)
+	return &s, nil
+}
+
+// queryModerationLog returns up to limit of the latest moderation log
+// entries of room, newest first.
+func (db *db) queryModerationLog(ctx context.Context, room string, limit int) ([]*ModerationEntry, error) {
+	stmt := `SELECT id, room, moderator, name, action, reason, created_at, expires_at FROM moderation_log
+WHERE room = ? ORDER BY id DESC LIMIT ?`
+	rows, err := db.conn.QueryContext(ctx, stmt, room, limit)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query moderation log of room '%s': %v", errDBInternal, room, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	entries := []*ModerationEntry{}
+	for rows.Next() {
+		e := &ModerationEntry{}
+		var expiresAt int64
+		err := rows.Scan(&e.ID, &e.Room, &e.Moderator, &e.User, &e.Action, &e.Reason, &e.CreatedAt, &expiresAt)
+		if err != nil {
+			return nil, errs.Errorf("%v: cannot scan moderation log entry: %v", errDBInternal, err)
+		}
+		e.ExpiresAt = formatExpiry(expiresAt)
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate moderation log: %v", errDBInternal, err)
+	}
+	return entries, nil
+}
+
+// queryMessages returns a list Messages for given room without thread
+// replies. A maximum of limit messages is returned, or all messages if
+// limit is set to -1 Only messages the came before given beforeID are
+// returned or messages up until the most recent one if beforeID is -1.
+func (db *db) queryMessages(ctx context.Context, room string, beforeID, limit int) ([]*Message, error) {
+	return db.queryMessagesWhere(ctx, "room = ? AND parent IS NULL", room, beforeID, limit)
+}
+
+// queryReplies returns the replies in the thread of message parent,
+// paginated as for queryMessages.
+func (db *db) queryReplies(ctx context.Context, parent, beforeID, limit int) ([]*Message, error) {
+	return db.queryMessagesWhere(ctx, "parent = ?", parent, beforeID, limit)
+}
+
+// queryMessagesWhere returns messages matching SQL condition cond with
+// a single argument arg, paginated as for queryMessages.
+func (db *db) queryMessagesWhere(ctx context.Context, cond string, arg interface{},
+	beforeID, limit int) ([]*Message, error) {
+	stmt := "SELECT " + messageColumns + " FROM messages WHERE " + cond
+	args := []interface{}{arg}
+	if beforeID != -1 {
+		stmt += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	stmt += " ORDER BY id DESC"
+	if limit != -1 {
+		stmt += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := db.conn.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, errs.Errorf("%v: QueryContext messages for '%v' before '%d': %v", errDBInternal, arg, beforeID, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	messages, err := rowsToMessages(rows)
+	if err != nil {
+		return nil, errs.Errorf("%v: rowsToMessages for '%v' before '%d': %v", errDBInternal, arg, beforeID, err)
+	}
+	return messages, nil
+}
+
+const messageColumns = `id, content, created_at, room, author, edited_at, deleted_at, COALESCE(deleted_by, ''),
+COALESCE(parent, 0)`
+
+// scanMessage scans a row of messageColumns.
+func scanMessage(row interface{ Scan(...interface{}) error }) (*Message, error) {
+	m := Message{}
+	err := row.Scan(&m.ID, &m.Content, &m.CreatedAt, &m.Room, &m.Author, &m.EditedAt, &m.DeletedAt, &m.DeletedBy,
+		&m.Parent)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func rowsToMessages(rows *sql.Rows) ([]*Message, error) {
+	messages := []*Message{}
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return nil, errs.Errorf("scan row: %v", err)
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// forEachMessageByAuthor calls fn for every message of author across
+// all rooms, ordered by ID, without loading all messages into memory.
+func (db *db) forEachMessageByAuthor(ctx context.Context, author string, fn func(*Message) error) error {
+	stmt := "SELECT " + messageColumns + " FROM messages WHERE author = ? ORDER BY id"
+	rows, err := db.conn.QueryContext(ctx, stmt, author)
+	if err != nil {
+		return errs.Errorf("%v: cannot query messages of '%s': %v", errDBInternal, author, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	for rows.Next() {
+		m, err := scanMessage(rows)
+		if err != nil {
+			return errs.Errorf("%v: cannot scan message: %v", errDBInternal, err)
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errs.Errorf("%v: cannot iterate messages of '%s': %v", errDBInternal, author, err)
+	}
+	return nil
+}
+
+// createMessage stores m and sets its ID. m.Parent is the parent
+// message of a thread reply, 0 for top-level messages.
+func (db *db) createMessage(ctx context.Context, m *Message) error {
+	parent := sql.NullInt64{Int64: int64(m.Parent), Valid: m.Parent != 0}
+	stmt := "INSERT INTO messages(content, created_at, room, author, parent) VALUES (?, ?, ?, ?, ?)"
+	result, err := db.conn.ExecContext(ctx, stmt, m.Content, m.CreatedAt, m.Room, m.Author, parent)
+	if err != nil {
+		return errs.Errorf("%v: cannot create message '%#v': %v", errDBInternal, m, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errs.Errorf("%v: cannot get ID of message '%#v': %v", errDBInternal, m, err)
+	}
+	m.ID = int(id)
+	return nil
+}
+
+// getMessage returns the message with given ID.
+func (db *db) getMessage(ctx context.Context, id int) (*Message, error) {
+	stmt := "SELECT " + messageColumns + " FROM messages WHERE id = ?"
+	m, err := scanMessage(db.conn.QueryRowContext(ctx, stmt, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errs.Errorf("%v: getMessage %d: %v", errDBNotFound, id, err)
+		}
+		return nil, errs.New(errDBInternal, err)
+	}
+	return m, nil
+}
+
+// editMessage replaces the content of m, records its prior content in
+// the message's edit history and updates m. Deleted messages cannot be
+// edited.
+func (db *db) editMessage(ctx context.Context, m *Message, content, editedAt string) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt := `INSERT INTO message_edits(message, content, replaced_at)
+SELECT id, content, ? FROM messages WHERE id = ? AND deleted_at = ''`
+	result, err := tx.ExecContext(ctx, stmt, editedAt, m.ID)
+	if err != nil {
+		return errs.Errorf("%v: cannot record edit of message %d: %v", errDBInternal, m.ID, err)
+	}
+	if cnt, err := result.RowsAffected(); err != nil || cnt == 0 {
+		return errs.Errorf("%v: cannot edit message %d", errDBNotFound, m.ID)
+	}
+	stmt = "UPDATE messages SET content = ?, edited_at = ? WHERE id = ?"
+	if _, err := tx.ExecContext(ctx, stmt, content, editedAt, m.ID); err != nil {
+		return errs.Errorf("%v: cannot edit message %d: %v", errDBInternal, m.ID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit edit of message %d: %v", errDBInternal, m.ID, err)
+	}
+	m.Content = content
+	m.EditedAt = editedAt
+	return nil
+}
+
+// deleteMessage turns m into a tombstone deleted by user deletedBy:
+// its content, edit history and reactions are removed, its ID is kept.
+// m is updated.
+func (db *db) deleteMessage(ctx context.Context, m *Message, deletedBy, deletedAt string) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt := `UPDATE messages SET content = '', edited_at = '', deleted_at = ?, deleted_by = ?
+WHERE id = ? AND deleted_at = ''`
+	result, err := tx.ExecContext(ctx, stmt, deletedAt, deletedBy, m.ID)
+	if err != nil {
+		return errs.Errorf("%v: cannot delete message %d: %v", errDBInternal, m.ID, err)
+	}
+	if cnt, err := result.RowsAffected(); err != nil || cnt == 0 {
+		return errs.Errorf("%v: cannot delete message %d", errDBNotFound, m.ID)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM message_edits WHERE message = ?", m.ID); err != nil {
+		return errs.Errorf("%v: cannot delete edits of message %d: %v", errDBInternal, m.ID, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reactions WHERE message = ?", m.ID); err != nil {
+		return errs.Errorf("%v: cannot delete reactions to message %d: %v", errDBInternal, m.ID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit deletion of message %d: %v", errDBInternal, m.ID, err)
+	}
+	m.Content = ""
+	m.EditedAt = ""
+	m.DeletedAt = deletedAt
+	m.DeletedBy = deletedBy
+	return nil
+}
+
+// queryMessageEdits returns the prior versions of message id, oldest
+// first.
+func (db *db) queryMessageEdits(ctx context.Context, id int) ([]*MessageEdit, error) {
+	stmt := "SELECT content, replaced_at FROM message_edits WHERE message = ? ORDER BY id"
+	rows, err := db.conn.QueryContext(ctx, stmt, id)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query edits of message %d: %v", errDBInternal, id, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	edits := []*MessageEdit{}
+	for rows.Next() {
+		e := &MessageEdit{}
+		if err := rows.Scan(&e.Content, &e.ReplacedAt); err != nil {
+			return nil, errs.Errorf("%v: cannot scan message edit: %v", errDBInternal, err)
+		}
+		edits = append(edits, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate edits of message %d: %v", errDBInternal, id, err)
+	}
+	return edits, nil
+}
+
+// addReaction adds the reaction emoji of user name to message id. It
+// reports whether the reaction was added, false if it existed already.
+func (db *db) addReaction(ctx context.Context, id int, name, emoji, createdAt string) (bool, error) {
+	stmt := "INSERT OR IGNORE INTO reactions(message, name, emoji, created_at) VALUES (?, ?, ?, ?)"
+	result, err := db.conn.ExecContext(ctx, stmt, id, name, emoji, createdAt)
+	if err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return false, errs.Errorf("%v: cannot add reaction to message %d: %v", errDBNotFound, id, err)
+		}
+		return false, errs.Errorf("%v: cannot add reaction to message %d: %v", errDBInternal, id, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return false, errs.Errorf("%v: cannot confirm reaction to message %d: %v", errDBInternal, id, err)
+	}
+	return cnt == 1, nil
+}
+
+// removeReaction removes the reaction emoji of user name from message
+// id. It reports whether the reaction was removed, false if there was
+// none.
+func (db *db) removeReaction(ctx context.Context, id int, name, emoji string) (bool, error) {
+	stmt := "DELETE FROM reactions WHERE message = ? AND name = ? AND emoji = ?"
+	result, err := db.conn.ExecContext(ctx, stmt, id, name, emoji)
+	if err != nil {
+		return false, errs.Errorf("%v: cannot remove reaction from message %d: %v", errDBInternal, id, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return false, errs.Errorf("%v: cannot confirm reaction removal from message %d: %v", errDBInternal, id, err)
+	}
+	return cnt == 1, nil
+}
+
+// countReactions returns the number of reactions emoji to message id.
+func (db *db) countReactions(ctx context.Context, id int, emoji string) (int, error) {
+	stmt := "SELECT COUNT(*) FROM reactions WHERE message = ? AND emoji = ?"
+	cnt := 0
+	if err := db.conn.QueryRowContext(ctx, stmt, id, emoji).Scan(&cnt); err != nil {
+		return 0, errs.Errorf("%v: cannot count reactions to message %d: %v", errDBInternal, id, err)
+	}
+	return cnt, nil
+}
+
+// setReactions sets the aggregated reactions of messages, in order of
+// their first use per message. Reactions of user viewer are flagged, if
+// not empty.
+func (db *db) setReactions(ctx context.Context, messages []*Message, viewer string) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Message, len(messages))
+	args := []interface{}{viewer}
+	for _, m := range messages {
+		byID[m.ID] = m
+		args = append(args, m.ID)
+	}
+	stmt := `SELECT message, emoji, COUNT(*), MAX(name = ?) FROM reactions
+WHERE message IN (?` + strings.Repeat(", ?", len(messages)-1) + `)
+GROUP BY message, emoji ORDER BY message, MIN(rowid)`
+	rows, err := db.conn.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return errs.Errorf("%v: cannot query reactions: %v", errDBInternal, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	for rows.Next() {
+		id := 0
+		r := Reaction{}
+		if err := rows.Scan(&id, &r.Emoji, &r.Count, &r.Me); err != nil {
+			return errs.Errorf("%v: cannot scan reaction: %v", errDBInternal, err)
+		}
+		byID[id].Reactions = append(byID[id].Reactions, r)
+	}
+	if err := rows.Err(); err != nil {
+		return errs.Errorf("%v: cannot iterate reactions: %v", errDBInternal, err)
+	}
+	return nil
+}
+
+// setThreadStats sets the reply count and time of the latest reply of
+// messages with thread replies. Deleted replies are not counted.
+func (db *db) setThreadStats(ctx context.Context, messages []*Message) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Message, len(messages))
+	args := make([]interface{}, 0, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+		args = append(args, m.ID)
+	}
+	stmt := `SELECT parent, COUNT(*), MAX(created_at) FROM messages
+WHERE deleted_at = '' AND parent IN (?` + strings.Repeat(", ?", len(messages)-1) + `)
+GROUP BY parent`
+	rows, err := db.conn.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return errs.Errorf("%v: cannot query thread stats: %v", errDBInternal, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	for rows.Next() {
+		id, cnt, last := 0, 0, ""
+		if err := rows.Scan(&id, &cnt, &last); err != nil {
+			return errs.Errorf("%v: cannot scan thread stats: %v", errDBInternal, err)
+		}
+		byID[id].ReplyCount = cnt
+		byID[id].LastReplyAt = last
+	}
+	if err := rows.Err(); err != nil {
+		return errs.Errorf("%v: cannot iterate thread stats: %v", errDBInternal, err)
+	}
+	return nil
+}
+
+// createLoginFailure records a failed login attempt for auditing.
+func (db *db) createLoginFailure(ctx context.Context, name, ip, createdAt string) error {
+	stmt := "INSERT INTO login_failures(name, ip, created_at) VALUES (?, ?, ?)"
+	if _, err := db.conn.ExecContext(ctx, stmt, name, ip, createdAt); err != nil {
+		return errs.Errorf("%v: cannot create login failure for '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// queryLoginFailures returns the failed login attempts recorded for
+// user name, oldest first.
+func (db *db) queryLoginFailures(ctx context.Context, name string) ([]loginFailure, error) {
+	stmt := "SELECT ip, created_at FROM login_failures WHERE name = ? ORDER BY id"
+	rows, err := db.conn.QueryContext(ctx, stmt, name)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query login failures of '%s': %v", errDBInternal, name, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	failures := []loginFailure{}
+	for rows.Next() {
+		f := loginFailure{}
+		if err := rows.Scan(&f.IP, &f.CreatedAt); err != nil {
+			return nil, errs.Errorf("%v: cannot scan login failure: %v", errDBInternal, err)
+		}
+		failures = append(failures, f)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate login failures: %v", errDBInternal, err)
+	}
+	return failures, nil
+}
+
+func (db *db) getTOTP(ctx context.Context, name string) (*totpSecret, error) {
+	t := totpSecret{}
+	stmt := "SELECT secret, confirmed, last_step FROM totp WHERE name = ?"
+	err := db.conn.QueryRowContext(ctx, stmt, name).Scan(&t.secret, &t.confirmed, &t.lastStep)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errs.Errorf("%s: getTOTP '%s': %v", errDBNotFound, name, err)
+		}
+		return nil, errs.New(errDBInternal, err)
+	}
+	return &t, nil
+}
+
+// createTOTP stores a new unconfirmed TOTP secret for user name,
+// replacing any existing one.
+func (db *db) createTOTP(ctx context.Context, name, secret string) error {
+	stmt := "INSERT OR REPLACE INTO totp(name, secret, confirmed, last_step) VALUES (?, ?, 0, 0)"
+	if _, err := db.conn.ExecContext(ctx, stmt, name, secret); err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return errs.Errorf("%v: cannot create TOTP for user '%s': %v", errDBNotFound, name, err)
+		}
+		return errs.Errorf("%v: cannot create TOTP for user '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// confirmTOTP marks the TOTP secret of user name as confirmed, sets the
+// last used time step and replaces all recovery codes with the given
+// hashes.
+func (db *db) confirmTOTP(ctx context.Context, name string, step int64, codeHashes []string) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	stmt := "UPDATE totp SET confirmed = 1, last_step = ? WHERE name = ?"
+	result, err := tx.ExecContext(ctx, stmt, step, name)
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm TOTP for user '%s': %v", errDBInternal, name, err)
+	}
+	if cnt, err := result.RowsAffected(); err != nil || cnt == 0 {
+		return errs.Errorf("%v: cannot confirm TOTP for user '%s'", errDBNotFound, name)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE name = ?", name); err != nil {
+		return errs.Errorf("%v: cannot delete recovery codes for user '%s': %v", errDBInternal, name, err)
+	}
+	stmt = "INSERT INTO recovery_codes(name, code_hash) VALUES (?, ?)"
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, stmt, name, hash); err != nil {
+			return errs.Errorf("%v: cannot create recovery code for user '%s': %v", errDBInternal, name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit TOTP confirmation for user '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// updateTOTPStep sets the last used TOTP time step of user name. It
+// returns an errDBNotFound error if step is not after the last used
+// one.
+func (db *db) updateTOTPStep(ctx context.Context, name string, step int64) error {
+	stmt := "UPDATE totp SET last_step = ? WHERE name = ? AND last_step < ?"
+	result, err := db.conn.ExecContext(ctx, stmt, step, name, step)
+	if err != nil {
+		return errs.Errorf("%v: cannot update TOTP step for user '%s': %v", errDBInternal, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm TOTP step update for user '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: TOTP step %d for user '%s'", errDBNotFound, step, name)
+	}
+	return nil
+}
+
+// deleteTOTP removes the TOTP secret and recovery codes of user name.
+func (db *db) deleteTOTP(ctx context.Context, name string) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for _, stmt := range []string{
+		"DELETE FROM totp WHERE name = ?",
+		"DELETE FROM recovery_codes WHERE name = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, stmt, name); err != nil {
+			return errs.Errorf("%v: cannot delete TOTP for user '%s': %v", errDBInternal, name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit TOTP deletion for user '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// deleteRecoveryCode removes the recovery code with given hash for user
+// name. It returns an errDBNotFound error if there is no such code.
+func (db *db) deleteRecoveryCode(ctx context.Context, name, codeHash string) error {
+	stmt := "DELETE FROM recovery_codes WHERE name = ? AND code_hash = ?"
+	result, err := db.conn.ExecContext(ctx, stmt, name, codeHash)
+	if err != nil {
+		return errs.Errorf("%v: cannot delete recovery code for user '%s': %v", errDBInternal, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm recovery code deletion for user '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: recovery code for user '%s'", errDBNotFound, name)
+	}
+	return nil
+}
+
+// createChallenge stores the hash of a second factor login challenge
+// for user name, valid until expiresAt in unix epoche seconds. Expired
+// challenges of all users are removed.
+func (db *db) createChallenge(ctx context.Context, challengeHash, name string, expiresAt int64) error {
+	stmt := "DELETE FROM login_challenges WHERE expires_at <= ?"
+	if _, err := db.conn.ExecContext(ctx, stmt, time.Now().Unix()); err != nil {
+		return errs.Errorf("%v: cannot delete expired login challenges: %v", errDBInternal, err)
+	}
+	stmt = "INSERT INTO login_challenges(challenge_hash, name, expires_at) VALUES (?, ?, ?)"
+	if _, err := db.conn.ExecContext(ctx, stmt, challengeHash, name, expiresAt); err != nil {
+		return errs.Errorf("%v: cannot create login challenge for user '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// getChallenge returns the user name of the login challenge with given
+// hash if it has not expired by now in unix epoche seconds.
+func (db *db) getChallenge(ctx context.Context, challengeHash string, now int64) (string, error) {
+	name := ""
+	stmt := "SELECT name FROM login_challenges WHERE challenge_hash = ? AND expires_at > ?"
+	if err := db.conn.QueryRowContext(ctx, stmt, challengeHash, now).Scan(&name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errs.Errorf("%s: getChallenge: %v", errDBNotFound, err)
+		}
+		return "", errs.New(errDBInternal, err)
+	}
+	return name, nil
+}
+
+// failChallenge records a failed attempt for the login challenge with
+// given hash and removes it after maxAttempts failures.
+func (db *db) failChallenge(ctx context.Context, challengeHash string, maxAttempts int) error {
+	stmt := "UPDATE login_challenges SET attempts = attempts + 1 WHERE challenge_hash = ?"
+	if _, err := db.conn.ExecContext(ctx, stmt, challengeHash); err != nil {
+		return errs.Errorf("%v: cannot update login challenge: %v", errDBInternal, err)
+	}
+	stmt = "DELETE FROM login_challenges WHERE challenge_hash = ? AND attempts >= ?"
+	if _, err := db.conn.ExecContext(ctx, stmt, challengeHash, maxAttempts); err != nil {
+		return errs.Errorf("%v: cannot delete login challenge: %v", errDBInternal, err)
+	}
+	return nil
+}
+
+func (db *db) deleteChallenge(ctx context.Context, challengeHash string) error {
+	stmt := "DELETE FROM login_challenges WHERE challenge_hash = ?"
+	if _, err := db.conn.ExecContext(ctx, stmt, challengeHash); err != nil {
+		return errs.Errorf("%v: cannot delete login challenge: %v", errDBInternal, err)
+	}
+	return nil
+}
+
+// createOIDCLogin stores nonce, PKCE code verifier and link target of
+// OIDC login l by the hash of its state, valid until expiresAt in unix
+// epoche seconds. Expired logins are removed.
+func (db *db) createOIDCLogin(ctx context.Context, stateHash string, l *oidcLogin, expiresAt int64) error {
+	stmt := "DELETE FROM oidc_logins WHERE expires_at <= ?"
+	if _, err := db.conn.ExecContext(ctx, stmt, time.Now().Unix()); err != nil {
+		return errs.Errorf("%v: cannot delete expired OIDC logins: %v", errDBInternal, err)
+	}
+	stmt = "INSERT INTO oidc_logins(state_hash, nonce, verifier, link_name, expires_at) VALUES (?, ?, ?, ?, ?)"
+	if _, err := db.conn.ExecContext(ctx, stmt, stateHash, l.nonce, l.verifier, l.linkName, expiresAt); err != nil {
+		return errs.Errorf("%v: cannot create OIDC login: %v", errDBInternal, err)
+	}
+	return nil
+}
+
+// deleteOIDCLogin removes and returns the OIDC login with given state
+// hash if it has not expired by now in unix epoche seconds.
+func (db *db) deleteOIDCLogin(ctx context.Context, stateHash string, now int64) (*oidcLogin, error) {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	l := &oidcLogin{}
+	stmt := "SELECT nonce, verifier, link_name FROM oidc_logins WHERE state_hash = ? AND expires_at > ?"
+	if err := tx.QueryRowContext(ctx, stmt, stateHash, now).Scan(&l.nonce, &l.verifier, &l.linkName); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errs.Errorf("%s: deleteOIDCLogin: %v", errDBNotFound, err)
+		}
+		return nil, errs.New(errDBInternal, err)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM oidc_logins WHERE state_hash = ?", stateHash); err != nil {
+		return nil, errs.Errorf("%v: cannot delete OIDC login: %v", errDBInternal, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, errs.Errorf("%v: cannot commit OIDC login deletion: %v", errDBInternal, err)
+	}
+	return l, nil
+}
+
+// getOIDCIdentity returns the name of the user linked to the IdP
+// identity given by issuer and subject.
+func (db *db) getOIDCIdentity(ctx context.Context, issuer, subject string) (string, error) {
+	name := ""
+	stmt := "SELECT name FROM oidc_identities WHERE issuer = ? AND subject = ?"
+	if err := db.conn.QueryRowContext(ctx, stmt, issuer, subject).Scan(&name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errs.Errorf("%s: getOIDCIdentity '%s': %v", errDBNotFound, subject, err)
+		}
+		return "", errs.New(errDBInternal, err)
+	}
+	return name, nil
+}
+
+// createOIDCIdentity links the IdP identity given by issuer and subject
+// to user name.
+func (db *db) createOIDCIdentity(ctx context.Context, issuer, subject, name string) error {
+	stmt := "INSERT INTO oidc_identities(issuer, subject, name) VALUES (?, ?, ?)"
+	if _, err := db.conn.ExecContext(ctx, stmt, issuer, subject, name); err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return errs.Errorf("%v: cannot link OIDC identity to user '%s': %v", errDBNotFound, name, err)
+		}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			return errs.Errorf("%v: OIDC identity '%s': %v", errDBDuplicate, subject, err)
+		}
+		return errs.Errorf("%v: cannot link OIDC identity to user '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// createAccessToken stores the personal access token t with given hash
+// for user name and sets its ID.
+func (db *db) createAccessToken(ctx context.Context, name, tokenHash string, t *AccessToken) error {
+	stmt := "INSERT INTO access_tokens(name, token_name, token_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?)"
+	scopes := strings.Join(t.Scopes, " ")
+	result, err := db.conn.ExecContext(ctx, stmt, name, t.Name, tokenHash, scopes, t.CreatedAt)
+	if err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return errs.Errorf("%v: cannot create access token for user '%s': %v", errDBNotFound, name, err)
+		}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique {
+			return errs.Errorf("%v: access token '%s': %v", errDBDuplicate, t.Name, err)
+		}
+		return errs.Errorf("%v: cannot create access token for user '%s': %v", errDBInternal, name, err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return errs.Errorf("%v: cannot get access token ID: %v", errDBInternal, err)
+	}
+	t.ID = int(id)
+	return nil
+}
+
+// useAccessToken sets the last used time of the personal access token
+// with given hash and returns the name of its user and its scopes.
+func (db *db) useAccessToken(ctx context.Context, tokenHash, usedAt string) (string, []string, error) {
+	stmt := "UPDATE access_tokens SET last_used_at = ? WHERE token_hash = ?"
+	if _, err := db.conn.ExecContext(ctx, stmt, usedAt, tokenHash); err != nil {
+		return "", nil, errs.Errorf("%v: cannot update access token: %v", errDBInternal, err)
+	}
+	name, scopes := "", ""
+	stmt = "SELECT name, scopes FROM access_tokens WHERE token_hash = ?"
+	if err := db.conn.QueryRowContext(ctx, stmt, tokenHash).Scan(&name, &scopes); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil, errs.Errorf("%s: useAccessToken: %v", errDBNotFound, err)
+		}
+		return "", nil, errs.New(errDBInternal, err)
+	}
+	return name, strings.Fields(scopes), nil
+}
+
+// queryAccessTokens returns the personal access tokens of user name
+// ordered by creation.
+func (db *db) queryAccessTokens(ctx context.Context, name string) ([]*AccessToken, error) {
+	stmt := `SELECT id, token_name, scopes, created_at, last_used_at FROM access_tokens
+WHERE name = ? ORDER BY id`
+	rows, err := db.conn.QueryContext(ctx, stmt, name)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query access tokens: %v", errDBInternal, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	tokens := []*AccessToken{}
+	for rows.Next() {
+		t := &AccessToken{}
+		scopes := ""
+		lastUsed := sql.NullString{}
+		if err := rows.Scan(&t.ID, &t.Name, &scopes, &t.CreatedAt, &lastUsed); err != nil {
+			return nil, errs.Errorf("%v: cannot scan access token: %v", errDBInternal, err)
+		}
+		t.Scopes = strings.Fields(scopes)
+		t.LastUsedAt = lastUsed.String
+		tokens = append(tokens, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate access tokens: %v", errDBInternal, err)
+	}
+	return tokens, nil
+}
+
+// deleteAccessToken revokes the personal access token with given ID of
+// user name.
+func (db *db) deleteAccessToken(ctx context.Context, name string, id int) error {
+	stmt := "DELETE FROM access_tokens WHERE name = ? AND id = ?"
+	result, err := db.conn.ExecContext(ctx, stmt, name, id)
+	if err != nil {
+		return errs.Errorf("%v: cannot delete access token %d: %v", errDBInternal, id, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm deletion of access token %d: %v", errDBInternal, id, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot delete access token %d of user '%s'", errDBNotFound, id, name)
+	}
+	return nil
+}
+
+// isAdmin reports whether user name has been granted the global admin
+// role.
+func (db *db) isAdmin(ctx context.Context, name string) (bool, error) {
+	cnt := 0
+	if err := db.conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM admins WHERE name = ?", name).Scan(&cnt); err != nil {
+		return false, errs.Errorf("%v: cannot query admin role of '%s': %v", errDBInternal, name, err)
+	}
+	return cnt != 0, nil
+}
+
+func (db *db) getRoomRole(ctx context.Context, room, name string) (string, error) {
+	r := ""
+	stmt := "SELECT role FROM room_members WHERE room = ? AND name = ?"
+	if err := db.conn.QueryRowContext(ctx, stmt, room, name).Scan(&r); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errs.Errorf("%s: getRoomRole '%s' in '%s': %v", errDBNotFound, name, room, err)
+		}
+		return "", errs.New(errDBInternal, err)
+	}
+	return r, nil
+}
+
+// queryRoles returns the global and room roles of user name, ordered by
+// room. Conversation participation is not a role and not returned.
+func (db *db) queryRoles(ctx context.Context, name string) ([]Role, error) {
+	stmt := `SELECT 'admin', '' FROM admins WHERE name = ?
+UNION ALL SELECT m.role, m.room FROM room_members m JOIN rooms r ON r.name = m.room
+WHERE m.name = ? AND NOT r.conversation ORDER BY 2`
+	rows, err := db.conn.QueryContext(ctx, stmt, name, name)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query roles of '%s': %v", errDBInternal, name, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	roles := []Role{}
+	for rows.Next() {
+		r := Role{}
+		if err := rows.Scan(&r.Role, &r.Room); err != nil {
+			return nil, errs.Errorf("%v: cannot scan role: %v", errDBInternal, err)
+		}
+		roles = append(roles, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate roles: %v", errDBInternal, err)
+	}
+	return roles, nil
+}
+
+// grantRole grants r to user name, replacing a previous role in the
+// same room. Users granted a room role become members of the room.
+func (db *db) grantRole(ctx context.Context, name string, r Role) error {
+	stmt, args := "INSERT OR IGNORE INTO admins(name) VALUES (?)", []interface{}{name}
+	if r.Room != "" {
+		stmt = `INSERT INTO room_members(room, name, role) VALUES (?, ?, ?)
+ON CONFLICT(room, name) DO UPDATE SET role = excluded.role`
+		args = []interface{}{r.Room, name, r.Role}
+	}
+	if _, err := db.conn.ExecContext(ctx, stmt, args...); err != nil {
+		sqliteErr := &sqlite3.Error{}
+		if errors.As(err, sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintForeignKey {
+			return errs.Errorf("%v: cannot grant %s role to '%s': %v", errDBNotFound, r.Role, name, err)
+		}
+		return errs.Errorf("%v: cannot grant %s role to '%s': %v", errDBInternal, r.Role, name, err)
+	}
+	return nil
+}
+
+// revokeRole revokes r from user name. It returns an errDBNotFound
+// error if the user does not have the role. Revoking the member role
+// removes the user from the room, revoking a higher room role leaves
+// them a member.
+func (db *db) revokeRole(ctx context.Context, name string, r Role) error {
+	stmt, args := "DELETE FROM admins WHERE name = ?", []interface{}{name}
+	switch {
+	case r.Room != "" && r.Role == roleMember.String():
+		stmt = "DELETE FROM room_members WHERE room = ? AND name = ? AND role = ?"
+		args = []interface{}{r.Room, name, r.Role}
+	case r.Room != "":
+		stmt = "UPDATE room_members SET role = ? WHERE room = ? AND name = ? AND role = ?"
+		args = []interface{}{roleMember.String(), r.Room, name, r.Role}
+	}
+	result, err := db.conn.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return errs.Errorf("%v: cannot revoke %s role from '%s': %v", errDBInternal, r.Role, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm revocation of %s role from '%s': %v", errDBInternal, r.Role, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot revoke %s role from '%s'", errDBNotFound, r.Role, name)
+	}
+	return nil
+}
+
+// updateProfile changes the non-nil profile fields of user name.
+func (db *db) updateProfile(ctx context.Context, name string, p profileUpdate) error {
+	var sets []string
+	var args []interface{}
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{
+		{"display_name", p.DisplayName},
+		{"bio", p.Bio},
+		{"status", p.Status},
+		{"timezone", p.Timezone},
+	} {
+		if f.value != nil {
+			sets = append(sets, f.column+" = ?")
+			args = append(args, *f.value)
+		}
+	}
+	if len(sets) == 0 {
+		_, err := db.getUser(ctx, name)
+		return err
+	}
+	stmt := "UPDATE users SET " + strings.Join(sets, ", ") + " WHERE name = ?"
+	result, err := db.conn.ExecContext(ctx, stmt, append(args, name)...)
+	if err != nil {
+		return errs.Errorf("%v: cannot update profile of '%s': %v", errDBInternal, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm profile update of '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot update profile of '%s'", errDBNotFound, name)
+	}
+	return nil
+}
+
+// setAvatar sets the avatar images of user name, nil removes them. The
+// avatarSize image is stored with the user, all others as thumbnails.
+func (db *db) setAvatar(ctx context.Context, name string, images avatarImages) error {
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return errs.Errorf("%v: cannot begin transaction: %v", errDBInternal, err)
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	result, err := tx.ExecContext(ctx, "UPDATE users SET avatar = ? WHERE name = ?", images[avatarSize], name)
+	if err != nil {
+		return errs.Errorf("%v: cannot set avatar of '%s': %v", errDBInternal, name, err)
+	}
+	cnt, err := result.RowsAffected()
+	if err != nil {
+		return errs.Errorf("%v: cannot confirm avatar update of '%s': %v", errDBInternal, name, err)
+	}
+	if cnt == 0 {
+		return errs.Errorf("%v: cannot set avatar of '%s'", errDBNotFound, name)
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM avatar_thumbnails WHERE name = ?", name); err != nil {
+		return errs.Errorf("%v: cannot delete avatar thumbnails of '%s': %v", errDBInternal, name, err)
+	}
+	stmt := "INSERT INTO avatar_thumbnails(name, size, image) VALUES (?, ?, ?)"
+	for size, image := range images {
+		if size == avatarSize {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, stmt, name, size, image); err != nil {
+			return errs.Errorf("%v: cannot set avatar thumbnail of '%s': %v", errDBInternal, name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errs.Errorf("%v: cannot commit avatar update of '%s': %v", errDBInternal, name, err)
+	}
+	return nil
+}
+
+// getAvatar returns the uploaded avatar image of user name at size, or
+// nil if there is none.
+func (db *db) getAvatar(ctx context.Context, name string, size int) ([]byte, error) {
+	stmt := "SELECT avatar FROM users WHERE name = ?"
+	args := []interface{}{name}
+	if size != avatarSize {
+		stmt = `SELECT t.image FROM users u
+			LEFT JOIN avatar_thumbnails t ON t.name = u.name AND t.size = ?
+			WHERE u.name = ?`
+		args = []interface{}{size, name}
+	}
+	var avatar []byte
+	err := db.conn.QueryRowContext(ctx, stmt, args...).Scan(&avatar)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errs.Errorf("%v: getAvatar '%s': %v", errDBNotFound, name, err)
+		}
+		return nil, errs.New(errDBInternal, err)
+	}
+	return avatar, nil
+}
+
+// queryUsers returns up to limit users ordered by name whose name or
+// display name starts with prefix, case-insensitively. The deletedUser
+// tombstone is not included.
+func (db *db) queryUsers(ctx context.Context, prefix string, limit int) ([]*User, error) {
+	stmt := `SELECT name, display_name, bio, status, timezone FROM users
+WHERE (substr(name_key, 1, length(?1)) = ?1 OR lower(substr(display_name, 1, length(?2))) = lower(?2))
+AND name <> ?4 ORDER BY name LIMIT ?3`
+	rows, err := db.conn.QueryContext(ctx, stmt, nameKey(prefix), prefix, limit, deletedUser)
+	if err != nil {
+		return nil, errs.Errorf("%v: cannot query users with prefix '%s': %v", errDBInternal, prefix, err)
+	}
+	defer rows.Close() //nolint:errcheck
+	users := []*User{}
+	for rows.Next() {
+		u := &User{}
+		if err := rows.Scan(&u.Name, &u.DisplayName, &u.Bio, &u.Status, &u.Timezone); err != nil {
+			return nil, errs.Errorf("%v: cannot scan user: %v", errDBInternal, err)
+		}
+		u.AvatarURL = avatarURL(u.Name)
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errs.Errorf("%v: cannot iterate users: %v", errDBInternal, err)
+	}
+	return users, nil
+}
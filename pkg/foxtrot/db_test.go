@@ -2,6 +2,7 @@ package foxtrot
 
 import (
 	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -50,7 +51,7 @@ func TestCreateGetDeleteUser(t *testing.T) {
 	db := mustDB()
 	defer db.close()
 
-	u := &User{Name: "alice", passwordHash: "###"}
+	u := &User{Name: "alice", passwordHash: "###", AvatarURL: "/api/user/alice/avatar"}
 	err := db.createUser(context.Background(), u)
 	require.NoError(t, err)
 
@@ -58,7 +59,7 @@ func TestCreateGetDeleteUser(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, u, u2)
 
-	err = db.deleteUser(context.Background(), "alice")
+	err = db.deleteUser(context.Background(), "alice", false)
 	require.NoError(t, err)
 
 	_, err = db.getUser(context.Background(), "alice")
@@ -90,7 +91,7 @@ func TestDeleteUserErr(t *testing.T) {
 	db := mustDB()
 	defer db.close()
 
-	err := db.deleteUser(context.Background(), "MISSING")
+	err := db.deleteUser(context.Background(), "MISSING", false)
 	require.Error(t, err)
 	requireErrIs(t, err, errDBNotFound)
 }
@@ -124,6 +125,214 @@ func TestCreateRoomErr(t *testing.T) {
 	require.Error(t, err) // room name cannot be empty
 }
 
+func TestCreateRoomOwner(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createRoom(ctx, &Room{Name: "kitchen", CreatedBy: "$Fox"}))
+	r, err := db.getRoomRole(ctx, "kitchen", "$Fox")
+	require.NoError(t, err)
+	require.Equal(t, "owner", r)
+	room, err := db.getRoom(ctx, "kitchen")
+	require.NoError(t, err)
+	require.Equal(t, "$Fox", room.CreatedBy)
+	err = db.createRoom(ctx, &Room{Name: "kitchen", CreatedBy: "$Cat"})
+	requireErrIs(t, err, errDBDuplicate)
+	_, err = db.getRoomRole(ctx, "kitchen", "$Cat")
+	requireErrIs(t, err, errDBNotFound)
+	err = db.createRoom(ctx, &Room{Name: "KITCHEN", CreatedBy: "$Cat"})
+	requireErrIs(t, err, errDBDuplicate)
+	err = db.createRoom(ctx, &Room{Name: "$kitchen"})
+	requireErrIs(t, err, errDBDuplicate) // sample data room $Kitchen
+}
+
+func TestQueryRooms(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createRoom(ctx, &Room{Name: "$Attic", CreatedBy: "$Fox"}))
+	require.NoError(t, db.createRoom(ctx, &Room{Name: "$Burrow", CreatedBy: "$Fox", Private: true}))
+	names := func(member, after string, limit int) []string {
+		t.Helper()
+		rooms, err := db.queryRooms(ctx, roomFilter{member: member, viewer: "$Cat"}, after, limit)
+		require.NoError(t, err)
+		names := []string{}
+		for _, r := range rooms {
+			names = append(names, r.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"$Attic", "$Kitchen", "$Shed"}, names("", "", 10))
+	require.Equal(t, []string{"$Attic", "$Kitchen"}, names("", "", 2))
+	require.Equal(t, []string{"$Shed"}, names("", "$Kitchen", 2))
+	require.Equal(t, []string{"$Attic"}, names("$Fox", "", 10)) // $Burrow is not visible to $Cat
+	require.Empty(t, names("$Cat", "", 10))
+
+	rooms, err := db.queryRooms(ctx, roomFilter{member: "$Fox", viewer: "$Fox"}, "", 10)
+	require.NoError(t, err)
+	require.Len(t, rooms, 2)
+	require.True(t, rooms[1].Private)
+	rooms, err = db.queryRooms(ctx, roomFilter{}, "", 10)
+	require.NoError(t, err)
+	require.Len(t, rooms, 4)
+}
+
+func TestJoinLeaveRoom(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.joinRoom(ctx, "$Kitchen", "$Cat", now()))
+	require.NoError(t, db.grantRole(ctx, "$Cat", Role{Role: "moderator", Room: "$Kitchen"}))
+	require.NoError(t, db.joinRoom(ctx, "$Kitchen", "$Cat", now())) // keeps role
+	r, err := db.getRoomRole(ctx, "$Kitchen", "$Cat")
+	require.NoError(t, err)
+	require.Equal(t, "moderator", r)
+	err = db.joinRoom(ctx, "$Cellar", "$Cat", now())
+	requireErrIs(t, err, errDBNotFound)
+
+	require.NoError(t, db.leaveRoom(ctx, "$Kitchen", "$Cat"))
+	err = db.leaveRoom(ctx, "$Kitchen", "$Cat")
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestInvites(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createRoom(ctx, &Room{Name: "$Burrow", CreatedBy: "$Fox", Private: true}))
+	inv := &Invite{Room: "$Burrow", CreatedBy: "$Fox", CreatedAt: "2021-01-01T00:00:00Z", MaxUses: 1}
+	require.NoError(t, db.createInvite(ctx, "hash1", 2000, inv))
+	require.Equal(t, "1970-01-01T00:33:20Z", inv.ExpiresAt)
+	unlimited := &Invite{Room: "$Burrow", CreatedBy: "$Fox", CreatedAt: "2021-01-01T00:00:00Z"}
+	require.NoError(t, db.createInvite(ctx, "hash2", 0, unlimited))
+	err := db.createInvite(ctx, "hash3", 0, &Invite{Room: "$Cellar", CreatedBy: "$Fox", CreatedAt: now()})
+	requireErrIs(t, err, errDBNotFound)
+
+	err = db.joinRoomWithInvite(ctx, "$Burrow", "$Cat", "hash1", now(), 2000) // expired
+	requireErrIs(t, err, errDBNotFound)
+	err = db.joinRoomWithInvite(ctx, "$Kitchen", "$Cat", "hash1", now(), 1000) // other room
+	requireErrIs(t, err, errDBNotFound)
+	require.NoError(t, db.joinRoomWithInvite(ctx, "$Burrow", "$Cat", "hash1", now(), 1000))
+	require.NoError(t, db.joinRoomWithInvite(ctx, "$Burrow", "$Cat", "hash2", now(), 1000)) // member already
+	err = db.joinRoomWithInvite(ctx, "$Burrow", "$Goat", "hash1", now(), 1000)              // used up
+	requireErrIs(t, err, errDBNotFound)
+	require.NoError(t, db.joinRoomWithInvite(ctx, "$Burrow", "$Goat", "hash2", now(), 1000))
+	r, err := db.getRoomRole(ctx, "$Burrow", "$Goat")
+	require.NoError(t, err)
+	require.Equal(t, "member", r)
+
+	invites, err := db.queryInvites(ctx, "$Burrow")
+	require.NoError(t, err)
+	require.Len(t, invites, 2)
+	require.Equal(t, 1, invites[0].Uses)
+	require.Equal(t, 1, invites[1].Uses)
+	require.Equal(t, "", invites[1].ExpiresAt)
+
+	require.NoError(t, db.deleteInvite(ctx, "$Burrow", unlimited.ID))
+	err = db.deleteInvite(ctx, "$Burrow", unlimited.ID)
+	requireErrIs(t, err, errDBNotFound)
+	err = db.joinRoomWithInvite(ctx, "$Burrow", "$Camel", "hash2", now(), 1000)
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestUpdateRoom(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	topic, icon := "Food", "🍳"
+	settings := RoomSettings{ReadOnly: true, SlowMode: 30}
+	require.NoError(t, db.updateRoom(ctx, "$Kitchen", roomUpdate{Topic: &topic, Icon: &icon, Settings: &settings}))
+	require.NoError(t, db.updateRoom(ctx, "$Kitchen", roomUpdate{}))
+	r, err := db.getRoom(ctx, "$Kitchen")
+	require.NoError(t, err)
+	require.Equal(t, &Room{Name: "$Kitchen", Topic: topic, Icon: icon, Settings: settings}, r)
+
+	require.NoError(t, db.grantRole(ctx, "$Fox", Role{Role: "owner", Room: "$Kitchen"}))
+	den := "$Den"
+	require.NoError(t, db.updateRoom(ctx, "$Kitchen", roomUpdate{Name: &den}))
+	_, err = db.getRoom(ctx, "$Kitchen")
+	requireErrIs(t, err, errDBNotFound)
+	messages, err := db.queryMessages(ctx, "$Den", -1, -1)
+	require.NoError(t, err)
+	require.Len(t, messages, 5)
+	require.Equal(t, "$Den", messages[0].Room)
+	role, err := db.getRoomRole(ctx, "$Den", "$Fox")
+	require.NoError(t, err)
+	require.Equal(t, "owner", role)
+
+	shed := "$Shed"
+	err = db.updateRoom(ctx, "$Den", roomUpdate{Name: &shed})
+	requireErrIs(t, err, errDBDuplicate)
+	shed = "$SHED"
+	err = db.updateRoom(ctx, "$Den", roomUpdate{Name: &shed})
+	requireErrIs(t, err, errDBDuplicate)
+	den = "$DEN"
+	require.NoError(t, db.updateRoom(ctx, "$Den", roomUpdate{Name: &den})) // change of case only
+	err = db.updateRoom(ctx, "MISSING", roomUpdate{Topic: &topic})
+	requireErrIs(t, err, errDBNotFound)
+	err = db.updateRoom(ctx, "MISSING", roomUpdate{})
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestDeleteRoom(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createRoom(ctx, &Room{Name: "$Attic", CreatedBy: "$Fox"}))
+	require.NoError(t, db.deleteRoom(ctx, "$Attic"))
+	_, err := db.getRoom(ctx, "$Attic")
+	requireErrIs(t, err, errDBNotFound)
+	err = db.deleteRoom(ctx, "$Attic")
+	requireErrIs(t, err, errDBNotFound)
+
+	require.NoError(t, db.grantRole(ctx, "$Cat", Role{Role: "member", Room: "$Kitchen"}))
+	inv := &Invite{Room: "$Kitchen", CreatedBy: "$Goat", CreatedAt: now()}
+	require.NoError(t, db.createInvite(ctx, "hash", 0, inv))
+	require.NoError(t, db.deleteRoom(ctx, "$Kitchen"))
+	messages, err := db.queryMessages(ctx, "$Kitchen", -1, -1)
+	require.NoError(t, err)
+	require.Empty(t, messages)
+	_, err = db.getRoomRole(ctx, "$Kitchen", "$Cat")
+	requireErrIs(t, err, errDBNotFound)
+	invites, err := db.queryInvites(ctx, "$Kitchen")
+	require.NoError(t, err)
+	require.Empty(t, invites)
+}
+
+func TestArchiveRoom(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.setRoomArchived(ctx, "$Kitchen", "2021-01-01T00:00:00Z"))
+	r, err := db.getRoom(ctx, "$Kitchen")
+	require.NoError(t, err)
+	require.Equal(t, "2021-01-01T00:00:00Z", r.ArchivedAt)
+	names := func(archived bool) []string {
+		t.Helper()
+		rooms, err := db.queryRooms(ctx, roomFilter{archived: archived}, "", 10)
+		require.NoError(t, err)
+		names := []string{}
+		for _, r := range rooms {
+			names = append(names, r.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"$Shed"}, names(false))
+	require.Equal(t, []string{"$Kitchen"}, names(true))
+
+	require.NoError(t, db.setRoomArchived(ctx, "$Kitchen", ""))
+	require.Equal(t, []string{"$Kitchen", "$Shed"}, names(false))
+	err = db.setRoomArchived(ctx, "MISSING", now())
+	requireErrIs(t, err, errDBNotFound)
+}
+
 func TestCreateQueryMessageSimple(t *testing.T) {
 	db := mustDB()
 	defer db.close()
@@ -234,3 +443,670 @@ func TestCreateMessageErr(t *testing.T) {
 	err = db.createMessage(ctx, &m)
 	require.Error(t, err)
 }
+
+func TestUpdatePassword(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	require.NoError(t, db.createPasswordReset(ctx, "alice", "abc", time.Now().Add(time.Hour).Unix()))
+
+	u, err := db.updatePassword(ctx, "alice", "***")
+	require.NoError(t, err)
+	require.Equal(t, &User{Name: "alice", passwordHash: "***", sessionGen: 1, AvatarURL: avatarURL("alice")}, u)
+
+	u2, err := db.getUser(ctx, "alice")
+	require.NoError(t, err)
+	require.Equal(t, u, u2)
+
+	err = db.deletePasswordReset(ctx, "alice", "abc", time.Now().Unix())
+	requireErrIs(t, err, errDBNotFound) // removed on password update
+
+	_, err = db.updatePassword(ctx, "MISSING", "***")
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestUpdatePasswordHash(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	require.NoError(t, db.updatePasswordHash(ctx, "alice", "###", "***"))
+	err := db.updatePasswordHash(ctx, "alice", "###", "+++")
+	requireErrIs(t, err, errDBNotFound) // concurrently changed
+
+	u, err := db.getUser(ctx, "alice")
+	require.NoError(t, err)
+	require.Equal(t, &User{Name: "alice", passwordHash: "***", AvatarURL: avatarURL("alice")}, u)
+}
+
+func TestPasswordReset(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	exp := time.Now().Add(time.Hour).Unix()
+	require.NoError(t, db.createPasswordReset(ctx, "alice", "abc", exp))
+
+	err := db.createPasswordReset(ctx, "MISSING", "def", exp)
+	requireErrIs(t, err, errDBNotFound)
+	err = db.createPasswordReset(ctx, "alice", "abc", exp)
+	require.Error(t, err) // duplicate
+
+	err = db.deletePasswordReset(ctx, "alice", "abc", exp)
+	requireErrIs(t, err, errDBNotFound) // expired
+	require.NoError(t, db.deletePasswordReset(ctx, "alice", "abc", exp-1))
+	err = db.deletePasswordReset(ctx, "alice", "abc", exp-1)
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestCreateUserCaseInsensitive(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	err := db.createUser(ctx, &User{Name: "ALICE", passwordHash: "###"})
+	requireErrIs(t, err, errDBDuplicate)
+	err = db.createUser(ctx, &User{Name: "$fox", passwordHash: "###"}) // sample data
+	requireErrIs(t, err, errDBDuplicate)
+}
+
+func TestTOTP(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	err := db.createTOTP(ctx, "MISSING", "ABC")
+	requireErrIs(t, err, errDBNotFound)
+	_, err = db.getTOTP(ctx, "alice")
+	requireErrIs(t, err, errDBNotFound)
+
+	require.NoError(t, db.createTOTP(ctx, "alice", "ABC"))
+	require.NoError(t, db.confirmTOTP(ctx, "alice", 5, []string{"h1", "h2"}))
+	got, err := db.getTOTP(ctx, "alice")
+	require.NoError(t, err)
+	require.Equal(t, &totpSecret{secret: "ABC", confirmed: true, lastStep: 5}, got)
+	err = db.confirmTOTP(ctx, "MISSING", 5, nil)
+	requireErrIs(t, err, errDBNotFound)
+
+	err = db.updateTOTPStep(ctx, "alice", 5)
+	requireErrIs(t, err, errDBNotFound)
+	require.NoError(t, db.updateTOTPStep(ctx, "alice", 6))
+
+	require.NoError(t, db.deleteRecoveryCode(ctx, "alice", "h1"))
+	err = db.deleteRecoveryCode(ctx, "alice", "h1")
+	requireErrIs(t, err, errDBNotFound)
+
+	require.NoError(t, db.deleteTOTP(ctx, "alice"))
+	_, err = db.getTOTP(ctx, "alice")
+	requireErrIs(t, err, errDBNotFound)
+	err = db.deleteRecoveryCode(ctx, "alice", "h2")
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestLoginChallenge(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	now := time.Now().Unix()
+	require.NoError(t, db.createChallenge(ctx, "abc", "alice", now+60))
+
+	name, err := db.getChallenge(ctx, "abc", now)
+	require.NoError(t, err)
+	require.Equal(t, "alice", name)
+	_, err = db.getChallenge(ctx, "abc", now+60)
+	requireErrIs(t, err, errDBNotFound) // expired
+
+	require.NoError(t, db.failChallenge(ctx, "abc", 2))
+	_, err = db.getChallenge(ctx, "abc", now)
+	require.NoError(t, err)
+	require.NoError(t, db.failChallenge(ctx, "abc", 2))
+	_, err = db.getChallenge(ctx, "abc", now)
+	requireErrIs(t, err, errDBNotFound)
+
+	require.NoError(t, db.createChallenge(ctx, "def", "alice", now+60))
+	require.NoError(t, db.deleteChallenge(ctx, "def"))
+	_, err = db.getChallenge(ctx, "def", now)
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestOIDCIdentity(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	_, err := db.getOIDCIdentity(ctx, "https://idp", "sub-1")
+	requireErrIs(t, err, errDBNotFound)
+	err = db.createOIDCIdentity(ctx, "https://idp", "sub-1", "MISSING")
+	requireErrIs(t, err, errDBNotFound)
+	require.NoError(t, db.createOIDCIdentity(ctx, "https://idp", "sub-1", "alice"))
+	err = db.createOIDCIdentity(ctx, "https://idp", "sub-1", "alice")
+	requireErrIs(t, err, errDBDuplicate)
+	name, err := db.getOIDCIdentity(ctx, "https://idp", "sub-1")
+	require.NoError(t, err)
+	require.Equal(t, "alice", name)
+
+	require.NoError(t, db.deleteUser(ctx, "alice", false))
+	_, err = db.getOIDCIdentity(ctx, "https://idp", "sub-1")
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestOIDCLoginState(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	now := time.Now().Unix()
+	l := &oidcLogin{nonce: "nonce", verifier: "verifier", linkName: "alice"}
+	require.NoError(t, db.createOIDCLogin(ctx, "abc", l, now+60))
+	_, err := db.deleteOIDCLogin(ctx, "abc", now+60)
+	requireErrIs(t, err, errDBNotFound) // expired
+	got, err := db.deleteOIDCLogin(ctx, "abc", now)
+	require.NoError(t, err)
+	require.Equal(t, l, got)
+	_, err = db.deleteOIDCLogin(ctx, "abc", now)
+	requireErrIs(t, err, errDBNotFound) // single use
+}
+
+func TestAccessTokens(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	tok := &AccessToken{Name: "bot", Scopes: []string{"a", "b"}, CreatedAt: "2020-10-25T07:55:50Z"}
+	require.NoError(t, db.createAccessToken(ctx, "alice", "hash", tok))
+	require.NotZero(t, tok.ID)
+	err := db.createAccessToken(ctx, "MISSING", "hash2", &AccessToken{Name: "bot", CreatedAt: tok.CreatedAt})
+	requireErrIs(t, err, errDBNotFound)
+
+	name, scopes, err := db.useAccessToken(ctx, "hash", "2020-10-26T07:55:50Z")
+	require.NoError(t, err)
+	require.Equal(t, "alice", name)
+	require.Equal(t, []string{"a", "b"}, scopes)
+	_, _, err = db.useAccessToken(ctx, "MISSING", "2020-10-26T07:55:50Z")
+	requireErrIs(t, err, errDBNotFound)
+
+	tokens, err := db.queryAccessTokens(ctx, "alice")
+	require.NoError(t, err)
+	want := &AccessToken{ID: tok.ID, Name: "bot", Scopes: []string{"a", "b"}, CreatedAt: tok.CreatedAt,
+		LastUsedAt: "2020-10-26T07:55:50Z"}
+	require.Equal(t, []*AccessToken{want}, tokens)
+
+	err = db.deleteAccessToken(ctx, "bob", tok.ID)
+	requireErrIs(t, err, errDBNotFound)
+	require.NoError(t, db.deleteAccessToken(ctx, "alice", tok.ID))
+	tokens, err = db.queryAccessTokens(ctx, "alice")
+	require.NoError(t, err)
+	require.Empty(t, tokens)
+}
+
+func TestRoles(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	require.NoError(t, db.grantRole(ctx, "alice", Role{Role: "admin"}))
+	require.NoError(t, db.grantRole(ctx, "alice", Role{Role: "admin"}))
+	require.NoError(t, db.grantRole(ctx, "alice", Role{Role: "member", Room: "$Shed"}))
+	require.NoError(t, db.grantRole(ctx, "alice", Role{Role: "owner", Room: "$Shed"})) // replaces member
+	require.NoError(t, db.grantRole(ctx, "alice", Role{Role: "moderator", Room: "$Kitchen"}))
+	err := db.grantRole(ctx, "alice", Role{Role: "member", Room: "$MISSING"})
+	requireErrIs(t, err, errDBNotFound)
+	err = db.grantRole(ctx, "MISSING", Role{Role: "admin"})
+	requireErrIs(t, err, errDBNotFound)
+
+	roles, err := db.queryRoles(ctx, "alice")
+	require.NoError(t, err)
+	want := []Role{{Role: "admin"}, {Role: "moderator", Room: "$Kitchen"}, {Role: "owner", Room: "$Shed"}}
+	require.Equal(t, want, roles)
+	admin, err := db.isAdmin(ctx, "alice")
+	require.NoError(t, err)
+	require.True(t, admin)
+	r, err := db.getRoomRole(ctx, "$Shed", "alice")
+	require.NoError(t, err)
+	require.Equal(t, "owner", r)
+
+	err = db.revokeRole(ctx, "alice", Role{Role: "member", Room: "$Shed"})
+	requireErrIs(t, err, errDBNotFound)
+	require.NoError(t, db.revokeRole(ctx, "alice", Role{Role: "owner", Room: "$Shed"}))
+	require.NoError(t, db.revokeRole(ctx, "alice", Role{Role: "admin"}))
+	err = db.revokeRole(ctx, "alice", Role{Role: "admin"})
+	requireErrIs(t, err, errDBNotFound)
+	r, err = db.getRoomRole(ctx, "$Shed", "alice") // still a member
+	require.NoError(t, err)
+	require.Equal(t, "member", r)
+	require.NoError(t, db.revokeRole(ctx, "alice", Role{Role: "member", Room: "$Shed"}))
+	_, err = db.getRoomRole(ctx, "$Shed", "alice")
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestUpdateProfile(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	name, bio := "Fantastic Mr. Fox", "Lives in a hole."
+	require.NoError(t, db.updateProfile(ctx, "$Fox", profileUpdate{DisplayName: &name, Bio: &bio}))
+	status := "hunting"
+	require.NoError(t, db.updateProfile(ctx, "$Fox", profileUpdate{Status: &status}))
+	require.NoError(t, db.updateProfile(ctx, "$Fox", profileUpdate{}))
+	u, err := db.getUser(ctx, "$Fox")
+	require.NoError(t, err)
+	require.Equal(t, name, u.DisplayName)
+	require.Equal(t, bio, u.Bio)
+	require.Equal(t, status, u.Status)
+	require.Equal(t, "/api/user/$Fox/avatar", u.AvatarURL)
+
+	err = db.updateProfile(ctx, "MISSING", profileUpdate{Status: &status})
+	requireErrIs(t, err, errDBNotFound)
+	err = db.updateProfile(ctx, "MISSING", profileUpdate{})
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestQueryUsers(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	name := "Fantastic Mr. Fox"
+	require.NoError(t, db.updateProfile(ctx, "$Cat", profileUpdate{DisplayName: &name}))
+	names := func(prefix string, limit int) []string {
+		t.Helper()
+		users, err := db.queryUsers(ctx, prefix, limit)
+		require.NoError(t, err)
+		var names []string
+		for _, u := range users {
+			names = append(names, u.Name)
+		}
+		return names
+	}
+	require.Equal(t, []string{"$Camel", "$Cat"}, names("$CA", 10))
+	require.Equal(t, []string{"$Camel"}, names("$ca", 1))
+	require.Equal(t, []string{"$Cat"}, names("fan", 10))
+	require.Len(t, names("", 10), 4)
+	require.Empty(t, names("%", 10))
+}
+
+func TestAvatar(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	avatar, err := db.getAvatar(ctx, "$Fox", avatarSize)
+	require.NoError(t, err)
+	require.Nil(t, avatar)
+	require.NoError(t, db.setAvatar(ctx, "$Fox", avatarImages{32: {1}, avatarSize: {1, 2, 3}}))
+	avatar, err = db.getAvatar(ctx, "$Fox", avatarSize)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 2, 3}, avatar)
+	avatar, err = db.getAvatar(ctx, "$Fox", 32)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1}, avatar)
+	avatar, err = db.getAvatar(ctx, "$Fox", 64)
+	require.NoError(t, err)
+	require.Nil(t, avatar)
+
+	require.NoError(t, db.setAvatar(ctx, "$Fox", nil))
+	for _, size := range []int{32, avatarSize} {
+		avatar, err = db.getAvatar(ctx, "$Fox", size)
+		require.NoError(t, err)
+		require.Nil(t, avatar)
+	}
+	err = db.setAvatar(ctx, "MISSING", avatarImages{avatarSize: {1}})
+	requireErrIs(t, err, errDBNotFound)
+	_, err = db.getAvatar(ctx, "MISSING", avatarSize)
+	requireErrIs(t, err, errDBNotFound)
+	_, err = db.getAvatar(ctx, "MISSING", 32)
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestDeleteUserMessages(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	authors := func(room string) map[string]int {
+		t.Helper()
+		messages, err := db.queryMessages(ctx, room, -1, -1)
+		require.NoError(t, err)
+		authors := map[string]int{}
+		for _, m := range messages {
+			authors[m.Author]++
+		}
+		return authors
+	}
+	require.NoError(t, db.deleteUser(ctx, "$Fox", false))
+	require.Equal(t, map[string]int{"$Goat": 3, deletedUser: 2}, authors("$Kitchen"))
+	require.NoError(t, db.deleteUser(ctx, "$Cat", true))
+	require.Equal(t, map[string]int{"$Goat": 2, "$Camel": 3}, authors("$Shed"))
+	_, err := db.getUser(ctx, "$Cat")
+	requireErrIs(t, err, errDBNotFound)
+}
+
+func TestDeleteUserSessionGen(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	u := &User{Name: "alice", passwordHash: "###"}
+	require.NoError(t, db.createUser(ctx, u))
+	require.Equal(t, int64(0), u.sessionGen)
+	_, err := db.updatePassword(ctx, "alice", "***")
+	require.NoError(t, err)
+	require.NoError(t, db.deleteUser(ctx, "alice", false))
+
+	u = &User{Name: "Alice", passwordHash: "###"}
+	require.NoError(t, db.createUser(ctx, u))
+	require.Equal(t, int64(2), u.sessionGen)
+	u2, err := db.getUser(ctx, "Alice")
+	require.NoError(t, err)
+	require.Equal(t, int64(2), u2.sessionGen)
+}
+
+func TestConversations(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	participants := []string{"$Cat", "$Fox"}
+	c, created, err := db.getOrCreateConversation(ctx, participants, "dm/1", "$Fox", "2021-01-01T00:00:00Z")
+	require.NoError(t, err)
+	require.True(t, created)
+	require.Equal(t, &Conversation{ID: "dm/1", Participants: participants, CreatedAt: "2021-01-01T00:00:00Z"}, c)
+	c, created, err = db.getOrCreateConversation(ctx, participants, "dm/2", "$Cat", "2021-01-02T00:00:00Z")
+	require.NoError(t, err)
+	require.False(t, created)
+	require.Equal(t, "dm/1", c.ID)
+	group := []string{"$Cat", "$Fox", "$Goat"}
+	_, _, err = db.getOrCreateConversation(ctx, group, "dm/3", "$Goat", "2021-01-03T00:00:00Z")
+	require.NoError(t, err)
+	_, _, err = db.getOrCreateConversation(ctx, []string{"$Fox", "MISSING"}, "dm/4", "$Fox", now())
+	requireErrIs(t, err, errDBNotFound)
+
+	ids := func(name string) []string {
+		t.Helper()
+		conversations, err := db.queryConversations(ctx, name)
+		require.NoError(t, err)
+		ids := []string{}
+		for _, c := range conversations {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	require.Equal(t, []string{"dm/3", "dm/1"}, ids("$Fox"))
+	require.Equal(t, []string{"dm/3"}, ids("$Goat"))
+	m := &Message{Content: "Psst", CreatedAt: "2021-01-04T00:00:00Z", Room: "dm/1", Author: "$Cat"}
+	require.NoError(t, db.createMessage(ctx, m))
+	require.Equal(t, []string{"dm/1", "dm/3"}, ids("$Fox"))
+	conversations, err := db.queryConversations(ctx, "$Fox")
+	require.NoError(t, err)
+	require.Equal(t, m, conversations[0].LastMessage)
+	require.Equal(t, group, conversations[1].Participants)
+	require.Nil(t, conversations[1].LastMessage)
+
+	rooms, err := db.queryRooms(ctx, roomFilter{member: "$Fox"}, "", 10)
+	require.NoError(t, err)
+	require.Empty(t, rooms)
+
+	// a new user of a deleted participant's name gets a new conversation
+	require.NoError(t, db.deleteUser(ctx, "$Cat", false))
+	require.Equal(t, []string{"dm/1", "dm/3"}, ids("$Fox"))
+	require.NoError(t, db.createUser(ctx, &User{Name: "$Cat", passwordHash: "###"}))
+	c, created, err = db.getOrCreateConversation(ctx, participants, "dm/5", "$Cat", now())
+	require.NoError(t, err)
+	require.True(t, created)
+	require.Equal(t, "dm/5", c.ID)
+}
+
+func TestModerate(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.grantRole(ctx, "$Cat", Role{Role: "member", Room: "$Kitchen"}))
+	entry := func(action string) *ModerationEntry {
+		return &ModerationEntry{Room: "$Kitchen", Moderator: "$Goat", User: "$Cat", Action: action, CreatedAt: now()}
+	}
+	ban := entry(actionBan)
+	ban.Reason = "spam"
+	require.NoError(t, db.moderate(ctx, ban, 2000))
+	require.NotZero(t, ban.ID)
+	require.Equal(t, "1970-01-01T00:33:20Z", ban.ExpiresAt)
+	_, err := db.getRoomRole(ctx, "$Kitchen", "$Cat")
+	requireErrIs(t, err, errDBNotFound)
+	s, err := db.getSanction(ctx, "$Kitchen", "$Cat", sanctionBan, 1000)
+	require.NoError(t, err)
+	require.Equal(t, "spam", s.Reason)
+	_, err = db.getSanction(ctx, "$Kitchen", "$Cat", sanctionBan, 2000) // expired
+	requireErrIs(t, err, errDBNotFound)
+	_, err = db.getSanction(ctx, "$Kitchen", "$Cat", sanctionMute, 1000)
+	requireErrIs(t, err, errDBNotFound)
+
+	require.NoError(t, db.moderate(ctx, entry(actionMute), 0))
+	sanctions, err := db.querySanctions(ctx, "$Kitchen", 1000)
+	require.NoError(t, err)
+	require.Len(t, sanctions, 2)
+	require.Equal(t, sanctionBan, sanctions[0].Kind)
+	require.Equal(t, sanctionMute, sanctions[1].Kind)
+
+	require.NoError(t, db.moderate(ctx, entry(actionUnban), 0))
+	err = db.moderate(ctx, entry(actionUnban), 0)
+	requireErrIs(t, err, errDBNotFound)
+	missing := entry(actionMute)
+	missing.User = "MISSING"
+	err = db.moderate(ctx, missing, 0)
+	requireErrIs(t, err, errDBNotFound)
+	require.NoError(t, db.moderate(ctx, entry(actionKick), 0))
+
+	entries, err := db.queryModerationLog(ctx, "$Kitchen", 10)
+	require.NoError(t, err)
+	actions := []string{}
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	require.Equal(t, []string{actionKick, actionUnban, actionMute, actionBan}, actions)
+	entries, err = db.queryModerationLog(ctx, "$Kitchen", 1)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	// the log outlives the users involved
+	require.NoError(t, db.deleteUser(ctx, "$Cat", false))
+	entries, err = db.queryModerationLog(ctx, "$Kitchen", 10)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+	sanctions, err = db.querySanctions(ctx, "$Kitchen", 1000)
+	require.NoError(t, err)
+	require.Empty(t, sanctions)
+}
+
+func TestEditMessage(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	m, err := db.getMessage(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, "Hallo", m.Content)
+	require.Empty(t, m.EditedAt)
+	require.NoError(t, db.editMessage(ctx, m, "Hello", "2021-01-01T00:00:00Z"))
+	require.NoError(t, db.editMessage(ctx, m, "Hello!", "2021-01-01T00:01:00Z"))
+	require.Equal(t, "2021-01-01T00:01:00Z", m.EditedAt)
+	got, err := db.getMessage(ctx, 2)
+	require.NoError(t, err)
+	require.Equal(t, m, got)
+	edits, err := db.queryMessageEdits(ctx, 2)
+	require.NoError(t, err)
+	want := []*MessageEdit{
+		{Content: "Hallo", ReplacedAt: "2021-01-01T00:00:00Z"},
+		{Content: "Hello", ReplacedAt: "2021-01-01T00:01:00Z"},
+	}
+	require.Equal(t, want, edits)
+	messages, err := db.queryMessages(ctx, "$Kitchen", 3, 1)
+	require.NoError(t, err)
+	require.Equal(t, []*Message{m}, messages)
+
+	_, err = db.getMessage(ctx, 1000)
+	requireErrIs(t, err, errDBNotFound)
+	err = db.editMessage(ctx, &Message{ID: 1000}, "Hi", "2021-01-01T00:00:00Z")
+	requireErrIs(t, err, errDBNotFound)
+
+	// edits are deleted with their message
+	require.NoError(t, db.deleteUser(ctx, "$Fox", true))
+	edits, err = db.queryMessageEdits(ctx, 2)
+	require.NoError(t, err)
+	require.Empty(t, edits)
+}
+
+func TestDeleteMessage(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	m, err := db.getMessage(ctx, 3)
+	require.NoError(t, err)
+	require.NoError(t, db.editMessage(ctx, m, "Hungry?", "2021-01-01T00:00:00Z"))
+	require.NoError(t, db.deleteMessage(ctx, m, "$Fox", "2021-01-01T00:01:00Z"))
+	want := &Message{
+		ID:        3,
+		CreatedAt: "2020-11-22T12:22:42Z",
+		Room:      "$Kitchen",
+		Author:    "$Goat",
+		DeletedAt: "2021-01-01T00:01:00Z",
+		DeletedBy: "$Fox",
+	}
+	require.Equal(t, want, m)
+	got, err := db.getMessage(ctx, 3)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	edits, err := db.queryMessageEdits(ctx, 3)
+	require.NoError(t, err)
+	require.Empty(t, edits)
+
+	// tombstones keep their place in the history
+	messages, err := db.queryMessages(ctx, "$Kitchen", 4, 2)
+	require.NoError(t, err)
+	require.Equal(t, []int{3, 2}, []int{messages[0].ID, messages[1].ID})
+	require.Equal(t, want, messages[0])
+
+	err = db.deleteMessage(ctx, m, "$Fox", "2021-01-01T00:02:00Z")
+	requireErrIs(t, err, errDBNotFound)
+	err = db.editMessage(ctx, m, "Hi", "2021-01-01T00:02:00Z")
+	requireErrIs(t, err, errDBNotFound)
+
+	require.NoError(t, db.deleteUser(ctx, "$Fox", false))
+	got, err = db.getMessage(ctx, 3)
+	require.NoError(t, err)
+	require.Equal(t, deletedUser, got.DeletedBy)
+}
+
+func TestReactions(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	added, err := db.addReaction(ctx, 2, "$Cat", "👍", now())
+	require.NoError(t, err)
+	require.True(t, added)
+	added, err = db.addReaction(ctx, 2, "$Cat", "👍", now())
+	require.NoError(t, err)
+	require.False(t, added)
+	for _, r := range []struct {
+		id    int
+		name  string
+		emoji string
+	}{{2, "$Goat", "🎉"}, {2, "$Goat", "👍"}, {4, "$Fox", "🎉"}} {
+		_, err := db.addReaction(ctx, r.id, r.name, r.emoji, now())
+		require.NoError(t, err)
+	}
+	_, err = db.addReaction(ctx, 1000, "$Cat", "👍", now())
+	requireErrIs(t, err, errDBNotFound)
+	cnt, err := db.countReactions(ctx, 2, "👍")
+	require.NoError(t, err)
+	require.Equal(t, 2, cnt)
+
+	messages, err := db.queryMessages(ctx, "$Kitchen", -1, -1)
+	require.NoError(t, err)
+	require.NoError(t, db.setReactions(ctx, messages, "$Goat"))
+	byID := map[int][]Reaction{}
+	for _, m := range messages {
+		byID[m.ID] = m.Reactions
+	}
+	require.Equal(t, map[int][]Reaction{
+		1: nil,
+		2: {{Emoji: "👍", Count: 2, Me: true}, {Emoji: "🎉", Count: 1, Me: true}},
+		3: nil,
+		4: {{Emoji: "🎉", Count: 1}},
+		5: nil,
+	}, byID)
+	require.NoError(t, db.setReactions(ctx, nil, ""))
+
+	removed, err := db.removeReaction(ctx, 2, "$Cat", "👍")
+	require.NoError(t, err)
+	require.True(t, removed)
+	removed, err = db.removeReaction(ctx, 2, "$Cat", "👍")
+	require.NoError(t, err)
+	require.False(t, removed)
+
+	// reactions are removed with tombstoned messages and deleted users
+	m, err := db.getMessage(ctx, 4)
+	require.NoError(t, err)
+	require.NoError(t, db.deleteMessage(ctx, m, "$Fox", now()))
+	require.NoError(t, db.deleteUser(ctx, "$Goat", false))
+	messages, err = db.queryMessages(ctx, "$Kitchen", -1, -1)
+	require.NoError(t, err)
+	require.NoError(t, db.setReactions(ctx, messages, ""))
+	for _, m := range messages {
+		require.Empty(t, m.Reactions, m.ID)
+	}
+}
+
+func TestThreads(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	for i, author := range []string{"$Fox", "$Cat", "$Fox"} {
+		createdAt := fmt.Sprintf("2021-01-01T00:0%d:00Z", i)
+		m := &Message{Content: "Re", CreatedAt: createdAt, Room: "$Kitchen", Author: author, Parent: 1}
+		require.NoError(t, db.createMessage(ctx, m))
+	}
+	messages, err := db.queryMessages(ctx, "$Kitchen", -1, -1)
+	require.NoError(t, err)
+	require.Len(t, messages, 5) // replies are not listed
+	replies, err := db.queryReplies(ctx, 1, -1, 2)
+	require.NoError(t, err)
+	require.Len(t, replies, 2)
+	require.Equal(t, 1, replies[0].Parent)
+	require.Equal(t, "2021-01-01T00:02:00Z", replies[0].CreatedAt)
+	more, err := db.queryReplies(ctx, 1, replies[1].ID, 2)
+	require.NoError(t, err)
+	require.Len(t, more, 1)
+	require.Equal(t, "$Fox", more[0].Author)
+
+	require.NoError(t, db.deleteMessage(ctx, replies[0], "$Fox", now()))
+	require.NoError(t, db.setThreadStats(ctx, messages))
+	stats := map[int]string{}
+	for _, m := range messages {
+		stats[m.ID] = fmt.Sprintf("%d %s", m.ReplyCount, m.LastReplyAt)
+	}
+	require.Equal(t, map[int]string{1: "2 2021-01-01T00:01:00Z", 2: "0 ", 3: "0 ", 4: "0 ", 5: "0 "}, stats)
+
+	// replies become top-level messages when their parent is removed
+	require.NoError(t, db.deleteUser(ctx, "$Goat", true))
+	messages, err = db.queryMessages(ctx, "$Kitchen", -1, -1)
+	require.NoError(t, err)
+	require.Len(t, messages, 5)
+	for _, m := range messages {
+		require.Zero(t, m.Parent)
+	}
+}
@@ -0,0 +1,133 @@
+package foxtrot
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"foxygo.at/s/errs"
+)
+
+// loginFailure is a failed login attempt as included in data exports.
+type loginFailure struct {
+	IP        string `json:"ip"`
+	CreatedAt string `json:"createdAt"`
+}
+
+// userExport holds everything foxtrot stores about a user for a
+// personal data export, except for authored messages, which are
+// streamed from the database when the export is written.
+type userExport struct {
+	profile       *User
+	avatar        []byte // nil if none uploaded
+	roles         []Role
+	accessTokens  []*AccessToken
+	loginFailures []loginFailure
+}
+
+func (db *db) newUserExport(ctx context.Context, name string) (*userExport, error) {
+	u, err := db.getUser(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	e := &userExport{profile: u}
+	if e.avatar, err = db.getAvatar(ctx, name, avatarSize); err != nil {
+		return nil, err
+	}
+	if e.roles, err = db.queryRoles(ctx, name); err != nil {
+		return nil, err
+	}
+	if e.accessTokens, err = db.queryAccessTokens(ctx, name); err != nil {
+		return nil, err
+	}
+	if e.loginFailures, err = db.queryLoginFailures(ctx, name); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// write writes the export as ZIP archive of JSON files and the avatar
+// image to w. Messages are streamed from db into the archive one at a
+// time.
+func (e *userExport) write(ctx context.Context, db *db, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	files := []struct {
+		name string
+		v    interface{}
+	}{
+		{"profile.json", e.profile},
+		{"roles.json", e.roles},
+		{"access_tokens.json", e.accessTokens},
+		{"login_failures.json", e.loginFailures},
+	}
+	for _, f := range files {
+		fw, err := createZipFile(zw, f.name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(f.v); err != nil {
+			return errs.Errorf("cannot write %s: %v", f.name, err)
+		}
+	}
+	if e.avatar != nil {
+		fw, err := createZipFile(zw, "avatar.png")
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(e.avatar); err != nil {
+			return errs.Errorf("cannot write avatar.png: %v", err)
+		}
+	}
+	if err := e.writeMessages(ctx, db, zw); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return errs.Errorf("cannot finish export archive: %v", err)
+	}
+	return nil
+}
+
+// writeMessages writes the user's messages as JSON array to
+// messages.json.
+func (e *userExport) writeMessages(ctx context.Context, db *db, zw *zip.Writer) error {
+	fw, err := createZipFile(zw, "messages.json")
+	if err != nil {
+		return err
+	}
+	sep := "[\n"
+	err = db.forEachMessageByAuthor(ctx, e.profile.Name, func(m *Message) error {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, sep); err != nil {
+			return err
+		}
+		sep = ",\n"
+		_, err = fw.Write(b)
+		return err
+	})
+	if err != nil {
+		return errs.Errorf("cannot write messages.json: %v", err)
+	}
+	end := "\n]\n"
+	if sep == "[\n" {
+		end = "[]\n"
+	}
+	if _, err := io.WriteString(fw, end); err != nil {
+		return errs.Errorf("cannot write messages.json: %v", err)
+	}
+	return nil
+}
+
+func createZipFile(zw *zip.Writer, name string) (io.Writer, error) {
+	fw, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return nil, errs.Errorf("cannot create %s: %v", name, err)
+	}
+	return fw, nil
+}
@@ -0,0 +1,70 @@
+package foxtrot
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readZip returns the contents of all files in a ZIP archive by name.
+func readZip(t *testing.T, b []byte) map[string][]byte {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	require.NoError(t, err)
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		require.NoError(t, err)
+		files[f.Name], err = ioutil.ReadAll(rc)
+		require.NoError(t, err)
+		require.NoError(t, rc.Close())
+	}
+	return files
+}
+
+func TestUserExport(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	require.NoError(t, db.setAvatar(ctx, "$Fox", avatarImages{avatarSize: []byte("PNG")}))
+	require.NoError(t, db.grantRole(ctx, "$Fox", Role{Role: "owner", Room: "$Kitchen"}))
+	require.NoError(t, db.createLoginFailure(ctx, "$Fox", "192.0.2.1", "2021-01-01T00:00:00Z"))
+	e, err := db.newUserExport(ctx, "$Fox")
+	require.NoError(t, err)
+	buf := &bytes.Buffer{}
+	require.NoError(t, e.write(ctx, db, buf))
+
+	files := readZip(t, buf.Bytes())
+	require.Len(t, files, 6)
+	require.Equal(t, "PNG", string(files["avatar.png"]))
+	u := User{}
+	require.NoError(t, json.Unmarshal(files["profile.json"], &u))
+	require.Equal(t, "$Fox", u.Name)
+	var messages []Message
+	require.NoError(t, json.Unmarshal(files["messages.json"], &messages))
+	require.Equal(t, []Message{
+		{ID: 2, Content: "Hallo", CreatedAt: "2020-11-22T11:12:12Z", Room: "$Kitchen", Author: "$Fox"},
+		{ID: 4, Content: "Yes.", CreatedAt: "2020-11-22T12:32:42Z", Room: "$Kitchen", Author: "$Fox"},
+	}, messages)
+	require.JSONEq(t, `[{"role": "owner", "room": "$Kitchen"}]`, string(files["roles.json"]))
+	require.JSONEq(t, `[]`, string(files["access_tokens.json"]))
+	require.JSONEq(t, `[{"ip": "192.0.2.1", "createdAt": "2021-01-01T00:00:00Z"}]`, string(files["login_failures.json"]))
+
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+	e, err = db.newUserExport(ctx, "alice")
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, e.write(ctx, db, buf))
+	files = readZip(t, buf.Bytes())
+	require.Len(t, files, 5)
+	require.Equal(t, "[]\n", string(files["messages.json"]))
+
+	_, err = db.newUserExport(ctx, "MISSING")
+	requireErrIs(t, err, errDBNotFound)
+}
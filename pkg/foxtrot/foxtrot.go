@@ -11,8 +11,48 @@ import (
 // Config contains the DB and Authenticator configuration as kong
 // struct tags to use as command line flags.
 type Config struct {
-	DSN        string `help:"SQLite Data Source Name" default:":memory:"`
-	AuthSecret string `help:"JWT token generation secret. default: <RANDOM_STRING>" env:"FT_AUTH_SECRET"`
+	DSN          string        `help:"SQLite Data Source Name" default:":memory:"`
+	AuthSecret   string        `help:"JWT token generation secret. default: <RANDOM_STRING>" env:"FT_AUTH_SECRET"`
+	AuthIssuer   string        `help:"JWT issuer claim, set on issue and checked on validation" env:"FT_AUTH_ISSUER"`
+	AuthAudience string        `help:"JWT audience claim, set on issue and checked on validation" env:"FT_AUTH_AUDIENCE"`
+	AuthLeeway   time.Duration `help:"Clock skew leeway for JWT exp, nbf and iat claim validation" default:"1m"`
+
+	LoginBackoff          time.Duration `help:"Wait after a failed login, doubling with each further failure" default:"1s"`
+	LoginLockout          time.Duration `help:"Lockout duration after too many failed logins" default:"15m"`
+	LoginMaxFailures      int           `help:"Failed logins per account before lockout, 0 to disable" default:"10"`
+	LoginMaxFailuresPerIP int           `help:"Failed logins per client IP in lockout period, 0 to disable" default:"100"`
+	TrustedProxies        []string      `help:"Proxy IPs or CIDRs trusted for X-Forwarded-For" env:"FT_TRUSTED_PROXIES"`
+
+	Admins           []string      `help:"Names of users with admin privileges" env:"FT_ADMINS"`
+	PasswordResetTTL time.Duration `help:"Validity of admin issued password reset tokens" default:"24h"`
+
+	UsernameMinLength int    `help:"Minimum user name length in characters" default:"1"`
+	UsernameMaxLength int    `help:"Maximum user name length in characters, 0 for no limit" default:"64"`
+	UsernamePattern   string `help:"Regular expression user names must match, in addition to PRECIS rules"`
+	PasswordMinLength int    `help:"Minimum password length in characters" default:"8"`
+	BreachedPasswords string `help:"File of breached passwords or their SHA-1 hashes, one per line"`
+
+	OIDCIssuer        string   `help:"OpenID Connect issuer URL for single sign-on, empty to disable"`
+	OIDCClientID      string   `help:"OpenID Connect client ID"`
+	OIDCClientSecret  string   `help:"OpenID Connect client secret, empty for public clients" env:"FT_OIDC_CLIENT_SECRET"`
+	OIDCRedirectURL   string   `help:"OpenID Connect redirect URL, foxtrot's /api/auth/oidc/callback"`
+	OIDCScopes        []string `help:"OpenID Connect scopes" default:"openid,profile"`
+	OIDCNameClaim     string   `help:"ID token claim used as foxtrot user name" default:"preferred_username"`
+	OIDCAutoProvision bool     `help:"Create foxtrot users on first single sign-on"`
+
+	CookieSession  bool   `help:"Set the JWT as HttpOnly session cookie on login instead of returning it"`
+	CookieSameSite string `help:"SameSite attribute of session cookies" enum:"lax,strict" default:"lax"`
+	CookieInsecure bool   `help:"Allow session cookies over plain HTTP, for development only"`
+
+	MessageEditWindow time.Duration `help:"How long authors can edit sent messages, 0 for no limit" default:"15m"`
+
+	TOTPIssuer string `help:"Issuer name shown in authenticator apps for two-factor authentication" default:"foxtrot"`
+
+	PasswordHash      string `help:"Password hashing algorithm for new hashes" enum:"bcrypt,argon2id" default:"argon2id"`
+	BcryptCost        int    `help:"bcrypt cost, 0 for default" default:"10"`
+	Argon2Memory      uint32 `help:"Argon2id memory in KiB, 0 for default" default:"65536"`
+	Argon2Iterations  uint32 `help:"Argon2id iterations, 0 for default" default:"3"`
+	Argon2Parallelism uint8  `help:"Argon2id parallelism, 0 for default" default:"4"`
 
 	Version Version `kong:"-"`
 }
@@ -28,6 +68,19 @@ type Version struct {
 // NewApp creates a new App struct for given config and wire it with
 // given mux on /api.
 func NewApp(cfg *Config, mux *http.ServeMux) (*App, error) {
+	argon2Params := argon2Hasher{
+		memory:      cfg.Argon2Memory,
+		iterations:  cfg.Argon2Iterations,
+		parallelism: cfg.Argon2Parallelism,
+	}
+	hasher, err := newPasswordHasher(cfg.PasswordHash, cfg.BcryptCost, argon2Params)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := newCredentialPolicy(cfg)
+	if err != nil {
+		return nil, err
+	}
 	db, err := newDB(cfg.DSN)
 	if err != nil {
 		return nil, err
@@ -40,8 +93,48 @@ func NewApp(cfg *Config, mux *http.ServeMux) (*App, error) {
 			return nil, fmt.Errorf("NewApp auth secret initialisation: %w", err)
 		}
 	}
-	auth := &authenticator{db: db, secret: secret}
+	jwtCfg := jwtConfig{
+		issuer:   cfg.AuthIssuer,
+		audience: cfg.AuthAudience,
+		leeway:   cfg.AuthLeeway,
+	}
+	auth := &authenticator{
+		db:               db,
+		hasher:           hasher,
+		policy:           policy,
+		secret:           secret,
+		jwtCfg:           jwtCfg,
+		throttle:         loginThrottle{backoff: cfg.LoginBackoff, lockout: cfg.LoginLockout},
+		maxFailures:      cfg.LoginMaxFailures,
+		maxFailuresPerIP: cfg.LoginMaxFailuresPerIP,
+		admins:           map[string]bool{},
+		resetTTL:         cfg.PasswordResetTTL,
+		totpIssuer:       cfg.TOTPIssuer,
+	}
+	if cfg.OIDCIssuer != "" {
+		auth.oidc = newOIDCProvider(oidcConfig{
+			issuer:        cfg.OIDCIssuer,
+			clientID:      cfg.OIDCClientID,
+			clientSecret:  cfg.OIDCClientSecret,
+			redirectURL:   cfg.OIDCRedirectURL,
+			scopes:        cfg.OIDCScopes,
+			nameClaim:     cfg.OIDCNameClaim,
+			autoProvision: cfg.OIDCAutoProvision,
+		})
+	}
+	for _, name := range cfg.Admins {
+		auth.admins[name] = true
+	}
 	api := newAPI(db, auth, cfg.Version)
+	api.editWindow = cfg.MessageEditWindow
+	if api.trustedProxies, err = parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		return nil, err
+	}
+	if cfg.CookieSession {
+		if api.sessions, err = newCookieSessions(cfg.CookieSameSite, cfg.CookieInsecure); err != nil {
+			return nil, err
+		}
+	}
 	api.wireRoutes("/api", mux)
 	app := &App{db: db, auth: auth, api: api}
 	return app, nil
@@ -59,17 +152,42 @@ type App struct {
 // the database as well as the data related to a user as presented in
 // the web UI.
 type User struct {
-	Name      string `json:"name"`
-	AvatarURL string `json:"avatarURL,omitempty"`
-	JWT       string `json:"jwt,omitempty"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+	Bio         string `json:"bio,omitempty"`
+	Status      string `json:"status,omitempty"`
+	Timezone    string `json:"timezone,omitempty"` // IANA time zone name
+	AvatarURL   string `json:"avatarURL,omitempty"`
+	JWT         string `json:"jwt,omitempty"`
 
 	passwordHash string
 	avatar       []byte
+	// sessionGen is incremented on password change. It is embedded in
+	// issued JWTs so that tokens of an older generation can be rejected.
+	sessionGen int64
+	// scopes limits what a user authenticated with a personal access
+	// token may do. nil for JWT authentication, which allows everything.
+	scopes []string
 }
 
 // Room is a chat room identified by its name.
 type Room struct {
-	Name string `json:"name"`
+	Name        string       `json:"name"`
+	Topic       string       `json:"topic,omitempty"`
+	Description string       `json:"description,omitempty"`
+	Icon        string       `json:"icon,omitempty"` // emoji or image URL
+	CreatedBy   string       `json:"createdBy,omitempty"`
+	CreatedAt   string       `json:"createdAt,omitempty"`
+	Settings    RoomSettings `json:"settings"`
+	Private     bool         `json:"private,omitempty"`    // only members can read and write
+	ArchivedAt  string       `json:"archivedAt,omitempty"` // read-only and not listed by default if set
+}
+
+// RoomSettings control who may post to a room and how often.
+// Moderators, owners and admins are exempt.
+type RoomSettings struct {
+	ReadOnly bool `json:"readOnly,omitempty"`
+	SlowMode int  `json:"slowMode,omitempty"` // minimum seconds between messages per user, 0: off
 }
 
 // Message is a chat message.
@@ -79,6 +197,28 @@ type Message struct {
 	CreatedAt string `json:"createdAt"`
 	Room      string `json:"room"`
 	Author    string `json:"author"`
+	EditedAt  string `json:"editedAt,omitempty"`  // empty unless edited
+	DeletedAt string `json:"deletedAt,omitempty"` // empty unless deleted, Content is empty if set
+	DeletedBy string `json:"deletedBy,omitempty"` // author or moderator who deleted the message
+	Parent    int    `json:"parent,omitempty"`    // ID of the message starting the thread of a reply
+
+	Reactions   []Reaction `json:"reactions,omitempty"`   // set for message history only
+	ReplyCount  int        `json:"replyCount,omitempty"`  // of thread parents, set for message history only
+	LastReplyAt string     `json:"lastReplyAt,omitempty"` // of thread parents, set for message history only
+}
+
+// Reaction is the aggregate of the reactions with one emoji to a
+// message. Me is set if the requesting user reacted with it.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me,omitempty"`
+}
+
+// MessageEdit is a prior version of an edited message.
+type MessageEdit struct {
+	Content    string `json:"content"`
+	ReplacedAt string `json:"replacedAt"`
 }
 
 func now() string {
@@ -0,0 +1,170 @@
+package foxtrot
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"foxygo.at/s/errs"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errPasswordMismatch = errors.New("password does not match hash")
+	errHashFormat       = errors.New("unknown password hash format")
+	errHashAlgorithm    = errors.New("unknown password hash algorithm")
+)
+
+// passwordHasher creates password hashes in PHC string format, see
+// https://github.com/P-H-C/phc-string-format/blob/master/phc-sf-spec.md.
+// bcrypt hashes use their traditional $2a$ / $2b$ format.
+type passwordHasher interface {
+	hash(password string) (string, error)
+	// upToDate reports whether the given hash was created with the
+	// hasher's algorithm and parameters. If not, the password should
+	// be rehashed on next successful login.
+	upToDate(hash string) bool
+}
+
+func newPasswordHasher(algorithm string, bcryptCost int, argon2Params argon2Hasher) (passwordHasher, error) {
+	switch algorithm {
+	case "bcrypt":
+		return bcryptHasher{cost: bcryptCost}, nil
+	case "", "argon2id":
+		return argon2Params.withDefaults(), nil
+	}
+	return nil, errs.Errorf("%v: '%s'", errHashAlgorithm, algorithm)
+}
+
+// verifyPassword checks password against hash created by any of the
+// supported hashers.
+func verifyPassword(hash, password string) error {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			return errs.New(errPasswordMismatch, err)
+		}
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2(hash, password)
+	}
+	return errHashFormat
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h bcryptHasher) hash(password string) (string, error) {
+	hashWithSalt, err := bcrypt.GenerateFromPassword([]byte(password), h.costOrDefault())
+	if err != nil {
+		return "", errs.New(errPasswordHash, err)
+	}
+	return string(hashWithSalt), nil
+}
+
+func (h bcryptHasher) upToDate(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost == h.costOrDefault()
+}
+
+func (h bcryptHasher) costOrDefault() int {
+	if h.cost == 0 {
+		return bcrypt.DefaultCost
+	}
+	return h.cost
+}
+
+// argon2Hasher creates Argon2id hashes, see RFC 9106.
+type argon2Hasher struct {
+	memory      uint32 // in KiB
+	iterations  uint32
+	parallelism uint8
+	saltLen     int
+	keyLen      uint32
+}
+
+// withDefaults returns a copy of h with zero parameters set to the
+// second recommended option of RFC 9106, section 4.
+func (h argon2Hasher) withDefaults() argon2Hasher {
+	if h.memory == 0 {
+		h.memory = 64 * 1024
+	}
+	if h.iterations == 0 {
+		h.iterations = 3
+	}
+	if h.parallelism == 0 {
+		h.parallelism = 4
+	}
+	if h.saltLen == 0 {
+		h.saltLen = 16
+	}
+	if h.keyLen == 0 {
+		h.keyLen = 32
+	}
+	return h
+}
+
+func (h argon2Hasher) hash(password string) (string, error) {
+	salt := make([]byte, h.saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", errs.New(errPasswordHash, err)
+	}
+	key := argon2.IDKey([]byte(password), salt, h.iterations, h.memory, h.parallelism, h.keyLen)
+	b64 := base64.RawStdEncoding
+	hash := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.memory, h.iterations, h.parallelism, b64.EncodeToString(salt), b64.EncodeToString(key))
+	return hash, nil
+}
+
+func (h argon2Hasher) upToDate(hash string) bool {
+	p, salt, key, err := parseArgon2(hash)
+	if err != nil {
+		return false
+	}
+	return p.memory == h.memory && p.iterations == h.iterations && p.parallelism == h.parallelism &&
+		len(salt) == h.saltLen && uint32(len(key)) == h.keyLen
+}
+
+func verifyArgon2(hash, password string) error {
+	p, salt, key, err := parseArgon2(hash)
+	if err != nil {
+		return err
+	}
+	got := argon2.IDKey([]byte(password), salt, p.iterations, p.memory, p.parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(got, key) != 1 {
+		return errPasswordMismatch
+	}
+	return nil
+}
+
+// parseArgon2 parses a PHC formatted Argon2id hash such as
+// $argon2id$v=19$m=65536,t=3,p=4$c2FsdA$a2V5.
+func parseArgon2(hash string) (argon2Hasher, []byte, []byte, error) {
+	h := argon2Hasher{}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return h, nil, nil, errs.Errorf("%v: expected argon2id", errHashFormat)
+	}
+	version := 0
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return h, nil, nil, errs.Errorf("%v: bad argon2id version '%s'", errHashFormat, parts[2])
+	}
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.parallelism)
+	if err != nil {
+		return h, nil, nil, errs.Errorf("%v: bad argon2id parameters '%s': %v", errHashFormat, parts[3], err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return h, nil, nil, errs.Errorf("%v: bad argon2id salt: %v", errHashFormat, err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return h, nil, nil, errs.Errorf("%v: bad argon2id key: %v", errHashFormat, err)
+	}
+	return h, salt, key, nil
+}
@@ -0,0 +1,85 @@
+package foxtrot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fastArgon2 uses cheap parameters to keep tests fast.
+var fastArgon2 = argon2Hasher{memory: 64, iterations: 1, parallelism: 1}
+
+func TestArgon2Hasher(t *testing.T) {
+	h := fastArgon2.withDefaults()
+	hash, err := h.hash("Pa$$w0rd")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$"), hash)
+	require.NoError(t, verifyPassword(hash, "Pa$$w0rd"))
+	requireErrIs(t, verifyPassword(hash, "WRONG-PASS"), errPasswordMismatch)
+	require.True(t, h.upToDate(hash))
+
+	hash2, err := h.hash("Pa$$w0rd")
+	require.NoError(t, err)
+	require.NotEqual(t, hash, hash2) // salted
+
+	h2 := h
+	h2.iterations = 2
+	require.False(t, h2.upToDate(hash))
+	require.False(t, h.upToDate("$2a$10$V5.UzTYmeYh.bPz51WiIH.Yp2KawEqEmgF/amTTXtOHBvcjkFuIrC"))
+}
+
+func TestArgon2Defaults(t *testing.T) {
+	h := argon2Hasher{}.withDefaults()
+	want := argon2Hasher{memory: 65536, iterations: 3, parallelism: 4, saltLen: 16, keyLen: 32}
+	require.Equal(t, want, h)
+}
+
+func TestBcryptHasher(t *testing.T) {
+	h := bcryptHasher{cost: 4}
+	hash, err := h.hash("Pa$$w0rd")
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(hash, "$2a$04$"), hash)
+	require.NoError(t, verifyPassword(hash, "Pa$$w0rd"))
+	requireErrIs(t, verifyPassword(hash, "WRONG-PASS"), errPasswordMismatch)
+	require.True(t, h.upToDate(hash))
+	require.False(t, bcryptHasher{cost: 5}.upToDate(hash))
+	require.False(t, h.upToDate("$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5"))
+
+	sampleHash := "$2a$10$V5.UzTYmeYh.bPz51WiIH.Yp2KawEqEmgF/amTTXtOHBvcjkFuIrC"
+	require.NoError(t, verifyPassword(sampleHash, "Pa$$w0rd"))
+	require.True(t, bcryptHasher{}.upToDate(sampleHash))
+}
+
+func TestNewPasswordHasher(t *testing.T) {
+	h, err := newPasswordHasher("bcrypt", 12, argon2Hasher{})
+	require.NoError(t, err)
+	require.Equal(t, bcryptHasher{cost: 12}, h)
+
+	h, err = newPasswordHasher("argon2id", 0, argon2Hasher{iterations: 5})
+	require.NoError(t, err)
+	require.Equal(t, uint32(5), h.(argon2Hasher).iterations)
+	require.Equal(t, uint32(65536), h.(argon2Hasher).memory)
+
+	_, err = newPasswordHasher("md5", 0, argon2Hasher{})
+	requireErrIs(t, err, errHashAlgorithm)
+}
+
+func TestVerifyPasswordErr(t *testing.T) {
+	tests := map[string]string{
+		"empty":        "",
+		"unknown":      "$md5$abc",
+		"argon2i":      "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		"version":      "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5",
+		"params":       "$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+		"salt":         "$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+		"key":          "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$!!!",
+		"missing part": "$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+	}
+	for name, hash := range tests {
+		hash := hash
+		t.Run(name, func(t *testing.T) {
+			requireErrIs(t, verifyPassword(hash, "Pa$$w0rd"), errHashFormat)
+		})
+	}
+}
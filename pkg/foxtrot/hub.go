@@ -0,0 +1,699 @@
+package foxtrot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second    // for a single write to the client
+	wsPongWait       = 60 * time.Second    // for the client's pong before the connection is closed
+	wsPingPeriod     = wsPongWait * 9 / 10 // must be less than wsPongWait
+	wsMaxCommandSize = 16 << 10            // in bytes
+	wsSendBuffer     = 64                  // queued events per client before it is dropped as too slow
+	slowModeSweep    = time.Minute         // between removals of passed slow mode entries
+
+	maxMessageLen = 4096 // in characters
+)
+
+// Event types sent to WebSocket clients.
+const (
+	eventAck           = "ack"            // successful command, Data holds the result if any
+	eventError         = "error"          // failed command
+	eventMessage       = "message"        // new message in subscribed room
+	eventMessageEdit   = "message-edit"   // edited message in subscribed room
+	eventMessageDelete = "message-delete" // deleted message in subscribed room, Data holds its tombstone
+	eventReaction      = "reaction"       // added or removed reaction in subscribed room, see reactionChange
+	eventThreadUpdate  = "thread-update"  // new or deleted reply in subscribed room, see threadUpdate
+	eventRoomUpdate    = "room-update"    // changed room metadata, Room holds the previous name on rename
+	eventUnsubscribe   = "unsubscribe"    // subscription ended by the server, e.g. on leaving a private room or deletion
+)
+
+// command is sent by WebSocket clients:
+//
+//	{"type": "subscribe", "room": "$Kitchen"}
+//	{"type": "unsubscribe", "room": "$Kitchen"}
+//	{"type": "message", "room": "$Kitchen", "content": "Hi"}
+//	{"type": "edit", "message": 42, "content": "Hi all"}
+//	{"type": "delete", "message": 42}
+//	{"type": "react", "message": 42, "emoji": "👍"}
+//	{"type": "unreact", "message": 42, "emoji": "👍"}
+//	{"type": "subscribe", "thread": 42}
+//	{"type": "unsubscribe", "thread": 42}
+//	{"type": "message", "room": "$Kitchen", "thread": 42, "content": "Me too"}
+//
+// Thread replies are only sent to subscribers of their thread, with the
+// events for editing, deleting and reacting to them. Room subscribers
+// receive thread-update events instead.
+//
+// The optional ID is echoed in the ack or error event for the command.
+type command struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Room    string `json:"room,omitempty"`
+	Thread  int    `json:"thread,omitempty"`  // ID of the message starting the thread
+	Message int    `json:"message,omitempty"` // ID of the message to edit, delete or react to
+	Content string `json:"content,omitempty"`
+	Emoji   string `json:"emoji,omitempty"`
+}
+
+// event is sent to WebSocket clients, either in reply to a command or
+// broadcast to the subscribers of a room.
+type event struct {
+	Type   string      `json:"type"`
+	ID     string      `json:"id,omitempty"`
+	Room   string      `json:"room,omitempty"`
+	Thread int         `json:"thread,omitempty"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// hub keeps track of WebSocket clients and their room and thread
+// subscriptions and broadcasts events to subscribers.
+type hub struct {
+	mu       sync.Mutex
+	rooms    map[string]map[*client]bool
+	threads  map[int]map[*client]bool // by ID of the message starting the thread
+	nextPost map[string]time.Time     // by room and user name, for slow mode
+	swept    time.Time                // last removal of passed nextPost entries
+}
+
+func newHub() *hub {
+	return &hub{
+		rooms:    map[string]map[*client]bool{},
+		threads:  map[int]map[*client]bool{},
+		nextPost: map[string]time.Time{},
+	}
+}
+
+func (h *hub) subscribe(c *client, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.rooms[room] == nil {
+		h.rooms[room] = map[*client]bool{}
+	}
+	h.rooms[room][c] = true
+	c.rooms[room] = true
+}
+
+func (h *hub) unsubscribe(c *client, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(c, room)
+}
+
+// subscribeThread subscribes c to the thread of message id in room.
+func (h *hub) subscribeThread(c *client, room string, id int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.threads[id] == nil {
+		h.threads[id] = map[*client]bool{}
+	}
+	h.threads[id][c] = true
+	c.threads[id] = room
+}
+
+func (h *hub) unsubscribeThread(c *client, id int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeThread(c, id)
+}
+
+// leave unsubscribes c from room and its threads.
+func (h *hub) leave(c *client, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeAll(c, room)
+}
+
+// unsubscribeAll removes c from all rooms and threads. Nothing is sent
+// to c afterwards.
+func (h *hub) unsubscribeAll(c *client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for room := range c.rooms {
+		h.remove(c, room)
+	}
+	for id := range c.threads {
+		h.removeThread(c, id)
+	}
+}
+
+// remove unsubscribes c from room, h.mu must be held.
+func (h *hub) remove(c *client, room string) {
+	delete(c.rooms, room)
+	delete(h.rooms[room], c)
+	if len(h.rooms[room]) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// removeThread unsubscribes c from the thread of message id, h.mu must
+// be held.
+func (h *hub) removeThread(c *client, id int) {
+	delete(c.threads, id)
+	delete(h.threads[id], c)
+	if len(h.threads[id]) == 0 {
+		delete(h.threads, id)
+	}
+}
+
+// removeAll unsubscribes c from room and its threads, h.mu must be held.
+func (h *hub) removeAll(c *client, room string) {
+	h.remove(c, room)
+	for id, r := range c.threads {
+		if r == room {
+			h.removeThread(c, id)
+		}
+	}
+}
+
+// roomClients returns the clients subscribed to room or one of its
+// threads, h.mu must be held.
+func (h *hub) roomClients(room string) map[*client]bool {
+	clients := map[*client]bool{}
+	for c := range h.rooms[room] {
+		clients[c] = true
+	}
+	for id, subscribers := range h.threads {
+		for c := range subscribers {
+			if c.threads[id] == room {
+				clients[c] = true
+			}
+		}
+	}
+	return clients
+}
+
+// broadcast sends e to all subscribers of room. Clients that do not
+// keep up are disconnected.
+func (h *hub) broadcast(room string, e *event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.rooms[room] {
+		c.queue(b)
+	}
+}
+
+// broadcastThread sends e to all subscribers of the thread of message
+// id.
+func (h *hub) broadcastThread(id int, e *event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.threads[id] {
+		c.queue(b)
+	}
+}
+
+// closeRoom unsubscribes all clients from room and notifies them with
+// an unsubscribe event.
+func (h *hub) closeRoom(room string) {
+	h.drop(room, func(*client) bool { return true })
+}
+
+// unsubscribeUser unsubscribes the clients of user name from room and
+// notifies them with an unsubscribe event.
+func (h *hub) unsubscribeUser(room, name string) {
+	h.drop(room, func(c *client) bool { return c.user.Name == name })
+}
+
+// drop unsubscribes the clients of room selected by match from the
+// room and its threads and notifies them with an unsubscribe event.
+func (h *hub) drop(room string, match func(*client) bool) {
+	b, err := json.Marshal(&event{Type: eventUnsubscribe, Room: room})
+	if err != nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.roomClients(room) {
+		if match(c) {
+			h.removeAll(c, room)
+			c.queue(b)
+		}
+	}
+}
+
+// clients returns the clients subscribed to room or one of its threads.
+func (h *hub) clients(room string) []*client {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	roomClients := h.roomClients(room)
+	clients := make([]*client, 0, len(roomClients))
+	for c := range roomClients {
+		clients = append(clients, c)
+	}
+	return clients
+}
+
+// renameRoom moves the room and thread subscriptions of room name to
+// newName.
+func (h *hub) renameRoom(name, newName string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.roomClients(name) {
+		for id, r := range c.threads {
+			if r == name {
+				c.threads[id] = newName
+			}
+		}
+	}
+	for c := range h.rooms[name] {
+		h.remove(c, name)
+		if h.rooms[newName] == nil {
+			h.rooms[newName] = map[*client]bool{}
+		}
+		h.rooms[newName][c] = true
+		c.rooms[newName] = true
+	}
+}
+
+// slowModeWait returns how long user has to wait before posting to room
+// again. If the user may post, the time of the next allowed post after
+// the given slow mode interval is recorded and 0 returned.
+func (h *hub) slowModeWait(room, user string, interval time.Duration, now time.Time) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := room + "\x00" + user
+	if wait := h.nextPost[key].Sub(now); wait > 0 {
+		return wait
+	}
+	h.sweepSlowMode(now)
+	h.nextPost[key] = now.Add(interval)
+	return 0
+}
+
+// sweepSlowMode removes nextPost entries that have passed, at most once
+// per slowModeSweep so that the cost is spread over many posts. It must
+// be called with h.mu held.
+func (h *hub) sweepSlowMode(now time.Time) {
+	if now.Sub(h.swept) < slowModeSweep {
+		return
+	}
+	for key, next := range h.nextPost {
+		if !next.After(now) {
+			delete(h.nextPost, key)
+		}
+	}
+	h.swept = now
+}
+
+// client is a WebSocket connection of an authenticated user.
+type client struct {
+	api     *api
+	conn    *websocket.Conn
+	user    *User
+	send    chan []byte
+	rooms   map[string]bool // guarded by hub.mu
+	threads map[int]string  // room by thread message ID, guarded by hub.mu
+
+	closeOnce sync.Once
+}
+
+// queue queues b for sending without blocking. If the send buffer is
+// full the connection is closed.
+func (c *client) queue(b []byte) {
+	select {
+	case c.send <- b:
+	default:
+		c.close()
+	}
+}
+
+func (c *client) close() {
+	c.closeOnce.Do(func() { _ = c.conn.Close() })
+}
+
+func (c *client) reply(e *event) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	c.queue(b)
+}
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// ws upgrades an authenticated request to a WebSocket connection and
+// serves the client's commands until the connection is closed.
+func (a *api) ws(w http.ResponseWriter, r *http.Request) error {
+	u, err := a.authenticate(r, "")
+	if err != nil {
+		return err
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil //nolint:nilerr // Upgrade has replied with an HTTP error
+	}
+	c := &client{
+		api:     a,
+		conn:    conn,
+		user:    u,
+		send:    make(chan []byte, wsSendBuffer),
+		rooms:   map[string]bool{},
+		threads: map[int]string{},
+	}
+	done := make(chan struct{})
+	go func() {
+		c.writePump()
+		close(done)
+	}()
+	c.readPump()
+	a.hub.unsubscribeAll(c)
+	close(c.send)
+	<-done
+	return nil
+}
+
+// readPump handles commands until the connection fails or is closed.
+func (c *client) readPump() {
+	defer c.close()
+	c.conn.SetReadLimit(wsMaxCommandSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	for {
+		cmd := command{}
+		if err := c.conn.ReadJSON(&cmd); err != nil {
+			var syntaxErr *json.SyntaxError
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+				c.reply(&event{Type: eventError, Error: "invalid command: " + err.Error()})
+				continue
+			}
+			return
+		}
+		c.handle(&cmd)
+	}
+}
+
+// writePump writes queued events and pings until the send channel is
+// closed or a write fails.
+func (c *client) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	defer c.close()
+	for {
+		select {
+		case b, ok := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// commandError is a command failure reported to the client.
+type commandError string
+
+func (e commandError) Error() string { return string(e) }
+
+const errInternal = commandError("internal error")
+
+func (c *client) handle(cmd *command) {
+	var data interface{}
+	var err error
+	switch cmd.Type {
+	case "subscribe":
+		if cmd.Thread != 0 {
+			err = c.subscribeThread(cmd.Thread)
+		} else {
+			err = c.subscribe(cmd.Room)
+		}
+	case "unsubscribe":
+		if cmd.Thread != 0 {
+			c.api.hub.unsubscribeThread(c, cmd.Thread)
+		} else {
+			c.api.hub.unsubscribe(c, cmd.Room)
+		}
+	case "message":
+		data, err = c.sendMessage(cmd.Room, cmd.Thread, cmd.Content)
+	case "edit":
+		data, err = c.editMessage(cmd.Message, cmd.Content)
+	case "delete":
+		data, err = c.deleteMessage(cmd.Message)
+	case "react", "unreact":
+		data, err = c.react(cmd.Message, cmd.Emoji, cmd.Type == "react")
+	default:
+		err = commandError(fmt.Sprintf("unknown command type '%s'", cmd.Type))
+	}
+	if err != nil {
+		msg := string(errInternal)
+		var ce commandError
+		if errors.As(err, &ce) {
+			msg = ce.Error()
+		}
+		c.reply(&event{Type: eventError, ID: cmd.ID, Room: cmd.Room, Thread: cmd.Thread, Error: msg})
+		return
+	}
+	c.reply(&event{Type: eventAck, ID: cmd.ID, Room: cmd.Room, Thread: cmd.Thread, Data: data})
+}
+
+// context returns a context for command handling.
+func (c *client) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), wsWriteWait)
+}
+
+// getRoom returns room or a commandError if it does not exist or the
+// user may not access it.
+func (c *client) getRoom(ctx context.Context, name string) (*Room, error) {
+	room, err := c.api.db.getRoom(ctx, name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil, commandError(fmt.Sprintf("room '%s' not found", name))
+		}
+		return nil, err
+	}
+	if err := c.api.auth.canAccess(ctx, c.user, room); err != nil {
+		switch {
+		case errors.Is(err, errBanned):
+			return nil, commandError(fmt.Sprintf("banned from room '%s'", name))
+		case errors.Is(err, errPermission):
+			return nil, commandError(fmt.Sprintf("room '%s' is private", name))
+		}
+		return nil, err
+	}
+	return room, nil
+}
+
+// unsubscribeRevoked unsubscribes clients from room whose users may no
+// longer access it and notifies them with an unsubscribe event. Access
+// is checked without holding the hub lock, clients that disconnect in
+// the meantime are skipped by drop.
+func (a *api) unsubscribeRevoked(ctx context.Context, room *Room) {
+	revoked := map[*client]bool{}
+	for _, c := range a.hub.clients(room.Name) {
+		if err := a.auth.canAccess(ctx, c.user, room); errors.Is(err, errPermission) {
+			revoked[c] = true
+		}
+	}
+	if len(revoked) > 0 {
+		a.hub.drop(room.Name, func(c *client) bool { return revoked[c] })
+	}
+}
+
+func (c *client) subscribe(room string) error {
+	if !c.user.hasScope(scopeHistoryRead) {
+		return commandError(errScope.Error())
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	if _, err := c.getRoom(ctx, room); err != nil {
+		return err
+	}
+	c.api.hub.subscribe(c, room)
+	return nil
+}
+
+// subscribeThread subscribes to the replies in the thread of message
+// id.
+func (c *client) subscribeThread(id int) error {
+	if !c.user.hasScope(scopeHistoryRead) {
+		return commandError(errScope.Error())
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	parent, err := c.getParent(ctx, id)
+	if err != nil {
+		return err
+	}
+	c.api.hub.subscribeThread(c, parent.Room, parent.ID)
+	return nil
+}
+
+// getParent returns the message starting the thread of message id, id
+// itself unless it is a reply, or a commandError if the message does
+// not exist or the user may not access its room.
+func (c *client) getParent(ctx context.Context, id int) (*Message, error) {
+	m, err := c.api.db.getMessage(ctx, id)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil, commandError(fmt.Sprintf("message %d not found", id))
+		}
+		return nil, err
+	}
+	if m.Parent != 0 {
+		return c.getParent(ctx, m.Parent)
+	}
+	if _, err := c.getRoom(ctx, m.Room); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// sendMessage stores a new message and broadcasts it to the room's
+// subscribers, or a reply to the thread of message thread if not 0 to
+// the thread's subscribers. The room's settings are enforced for users
+// below the moderator role.
+func (c *client) sendMessage(roomName string, thread int, content string) (*Message, error) {
+	if !c.user.hasScope(scopeMessagesWrite) {
+		return nil, commandError(errScope.Error())
+	}
+	if err := validateContent(content); err != nil {
+		var v validationErrors
+		errors.As(err, &v)
+		return nil, commandError(v[0].Message)
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	room, err := c.getRoom(ctx, roomName)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.checkSettings(ctx, room); err != nil {
+		return nil, err
+	}
+	m := &Message{Content: content, CreatedAt: now(), Room: room.Name, Author: c.user.Name}
+	if thread != 0 {
+		parent, err := c.getParent(ctx, thread)
+		if err != nil {
+			return nil, err
+		}
+		if parent.Room != room.Name || parent.DeletedAt != "" {
+			return nil, commandError(fmt.Sprintf("message %d not found in room '%s'", thread, room.Name))
+		}
+		m.Parent = parent.ID
+	}
+	if err := c.api.db.createMessage(ctx, m); err != nil {
+		return nil, err
+	}
+	c.api.broadcastMessage(room.Name, m, eventMessage, m)
+	if m.Parent != 0 {
+		c.api.broadcastThreadUpdate(ctx, room.Name, m.Parent)
+	}
+	return m, nil
+}
+
+// editMessage replaces the content of the user's message id, see
+// api.editMessage.
+func (c *client) editMessage(id int, content string) (*Message, error) {
+	if !c.user.hasScope(scopeMessagesWrite) {
+		return nil, commandError(errScope.Error())
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	m, err := c.api.editMessage(ctx, c.user, id, content)
+	return m, messageCommandErr("edit", id, err)
+}
+
+// deleteMessage deletes message id, see api.deleteMessage.
+func (c *client) deleteMessage(id int) (*Message, error) {
+	if !c.user.hasScope(scopeMessagesWrite) {
+		return nil, commandError(errScope.Error())
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	m, err := c.api.deleteMessage(ctx, c.user, id)
+	return m, messageCommandErr("delete", id, err)
+}
+
+// react adds or removes the user's reaction emoji to message id, see
+// api.react.
+func (c *client) react(id int, emoji string, add bool) (*reactionChange, error) {
+	if !c.user.hasScope(scopeMessagesWrite) {
+		return nil, commandError(errScope.Error())
+	}
+	ctx, cancel := c.context()
+	defer cancel()
+	rc, err := c.api.react(ctx, c.user, id, emoji, add)
+	return rc, messageCommandErr("react to", id, err)
+}
+
+// messageCommandErr maps errors of changing message id to
+// commandErrors.
+func messageCommandErr(verb string, id int, err error) error {
+	var v validationErrors
+	switch {
+	case errors.As(err, &v):
+		return commandError(v[0].Message)
+	case errors.Is(err, errDBNotFound):
+		return commandError(fmt.Sprintf("message %d not found", id))
+	case errors.Is(err, errPermission):
+		return commandError(fmt.Sprintf("cannot %s message %d: %v", verb, id, err))
+	}
+	return err
+}
+
+// checkSettings returns a commandError if the room is archived, the
+// user is muted or the room's read-only or slow mode settings do not
+// allow the user to post now.
+func (c *client) checkSettings(ctx context.Context, room *Room) error {
+	if room.ArchivedAt != "" {
+		return commandError(fmt.Sprintf("room '%s' is archived", room.Name))
+	}
+	mute, err := c.api.db.getSanction(ctx, room.Name, c.user.Name, sanctionMute, time.Now().Unix())
+	switch {
+	case err == nil && mute.ExpiresAt != "":
+		return commandError(fmt.Sprintf("muted in room '%s' until %s", room.Name, mute.ExpiresAt))
+	case err == nil:
+		return commandError(fmt.Sprintf("muted in room '%s'", room.Name))
+	case !errors.Is(err, errDBNotFound):
+		return err
+	}
+	s := room.Settings
+	if !s.ReadOnly && s.SlowMode == 0 {
+		return nil
+	}
+	if err := c.api.auth.authorize(ctx, c.user, room.Name, roleModerator); err == nil {
+		return nil
+	} else if !errors.Is(err, errPermission) {
+		return err
+	}
+	if s.ReadOnly {
+		return commandError(fmt.Sprintf("room '%s' is read-only", room.Name))
+	}
+	interval := time.Duration(s.SlowMode) * time.Second
+	if wait := c.api.hub.slowModeWait(room.Name, c.user.Name, interval, time.Now()); wait > 0 {
+		return commandError(fmt.Sprintf("slow mode: wait %s before posting again", wait.Round(time.Second)))
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package foxtrot
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func newHubTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	cfg := &Config{DSN: ":memory:", Admins: []string{"$Goat"}}
+	mux := http.NewServeMux()
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+	return httptest.NewServer(mux)
+}
+
+func dialWS(t *testing.T, serverURL, jwt string) *websocket.Conn {
+	t.Helper()
+	header := http.Header{"Authorization": []string{"Bearer " + jwt}}
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(serverURL, "http")+"/api/ws", header)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+func sendCommand(t *testing.T, conn *websocket.Conn, cmd command) {
+	t.Helper()
+	require.NoError(t, conn.WriteJSON(cmd))
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn) event {
+	t.Helper()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	e := event{}
+	require.NoError(t, conn.ReadJSON(&e))
+	return e
+}
+
+func TestHubUnauthenticated(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/ws", nil)
+	require.Error(t, err)
+	require.NoError(t, resp.Body.Close())
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHubMessage(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	fox := dialWS(t, server.URL, login(t, server.URL, "$Fox", "Pa$$w0rd"))
+	cat := dialWS(t, server.URL, login(t, server.URL, "$Cat", "Pa$$w0rd"))
+	sendCommand(t, cat, command{Type: "subscribe", ID: "1", Room: "$Kitchen"})
+	require.Equal(t, event{Type: eventAck, ID: "1", Room: "$Kitchen"}, readEvent(t, cat))
+
+	sendCommand(t, fox, command{Type: "message", ID: "2", Room: "$Kitchen", Content: "Hi"})
+	ack := readEvent(t, fox)
+	require.Equal(t, eventAck, ack.Type)
+	require.Equal(t, "2", ack.ID)
+	e := readEvent(t, cat)
+	require.Equal(t, eventMessage, e.Type)
+	m := Message{}
+	b, err := json.Marshal(e.Data)
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(b, &m))
+	require.Equal(t, "Hi", m.Content)
+	require.Equal(t, "$Fox", m.Author)
+	require.NotZero(t, m.ID)
+
+	sendCommand(t, fox, command{Type: "message", ID: "3", Room: "$Cellar", Content: "Hi"})
+	e = readEvent(t, fox)
+	require.Equal(t, eventError, e.Type)
+	require.Equal(t, "3", e.ID)
+	require.Contains(t, e.Error, "not found")
+	sendCommand(t, fox, command{Type: "message", Room: "$Kitchen", Content: " "})
+	require.Equal(t, eventError, readEvent(t, fox).Type)
+	sendCommand(t, fox, command{Type: "dance"})
+	require.Contains(t, readEvent(t, fox).Error, "unknown command")
+
+	sendCommand(t, cat, command{Type: "unsubscribe", Room: "$Kitchen"})
+	require.Equal(t, eventAck, readEvent(t, cat).Type)
+	sendCommand(t, fox, command{Type: "message", Room: "$Kitchen", Content: "Anyone?"})
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+	sendCommand(t, cat, command{Type: "subscribe", ID: "4", Room: "$Shed"})
+	require.Equal(t, "4", readEvent(t, cat).ID) // no message event from $Kitchen in between
+}
+
+func TestHubRoomSettings(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	fox := dialWS(t, server.URL, foxJWT)
+	goat := dialWS(t, server.URL, goatJWT)
+	sendCommand(t, fox, command{Type: "subscribe", Room: "$Kitchen"})
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+
+	patch := `{"topic": "Quiet", "settings": {"readOnly": true}}`
+	body, status := httpDoAuth(t, http.MethodPatch, server.URL+"/api/room/$Kitchen", patch, goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	e := readEvent(t, fox)
+	require.Equal(t, eventRoomUpdate, e.Type)
+	require.Equal(t, "$Kitchen", e.Room)
+	require.Equal(t, "Quiet", e.Data.(map[string]interface{})["topic"])
+
+	sendCommand(t, fox, command{Type: "message", Room: "$Kitchen", Content: "Hi"})
+	require.Contains(t, readEvent(t, fox).Error, "read-only")
+	sendCommand(t, goat, command{Type: "message", Room: "$Kitchen", Content: "Hi"})
+	require.Equal(t, eventAck, readEvent(t, goat).Type)
+	require.Equal(t, eventMessage, readEvent(t, fox).Type)
+
+	patch = `{"settings": {"slowMode": 60}}`
+	body, status = httpDoAuth(t, http.MethodPatch, server.URL+"/api/room/$Kitchen", patch, goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Equal(t, eventRoomUpdate, readEvent(t, fox).Type)
+	sendCommand(t, fox, command{Type: "message", Room: "$Kitchen", Content: "Hi"})
+	require.Equal(t, eventMessage, readEvent(t, fox).Type) // broadcast before ack
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+	sendCommand(t, fox, command{Type: "message", Room: "$Kitchen", Content: "Hi again"})
+	require.Contains(t, readEvent(t, fox).Error, "slow mode")
+
+	body, status = httpDoAuth(t, http.MethodPatch, server.URL+"/api/room/$Kitchen", `{"name": "$Den"}`, goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	e = readEvent(t, fox)
+	require.Equal(t, eventRoomUpdate, e.Type)
+	require.Equal(t, "$Kitchen", e.Room)
+	require.Equal(t, "$Den", e.Data.(map[string]interface{})["name"])
+	sendCommand(t, goat, command{Type: "message", Room: "$Den", Content: "Moved"})
+	require.Equal(t, eventAck, readEvent(t, goat).Type)
+	e = readEvent(t, fox)
+	require.Equal(t, eventMessage, e.Type)
+	require.Equal(t, "$Den", e.Room)
+}
+
+func TestHubPrivateRoom(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/room", `{"name": "$Burrow", "private": true}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	cat := dialWS(t, server.URL, catJWT)
+	sendCommand(t, cat, command{Type: "subscribe", Room: "$Burrow"})
+	require.Contains(t, readEvent(t, cat).Error, "private")
+	sendCommand(t, cat, command{Type: "message", Room: "$Burrow", Content: "Hi"})
+	require.Contains(t, readEvent(t, cat).Error, "private")
+
+	body, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/user/$Cat/roles",
+		`{"role": "member", "room": "$Burrow"}`, foxJWT)
+	require.Equal(t, http.StatusNoContent, status, body)
+	sendCommand(t, cat, command{Type: "subscribe", Room: "$Burrow"})
+	require.Equal(t, eventAck, readEvent(t, cat).Type)
+
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Burrow/leave", "", catJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	require.Equal(t, event{Type: eventUnsubscribe, Room: "$Burrow"}, readEvent(t, cat))
+}
+
+func TestHubArchiveDeleteRoom(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	fox := dialWS(t, server.URL, foxJWT)
+	goat := dialWS(t, server.URL, goatJWT)
+	sendCommand(t, fox, command{Type: "subscribe", Room: "$Kitchen"})
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+
+	_, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Kitchen/archive", "", goatJWT)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, eventRoomUpdate, readEvent(t, fox).Type)
+	sendCommand(t, goat, command{Type: "message", Room: "$Kitchen", Content: "Hi"})
+	require.Contains(t, readEvent(t, goat).Error, "archived") // admins too
+
+	_, status = httpDoAuth(t, http.MethodDelete, server.URL+"/api/room/$Kitchen", "", goatJWT)
+	require.Equal(t, http.StatusNoContent, status)
+	require.Equal(t, event{Type: eventUnsubscribe, Room: "$Kitchen"}, readEvent(t, fox))
+}
+
+func TestHubModeration(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	catJWT := login(t, server.URL, "$Cat", "Pa$$w0rd")
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/user/$Fox/roles",
+		`{"role": "moderator", "room": "$Kitchen"}`, goatJWT)
+	require.Equal(t, http.StatusNoContent, status, body)
+	cat := dialWS(t, server.URL, catJWT)
+	sendCommand(t, cat, command{Type: "subscribe", Room: "$Kitchen"})
+	require.Equal(t, eventAck, readEvent(t, cat).Type)
+
+	modURL := server.URL + "/api/room/$Kitchen/moderation"
+	body, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "mute", "user": "$Cat", "duration": 60}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	sendCommand(t, cat, command{Type: "message", Room: "$Kitchen", Content: "Hi"})
+	require.Contains(t, readEvent(t, cat).Error, "muted")
+	body, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "unmute", "user": "$Cat"}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	sendCommand(t, cat, command{Type: "message", Room: "$Kitchen", Content: "Hi"})
+	require.Equal(t, eventMessage, readEvent(t, cat).Type)
+	require.Equal(t, eventAck, readEvent(t, cat).Type)
+
+	body, status = httpDoAuth(t, http.MethodPost, modURL, `{"action": "ban", "user": "$Cat", "reason": "spam"}`, foxJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	require.Equal(t, event{Type: eventUnsubscribe, Room: "$Kitchen"}, readEvent(t, cat))
+	sendCommand(t, cat, command{Type: "subscribe", Room: "$Kitchen"})
+	require.Contains(t, readEvent(t, cat).Error, "banned")
+	sendCommand(t, cat, command{Type: "message", Room: "$Kitchen", Content: "Hi"})
+	require.Contains(t, readEvent(t, cat).Error, "banned")
+	_, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Kitchen/join", "", catJWT)
+	require.Equal(t, http.StatusForbidden, status)
+}
+
+func TestHubEditMessage(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	fox := dialWS(t, server.URL, login(t, server.URL, "$Fox", "Pa$$w0rd"))
+	cat := dialWS(t, server.URL, login(t, server.URL, "$Cat", "Pa$$w0rd"))
+	sendCommand(t, cat, command{Type: "subscribe", Room: "$Kitchen"})
+	require.Equal(t, eventAck, readEvent(t, cat).Type)
+
+	sendCommand(t, fox, command{Type: "edit", ID: "1", Message: 2, Content: "Hello"})
+	e := readEvent(t, fox)
+	require.Equal(t, eventAck, e.Type)
+	require.Equal(t, "1", e.ID)
+	e = readEvent(t, cat)
+	require.Equal(t, eventMessageEdit, e.Type)
+	require.Equal(t, "$Kitchen", e.Room)
+	m := e.Data.(map[string]interface{})
+	require.Equal(t, "Hello", m["content"])
+	require.NotEmpty(t, m["editedAt"])
+
+	sendCommand(t, cat, command{Type: "edit", Message: 2, Content: "Meow"})
+	require.Contains(t, readEvent(t, cat).Error, "not the message author")
+	sendCommand(t, fox, command{Type: "edit", Message: 2, Content: " "})
+	require.Equal(t, "message must not be empty", readEvent(t, fox).Error)
+	sendCommand(t, fox, command{Type: "edit", Message: 1000, Content: "Hi"})
+	require.Equal(t, "message 1000 not found", readEvent(t, fox).Error)
+}
+
+func TestHubDeleteMessage(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	fox := dialWS(t, server.URL, login(t, server.URL, "$Fox", "Pa$$w0rd"))
+	cat := dialWS(t, server.URL, login(t, server.URL, "$Cat", "Pa$$w0rd"))
+	sendCommand(t, cat, command{Type: "subscribe", Room: "$Kitchen"})
+	require.Equal(t, eventAck, readEvent(t, cat).Type)
+
+	sendCommand(t, cat, command{Type: "delete", Message: 2})
+	require.Contains(t, readEvent(t, cat).Error, "not the message author")
+	sendCommand(t, fox, command{Type: "delete", ID: "1", Message: 2})
+	e := readEvent(t, fox)
+	require.Equal(t, eventAck, e.Type)
+	require.Equal(t, "1", e.ID)
+	e = readEvent(t, cat)
+	require.Equal(t, eventMessageDelete, e.Type)
+	require.Equal(t, "$Kitchen", e.Room)
+	m := e.Data.(map[string]interface{})
+	require.Equal(t, "", m["content"])
+	require.Equal(t, "$Fox", m["deletedBy"])
+
+	sendCommand(t, fox, command{Type: "delete", Message: 2})
+	require.Equal(t, "message 2 not found", readEvent(t, fox).Error)
+	sendCommand(t, fox, command{Type: "edit", Message: 2, Content: "Hallo"})
+	require.Equal(t, "message 2 not found", readEvent(t, fox).Error)
+}
+
+func TestHubReactions(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	fox := dialWS(t, server.URL, foxJWT)
+	cat := dialWS(t, server.URL, login(t, server.URL, "$Cat", "Pa$$w0rd"))
+	sendCommand(t, fox, command{Type: "subscribe", Room: "$Kitchen"})
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+
+	sendCommand(t, cat, command{Type: "react", ID: "1", Message: 2, Emoji: "👍"})
+	e := readEvent(t, cat)
+	require.Equal(t, eventAck, e.Type)
+	require.Equal(t, "1", e.ID)
+	want := map[string]interface{}{"message": 2.0, "emoji": "👍", "user": "$Cat", "added": true, "count": 1.0}
+	require.Equal(t, want, e.Data)
+	e = readEvent(t, fox)
+	require.Equal(t, eventReaction, e.Type)
+	require.Equal(t, "$Kitchen", e.Room)
+	require.Equal(t, want, e.Data)
+
+	sendCommand(t, fox, command{Type: "react", Message: 2, Emoji: "👍"})
+	require.Equal(t, eventReaction, readEvent(t, fox).Type)
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+	body, status := httpDoAuth(t, http.MethodGet, server.URL+"/api/history?room=$Kitchen", "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.Contains(t, body, `"reactions":[{"emoji":"👍","count":2,"me":true}]`)
+	body, status = httpGet(t, server.URL+"/api/history?room=$Kitchen")
+	require.Equal(t, http.StatusOK, status, body)
+	require.Contains(t, body, `"reactions":[{"emoji":"👍","count":2}]`)
+
+	sendCommand(t, cat, command{Type: "unreact", Message: 2, Emoji: "👍"})
+	e = readEvent(t, fox)
+	require.Equal(t, eventReaction, e.Type)
+	require.Equal(t, false, e.Data.(map[string]interface{})["added"])
+	require.Equal(t, 1.0, e.Data.(map[string]interface{})["count"])
+	require.Equal(t, eventAck, readEvent(t, cat).Type)
+
+	sendCommand(t, cat, command{Type: "react", Message: 2, Emoji: "x"})
+	require.Equal(t, "invalid emoji 'x'", readEvent(t, cat).Error)
+	sendCommand(t, cat, command{Type: "react", Message: 1000, Emoji: "👍"})
+	require.Equal(t, "message 1000 not found", readEvent(t, cat).Error)
+}
+
+func TestHubThreads(t *testing.T) {
+	server := newHubTestServer(t)
+	defer server.Close()
+
+	fox := dialWS(t, server.URL, login(t, server.URL, "$Fox", "Pa$$w0rd"))
+	cat := dialWS(t, server.URL, login(t, server.URL, "$Cat", "Pa$$w0rd"))
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	sendCommand(t, fox, command{Type: "subscribe", Room: "$Kitchen"})
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+	sendCommand(t, cat, command{Type: "subscribe", Thread: 1})
+	e := readEvent(t, cat)
+	require.Equal(t, eventAck, e.Type)
+	require.Equal(t, 1, e.Thread)
+
+	sendCommand(t, fox, command{Type: "message", Room: "$Kitchen", Thread: 1, Content: "Re: Hi"})
+	e = readEvent(t, cat)
+	require.Equal(t, eventMessage, e.Type)
+	require.Equal(t, 1, e.Thread)
+	m := e.Data.(map[string]interface{})
+	require.Equal(t, 1.0, m["parent"])
+	replyID := int(m["id"].(float64))
+	e = readEvent(t, fox) // room subscribers only get the thread update
+	require.Equal(t, eventThreadUpdate, e.Type)
+	tu := e.Data.(map[string]interface{})
+	require.Equal(t, 1.0, tu["message"])
+	require.Equal(t, 1.0, tu["replyCount"])
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+
+	// replies to replies join the parent's thread
+	sendCommand(t, fox, command{Type: "message", Room: "$Kitchen", Thread: replyID, Content: "Re: Re: Hi"})
+	require.Equal(t, 1.0, readEvent(t, cat).Data.(map[string]interface{})["parent"])
+	require.Equal(t, eventThreadUpdate, readEvent(t, fox).Type)
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+	sendCommand(t, fox, command{Type: "edit", Message: replyID, Content: "Re: Hello"})
+	e = readEvent(t, cat)
+	require.Equal(t, eventMessageEdit, e.Type)
+	require.Equal(t, 1, e.Thread)
+	require.Equal(t, eventAck, readEvent(t, fox).Type)
+
+	sendCommand(t, fox, command{Type: "message", Room: "$Shed", Thread: 1, Content: "Hi"})
+	require.Equal(t, "message 1 not found in room '$Shed'", readEvent(t, fox).Error)
+	sendCommand(t, fox, command{Type: "subscribe", Thread: 1000})
+	require.Equal(t, "message 1000 not found", readEvent(t, fox).Error)
+
+	// banning ends thread subscriptions in the room
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/room/$Kitchen/moderation",
+		`{"action": "ban", "user": "$Cat"}`, goatJWT)
+	require.Equal(t, http.StatusCreated, status, body)
+	require.Equal(t, event{Type: eventUnsubscribe, Room: "$Kitchen"}, readEvent(t, cat))
+	sendCommand(t, cat, command{Type: "subscribe", Thread: 1})
+	require.Contains(t, readEvent(t, cat).Error, "banned")
+}
+
+func TestSlowModeWait(t *testing.T) {
+	h := newHub()
+	now := time.Unix(1613555000, 0)
+	require.Equal(t, time.Duration(0), h.slowModeWait("$Kitchen", "$Fox", time.Minute, now))
+	require.Equal(t, 30*time.Second, h.slowModeWait("$Kitchen", "$Fox", time.Minute, now.Add(30*time.Second)))
+	require.Equal(t, time.Duration(0), h.slowModeWait("$Shed", "$Fox", time.Minute, now))
+	require.Len(t, h.nextPost, 2)
+
+	// passed entries are removed
+	later := now.Add(time.Hour)
+	require.Equal(t, time.Duration(0), h.slowModeWait("$Kitchen", "$Cat", time.Second, later))
+	require.Len(t, h.nextPost, 1)
+	require.Equal(t, time.Duration(0), h.slowModeWait("$Kitchen", "$Fox", time.Minute, later))
+	require.Len(t, h.nextPost, 2)
+}
+
+func TestHubDropDisconnected(t *testing.T) {
+	h := newHub()
+	newClient := func() *client {
+		return &client{send: make(chan []byte, 1), rooms: map[string]bool{}, threads: map[int]string{}}
+	}
+	gone, live := newClient(), newClient()
+	h.subscribe(gone, "$Kitchen")
+	h.subscribe(live, "$Kitchen")
+	require.Len(t, h.clients("$Kitchen"), 2)
+
+	// disconnect after the clients have been listed, as in ws()
+	h.unsubscribeAll(gone)
+	close(gone.send)
+	h.drop("$Kitchen", func(*client) bool { return true })
+	require.JSONEq(t, `{"type": "unsubscribe", "room": "$Kitchen"}`, string(<-live.send))
+	require.Empty(t, h.clients("$Kitchen"))
+}
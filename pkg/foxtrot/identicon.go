@@ -0,0 +1,114 @@
+package foxtrot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+)
+
+const identiconGrid = 5 // cells per row and column
+
+var identiconBackground = color.RGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+// identicon is a generated default avatar: a horizontally symmetric
+// 5x5 pattern of cells in a colour, both derived from the hash of the
+// user name. The pattern has a margin of half a cell on each side.
+type identicon struct {
+	color color.RGBA
+	cells [identiconGrid][identiconGrid]bool // [row][column]
+}
+
+func newIdenticon(name string) identicon {
+	h := sha256.Sum256([]byte(name))
+	hue := float64(uint16(h[0])<<8|uint16(h[1])) / 65536 * 360
+	sat := 0.45 + float64(h[2])/255*0.2
+	light := 0.45 + float64(h[3])/255*0.15
+	ic := identicon{color: hslToRGB(hue, sat, light)}
+	bits := uint32(h[4])<<16 | uint32(h[5])<<8 | uint32(h[6])
+	for col := 0; col < (identiconGrid+1)/2; col++ {
+		for row := 0; row < identiconGrid; row++ {
+			on := bits&1 == 1
+			bits >>= 1
+			ic.cells[row][col] = on
+			ic.cells[row][identiconGrid-1-col] = on
+		}
+	}
+	return ic
+}
+
+// cellRect returns the pixel rectangle of cell row, col for an
+// identicon of given size.
+func (ic identicon) cellRect(row, col, size int) image.Rectangle {
+	units := 2*identiconGrid + 2 // cells are two units wide, the margin one
+	pos := func(u int) int { return int(math.Round(float64(u*size) / float64(units))) }
+	return image.Rect(pos(1+2*col), pos(1+2*row), pos(3+2*col), pos(3+2*row))
+}
+
+func (ic identicon) image(size int) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(identiconBackground), image.Point{}, draw.Src)
+	fg := image.NewUniform(ic.color)
+	for row := range ic.cells {
+		for col, on := range ic.cells[row] {
+			if on {
+				draw.Draw(img, ic.cellRect(row, col, size), fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+func (ic identicon) png(size int) ([]byte, error) {
+	return encodeAvatar(ic.image(size))
+}
+
+func (ic identicon) svg(size int) []byte {
+	units := 2*identiconGrid + 2
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		size, size, units, units)
+	fmt.Fprintf(buf, `<rect width="%d" height="%d" fill="%s"/>`, units, units, hexColor(identiconBackground))
+	fmt.Fprintf(buf, `<g fill="%s">`, hexColor(ic.color))
+	for row := range ic.cells {
+		for col, on := range ic.cells[row] {
+			if on {
+				fmt.Fprintf(buf, `<rect x="%d" y="%d" width="2" height="2"/>`, 1+2*col, 1+2*row)
+			}
+		}
+	}
+	buf.WriteString("</g></svg>\n")
+	return buf.Bytes()
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// hslToRGB converts hue in degrees, saturation and lightness in [0, 1]
+// to an opaque RGB colour.
+func hslToRGB(hue, sat, light float64) color.RGBA {
+	c := (1 - math.Abs(2*light-1)) * sat
+	x := c * (1 - math.Abs(math.Mod(hue/60, 2)-1))
+	m := light - c/2
+	var r, g, b float64
+	switch {
+	case hue < 60:
+		r, g, b = c, x, 0
+	case hue < 120:
+		r, g, b = x, c, 0
+	case hue < 180:
+		r, g, b = 0, c, x
+	case hue < 240:
+		r, g, b = 0, x, c
+	case hue < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	to8 := func(v float64) uint8 { return uint8(math.Round((v + m) * 255)) }
+	return color.RGBA{R: to8(r), G: to8(g), B: to8(b), A: 0xff}
+}
@@ -0,0 +1,53 @@
+package foxtrot
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdenticon(t *testing.T) {
+	ic := newIdenticon("$Fox")
+	require.Equal(t, ic, newIdenticon("$Fox"))
+	require.NotEqual(t, ic, newIdenticon("$Cat"))
+	for row := range ic.cells {
+		for col := range ic.cells[row] {
+			require.Equal(t, ic.cells[row][col], ic.cells[row][identiconGrid-1-col])
+		}
+	}
+
+	b, err := ic.png(60)
+	require.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(b))
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 60, 60), img.Bounds())
+	require.Equal(t, color.RGBAModel.Convert(identiconBackground), color.RGBAModel.Convert(img.At(0, 0)))
+	for row := range ic.cells {
+		for col, on := range ic.cells[row] {
+			// cells are 10 pixels wide with a margin of 5 pixels
+			want := color.Color(identiconBackground)
+			if on {
+				want = ic.color
+			}
+			got := img.At(5+10*col+5, 5+10*row+5)
+			require.Equal(t, color.RGBAModel.Convert(want), color.RGBAModel.Convert(got), "row %d col %d", row, col)
+		}
+	}
+
+	svg := string(ic.svg(60))
+	require.True(t, strings.HasPrefix(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="60" height="60"`), svg)
+	require.Contains(t, svg, hexColor(ic.color))
+}
+
+func TestHSLToRGB(t *testing.T) {
+	require.Equal(t, color.RGBA{R: 255, A: 255}, hslToRGB(0, 1, 0.5))
+	require.Equal(t, color.RGBA{G: 255, A: 255}, hslToRGB(120, 1, 0.5))
+	require.Equal(t, color.RGBA{B: 255, A: 255}, hslToRGB(240, 1, 0.5))
+	require.Equal(t, color.RGBA{R: 128, G: 128, B: 128, A: 255}, hslToRGB(0, 0, 0.5))
+	require.Equal(t, "#ff0000", hexColor(hslToRGB(0, 1, 0.5)))
+}
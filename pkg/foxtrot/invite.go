@@ -0,0 +1,64 @@
+package foxtrot
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	maxInviteTTL  = 30 * 24 * 60 * 60 // in seconds
+	maxInviteUses = 10000
+)
+
+// Invite allows users to join a private room. Token is only set on
+// creation, only its hash is stored.
+type Invite struct {
+	ID        int    `json:"id"`
+	Room      string `json:"room"`
+	CreatedBy string `json:"createdBy"`
+	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt,omitempty"` // empty if the invite does not expire
+	MaxUses   int    `json:"maxUses,omitempty"`   // 0: unlimited
+	Uses      int    `json:"uses"`
+	Token     string `json:"token,omitempty"`
+}
+
+// inviteRequest is the request body of POST /api/room/NAME/invites.
+type inviteRequest struct {
+	ExpiresIn int `json:"expiresIn"` // in seconds, 0: never
+	MaxUses   int `json:"maxUses"`   // 0: unlimited
+}
+
+func (ir inviteRequest) validate() error {
+	var v validationErrors
+	if ir.ExpiresIn < 0 || ir.ExpiresIn > maxInviteTTL {
+		msg := fmt.Sprintf("expiresIn must be between 0 and %d seconds", maxInviteTTL)
+		v = append(v, validationError{Field: "expiresIn", Code: "invalid", Message: msg})
+	}
+	if ir.MaxUses < 0 || ir.MaxUses > maxInviteUses {
+		msg := fmt.Sprintf("maxUses must be between 0 and %d", maxInviteUses)
+		v = append(v, validationError{Field: "maxUses", Code: "invalid", Message: msg})
+	}
+	if len(v) != 0 {
+		return v
+	}
+	return nil
+}
+
+// expiresAt returns the expiry time of an invite created at t in unix
+// epoche seconds, 0 if it does not expire.
+func (ir inviteRequest) expiresAt(t time.Time) int64 {
+	if ir.ExpiresIn == 0 {
+		return 0
+	}
+	return t.Add(time.Duration(ir.ExpiresIn) * time.Second).Unix()
+}
+
+// formatExpiry formats an invite expiry in unix epoche seconds as
+// rfc3339, "" for 0.
+func formatExpiry(expiresAt int64) string {
+	if expiresAt == 0 {
+		return ""
+	}
+	return time.Unix(expiresAt, 0).UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,29 @@
+package foxtrot
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInviteRequestValidate(t *testing.T) {
+	require.NoError(t, inviteRequest{}.validate())
+	require.NoError(t, inviteRequest{ExpiresIn: maxInviteTTL, MaxUses: maxInviteUses}.validate())
+
+	var v validationErrors
+	err := inviteRequest{ExpiresIn: -1, MaxUses: maxInviteUses + 1}.validate()
+	require.True(t, errors.As(err, &v))
+	require.Len(t, v, 2)
+	require.Equal(t, "expiresIn", v[0].Field)
+	require.Equal(t, "maxUses", v[1].Field)
+}
+
+func TestInviteExpiry(t *testing.T) {
+	created := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, int64(0), inviteRequest{}.expiresAt(created))
+	expiresAt := inviteRequest{ExpiresIn: 3600}.expiresAt(created)
+	require.Equal(t, "2021-01-01T01:00:00Z", formatExpiry(expiresAt))
+	require.Equal(t, "", formatExpiry(0))
+}
@@ -24,43 +24,122 @@ var (
 	errJWT          = errors.New("invalid JWT Token")
 	errJWTEncoding  = fmt.Errorf("%w: bad encoding", errJWT)
 	errJWTExpired   = fmt.Errorf("%w: expired", errJWT)
+	errJWTNotBefore = fmt.Errorf("%w: not yet valid", errJWT)
+	errJWTIssuedAt  = fmt.Errorf("%w: issued in the future", errJWT)
+	errJWTIssuer    = fmt.Errorf("%w: invalid issuer", errJWT)
+	errJWTAudience  = fmt.Errorf("%w: invalid audience", errJWT)
 	errJWTSignature = fmt.Errorf("%w: invalid signature", errJWT)
 )
 
 type jwtPayload struct {
-	Sub string `json:"sub"` // subject: user name
-	Exp int64  `json:"exp"` // expiry in unix epoche seconds
+	Sub string   `json:"sub"`           // subject: user name
+	Exp int64    `json:"exp"`           // expiry in unix epoche seconds
+	Iat int64    `json:"iat,omitempty"` // issued at in unix epoche seconds
+	Nbf int64    `json:"nbf,omitempty"` // not before in unix epoche seconds
+	Iss string   `json:"iss,omitempty"` // issuer
+	Aud audience `json:"aud,omitempty"` // audience
+	Gen int64    `json:"gen,omitempty"` // session generation, see User.sessionGen
 }
 
-func validateJWT(jwt string, secret []byte) error {
+// audience is a JWT aud claim, which is either a string or an array of
+// strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+// MarshalJSON encodes a single audience as string, as most JWTs do.
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a audience) contains(s string) bool {
+	for _, aud := range a {
+		if aud == s {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtConfig holds the expected issuer and audience claims of a JWT as
+// well as the leeway allowed for clock skew when validating the time
+// based claims exp, nbf and iat.
+type jwtConfig struct {
+	issuer   string
+	audience string
+	leeway   time.Duration
+}
+
+func validateJWT(jwt string, secret []byte, cfg jwtConfig, now time.Time) error {
+	_, err := parseJWT(jwt, secret, cfg, now)
+	return err
+}
+
+// parseJWT validates jwt and returns its payload.
+func parseJWT(jwt string, secret []byte, cfg jwtConfig, now time.Time) (*jwtPayload, error) {
 	parts := strings.Split(jwt, ".")
 	if len(parts) != 3 {
-		return errs.Errorf("%v: invalid format, expected 2 '.' got %d", errJWT, len(parts)-1)
+		return nil, errs.Errorf("%v: invalid format, expected 2 '.' got %d", errJWT, len(parts)-1)
 	}
 	expectedSignature := sign(parts[0]+"."+parts[1], secret)
 	if parts[2] != expectedSignature {
-		return errJWTSignature
+		return nil, errJWTSignature
 	}
 	if parts[0] != encodedJWTHeader {
-		return errs.Errorf("%v: invalid JWT header", errJWT)
+		return nil, errs.Errorf("%v: invalid JWT header", errJWT)
 	}
 	payload := parts[1]
 	b, err := base64.RawURLEncoding.DecodeString(payload)
 	if err != nil {
-		return errs.Errorf("%v: base64: %v", errJWTEncoding, err)
+		return nil, errs.Errorf("%v: base64: %v", errJWTEncoding, err)
 	}
 	p := jwtPayload{}
 	if err := json.Unmarshal(b, &p); err != nil {
-		return errs.Errorf("%v: json: %v", errJWTEncoding, err)
+		return nil, errs.Errorf("%v: json: %v", errJWTEncoding, err)
+	}
+	if err := validateClaims(&p, cfg, now); err != nil {
+		return nil, err
 	}
-	if p.Exp <= time.Now().Unix() {
+	return &p, nil
+}
+
+func validateClaims(p *jwtPayload, cfg jwtConfig, now time.Time) error {
+	leeway := int64(cfg.leeway / time.Second)
+	t := now.Unix()
+	if p.Exp <= t-leeway {
 		return errJWTExpired
 	}
+	if p.Nbf > t+leeway {
+		return errJWTNotBefore
+	}
+	if p.Iat > t+leeway {
+		return errJWTIssuedAt
+	}
+	if p.Iss != cfg.issuer {
+		return errs.Errorf("%v: got '%s' expected '%s'", errJWTIssuer, p.Iss, cfg.issuer)
+	}
+	if cfg.audience == "" && len(p.Aud) != 0 || cfg.audience != "" && !p.Aud.contains(cfg.audience) {
+		return errs.Errorf("%v: got '%s' expected '%s'", errJWTAudience, strings.Join(p.Aud, " "), cfg.audience)
+	}
 	return nil
 }
 
-func newJWT(sub string, exp int64, secret []byte) string {
-	payload := jwtPayload{Sub: sub, Exp: exp}
+func newJWT(payload jwtPayload, secret []byte) string {
 	j := encodedJWTHeader + "." + jsonBase64Encode(payload)
 	signature := sign(j, secret)
 	return j + "." + signature
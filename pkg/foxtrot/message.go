@@ -0,0 +1,254 @@
+package foxtrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"foxygo.at/s/errs"
+)
+
+var (
+	errNotAuthor  = fmt.Errorf("%w: not the message author", errPermission)
+	errEditWindow = fmt.Errorf("%w: edit window has passed", errPermission)
+	errArchived   = fmt.Errorf("%w: room is archived", errPermission)
+	errMuted      = fmt.Errorf("%w: muted", errPermission)
+)
+
+const (
+	maxEmojiLen = 16 // in characters, for emoji ZWJ sequences such as 👨‍👩‍👧‍👦
+
+	defaultReplies = 50  // per page of thread replies
+	maxReplies     = 200 // per page of thread replies
+)
+
+// Thread is a message with a page of its thread replies.
+type Thread struct {
+	Parent  *Message   `json:"parent"`
+	Replies []*Message `json:"replies"`
+}
+
+type messageRequest struct {
+	Content string `json:"content"`
+}
+
+// validateContent checks that message content is neither blank nor
+// longer than maxMessageLen.
+func validateContent(content string) error {
+	if strings.TrimSpace(content) == "" {
+		return validationErrors{{Field: "content", Code: "too_short", Message: "message must not be empty"}}
+	}
+	if utf8.RuneCountInString(content) > maxMessageLen {
+		msg := fmt.Sprintf("message must be at most %d characters long", maxMessageLen)
+		return validationErrors{{Field: "content", Code: "too_long", Message: msg}}
+	}
+	return nil
+}
+
+// validateEmoji checks that emoji is a single short emoji or emoji
+// sequence: symbols with their modifiers, variation selectors and
+// joiners, and no letters, digits other than keycaps, space or controls.
+func validateEmoji(emoji string) error {
+	runes := []rune(emoji)
+	if len(runes) == 0 || len(runes) > maxEmojiLen {
+		msg := fmt.Sprintf("emoji must be 1 to %d characters long", maxEmojiLen)
+		return validationErrors{{Field: "emoji", Code: "invalid", Message: msg}}
+	}
+	invalid := validationErrors{{Field: "emoji", Code: "invalid", Message: fmt.Sprintf("invalid emoji '%s'", emoji)}}
+	symbol := false
+	for _, r := range runes {
+		switch {
+		case unicode.Is(unicode.So, r) || unicode.Is(unicode.Me, r): // symbols, enclosing keycaps
+			symbol = true
+		case unicode.Is(unicode.Sk, r) || unicode.Is(unicode.Mn, r) || r == '\u200d': // modifiers, selectors, joiner
+		case r >= '0' && r <= '9' || r == '#' || r == '*': // keycap bases
+		default:
+			return invalid
+		}
+	}
+	if !symbol {
+		return invalid
+	}
+	return nil
+}
+
+// threadUpdate is broadcast as thread-update event to room subscribers
+// when a reply is added to or deleted from the thread of message
+// Message.
+type threadUpdate struct {
+	Message     int    `json:"message"`
+	ReplyCount  int    `json:"replyCount"`
+	LastReplyAt string `json:"lastReplyAt,omitempty"`
+}
+
+// reactionChange is broadcast as reaction event when a user adds or
+// removes a reaction. Count is the new number of reactions with Emoji to
+// the message.
+type reactionChange struct {
+	Message int    `json:"message"`
+	Emoji   string `json:"emoji"`
+	User    string `json:"user"`
+	Added   bool   `json:"added"`
+	Count   int    `json:"count"`
+}
+
+// editMessage replaces the content of message id by its author u and
+// broadcasts the edited message to the room's subscribers. Messages can
+// only be edited within the edit window, by authors who can still
+// access the room and are not muted in it, and not in archived rooms.
+func (a *api) editMessage(ctx context.Context, u *User, id int, content string) (*Message, error) {
+	if err := validateContent(content); err != nil {
+		return nil, err
+	}
+	m, room, err := a.getMessage(ctx, u, id)
+	if err != nil {
+		return nil, err
+	}
+	if m.Author != u.Name {
+		return nil, errNotAuthor
+	}
+	if room.ArchivedAt != "" {
+		return nil, errArchived
+	}
+	if a.editWindow > 0 {
+		createdAt, err := time.Parse(time.RFC3339, m.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if time.Since(createdAt) > a.editWindow {
+			return nil, errEditWindow
+		}
+	}
+	if err := a.checkMuted(ctx, u, room.Name); err != nil {
+		return nil, err
+	}
+	if err := a.db.editMessage(ctx, m, content, now()); err != nil {
+		return nil, err
+	}
+	a.broadcastMessage(room.Name, m, eventMessageEdit, m)
+	return m, nil
+}
+
+// deleteMessage turns message id into a tombstone and broadcasts it to
+// the room's subscribers. Authors can delete their own messages unless
+// the room is archived, moderators any message in their room.
+func (a *api) deleteMessage(ctx context.Context, u *User, id int) (*Message, error) {
+	m, room, err := a.getMessage(ctx, u, id)
+	if err != nil {
+		return nil, err
+	}
+	err = a.auth.authorize(ctx, u, room.Name, roleModerator)
+	switch {
+	case err == nil:
+	case !errors.Is(err, errPermission):
+		return nil, err
+	case m.Author != u.Name:
+		return nil, errNotAuthor
+	case room.ArchivedAt != "":
+		return nil, errArchived
+	}
+	if err := a.db.deleteMessage(ctx, m, u.Name, now()); err != nil {
+		return nil, err
+	}
+	a.broadcastMessage(room.Name, m, eventMessageDelete, m)
+	if m.Parent != 0 {
+		a.broadcastThreadUpdate(ctx, room.Name, m.Parent)
+	}
+	return m, nil
+}
+
+// react adds or removes the reaction emoji of u to message id and
+// broadcasts the change to the room's subscribers. Adding an existing
+// or removing a missing reaction is not an error and not broadcast.
+// Muted users cannot add reactions and none can be changed in archived
+// rooms.
+func (a *api) react(ctx context.Context, u *User, id int, emoji string, add bool) (*reactionChange, error) {
+	if err := validateEmoji(emoji); err != nil {
+		return nil, err
+	}
+	m, room, err := a.getMessage(ctx, u, id)
+	if err != nil {
+		return nil, err
+	}
+	if room.ArchivedAt != "" {
+		return nil, errArchived
+	}
+	changed := false
+	if add {
+		if err := a.checkMuted(ctx, u, room.Name); err != nil {
+			return nil, err
+		}
+		changed, err = a.db.addReaction(ctx, m.ID, u.Name, emoji, now())
+	} else {
+		changed, err = a.db.removeReaction(ctx, m.ID, u.Name, emoji)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cnt, err := a.db.countReactions(ctx, m.ID, emoji)
+	if err != nil {
+		return nil, err
+	}
+	rc := &reactionChange{Message: m.ID, Emoji: emoji, User: u.Name, Added: add, Count: cnt}
+	if changed {
+		a.broadcastMessage(room.Name, m, eventReaction, rc)
+	}
+	return rc, nil
+}
+
+// getMessage returns message id and its room if u can access the room.
+// Deleted messages are not found.
+func (a *api) getMessage(ctx context.Context, u *User, id int) (*Message, *Room, error) {
+	m, err := a.db.getMessage(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.DeletedAt != "" {
+		return nil, nil, errs.Errorf("%v: message %d is deleted", errDBNotFound, id)
+	}
+	room, err := a.db.getRoom(ctx, m.Room)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := a.auth.canAccess(ctx, u, room); err != nil {
+		return nil, nil, err
+	}
+	return m, room, nil
+}
+
+// broadcastMessage sends an event of type typ about m with data to the
+// subscribers of its room, or of its thread if m is a reply.
+func (a *api) broadcastMessage(room string, m *Message, typ string, data interface{}) {
+	if m.Parent == 0 {
+		a.hub.broadcast(room, &event{Type: typ, Room: room, Data: data})
+		return
+	}
+	a.hub.broadcastThread(m.Parent, &event{Type: typ, Room: room, Thread: m.Parent, Data: data})
+}
+
+// broadcastThreadUpdate sends the reply count and latest reply time of
+// the thread of message parent to the subscribers of room.
+func (a *api) broadcastThreadUpdate(ctx context.Context, room string, parent int) {
+	m := &Message{ID: parent}
+	if err := a.db.setThreadStats(ctx, []*Message{m}); err != nil {
+		return
+	}
+	tu := &threadUpdate{Message: parent, ReplyCount: m.ReplyCount, LastReplyAt: m.LastReplyAt}
+	a.hub.broadcast(room, &event{Type: eventThreadUpdate, Room: room, Data: tu})
+}
+
+// checkMuted returns errMuted if u is muted in room.
+func (a *api) checkMuted(ctx context.Context, u *User, room string) error {
+	_, err := a.db.getSanction(ctx, room, u.Name, sanctionMute, time.Now().Unix())
+	switch {
+	case err == nil:
+		return errMuted
+	case errors.Is(err, errDBNotFound):
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+package foxtrot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateContent(t *testing.T) {
+	require.NoError(t, validateContent("Hi"))
+	require.NoError(t, validateContent(strings.Repeat("ü", maxMessageLen)))
+	for code, content := range map[string]string{
+		"too_short": " \n",
+		"too_long":  strings.Repeat("x", maxMessageLen+1),
+	} {
+		var v validationErrors
+		require.True(t, errors.As(validateContent(content), &v), code)
+		require.Equal(t, "content", v[0].Field)
+		require.Equal(t, code, v[0].Code)
+	}
+}
+
+func TestValidateEmoji(t *testing.T) {
+	for _, emoji := range []string{"👍", "❤️", "👍🏽", "👨‍👩‍👧‍👦", "🇳🇿", "1️⃣", "☕"} {
+		require.NoError(t, validateEmoji(emoji), emoji)
+	}
+	tooLong := strings.Repeat("👍", maxEmojiLen+1)
+	for _, emoji := range []string{"", "a", "1", ":+1:", "👍 ", "\n", tooLong} {
+		var v validationErrors
+		require.True(t, errors.As(validateEmoji(emoji), &v), emoji)
+		require.Equal(t, "emoji", v[0].Field)
+	}
+}
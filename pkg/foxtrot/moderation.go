@@ -0,0 +1,113 @@
+package foxtrot
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Moderation actions in rooms.
+const (
+	actionKick   = "kick"   // remove from members and subscriptions
+	actionBan    = "ban"    // kick and prevent joining, subscribing and posting
+	actionUnban  = "unban"  // lift a ban
+	actionMute   = "mute"   // prevent posting for a while
+	actionUnmute = "unmute" // lift a mute
+)
+
+// Kinds of sanctions, see Sanction.
+const (
+	sanctionBan  = "ban"
+	sanctionMute = "mute"
+)
+
+const (
+	maxReasonLen       = 512                // in characters
+	maxBanDuration     = 365 * 24 * 60 * 60 // in seconds
+	maxMuteDuration    = 30 * 24 * 60 * 60  // in seconds
+	moderationLogLimit = 200                // entries returned by GET /api/room/NAME/moderation
+)
+
+// ModerationEntry records a moderation action in a room's moderation
+// log.
+type ModerationEntry struct {
+	ID        int    `json:"id"`
+	Room      string `json:"room"`
+	Moderator string `json:"moderator"`
+	User      string `json:"user"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt,omitempty"` // of bans and mutes, empty if permanent
+}
+
+// Sanction is a ban or mute of a user in a room.
+type Sanction struct {
+	Room      string `json:"room"`
+	User      string `json:"user"`
+	Kind      string `json:"kind"`
+	Moderator string `json:"moderator"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt,omitempty"` // empty if permanent
+}
+
+// moderationRequest is the request body of POST
+// /api/room/NAME/moderation.
+type moderationRequest struct {
+	Action   string `json:"action"`
+	User     string `json:"user"`
+	Reason   string `json:"reason"`
+	Duration int    `json:"duration"` // of bans and mutes in seconds, 0: permanent ban
+}
+
+func (mr moderationRequest) validate() error {
+	var v validationErrors
+	switch mr.Action {
+	case actionKick, actionBan, actionUnban, actionMute, actionUnmute:
+	default:
+		msg := fmt.Sprintf("unknown action '%s'", mr.Action)
+		v = append(v, validationError{Field: "action", Code: "invalid", Message: msg})
+	}
+	if strings.TrimSpace(mr.User) == "" {
+		v = append(v, validationError{Field: "user", Code: "too_short", Message: "user must not be empty"})
+	}
+	if utf8.RuneCountInString(mr.Reason) > maxReasonLen {
+		msg := fmt.Sprintf("reason must be at most %d characters long", maxReasonLen)
+		v = append(v, validationError{Field: "reason", Code: "too_long", Message: msg})
+	}
+	switch {
+	case mr.Action == actionBan && (mr.Duration < 0 || mr.Duration > maxBanDuration):
+		msg := fmt.Sprintf("duration must be between 0 and %d seconds", maxBanDuration)
+		v = append(v, validationError{Field: "duration", Code: "invalid", Message: msg})
+	case mr.Action == actionMute && (mr.Duration < 1 || mr.Duration > maxMuteDuration):
+		msg := fmt.Sprintf("duration must be between 1 and %d seconds", maxMuteDuration)
+		v = append(v, validationError{Field: "duration", Code: "invalid", Message: msg})
+	}
+	if len(v) != 0 {
+		return v
+	}
+	return nil
+}
+
+// sanctionKind returns the kind of sanction imposed or lifted by
+// action, "" for kicks.
+func sanctionKind(action string) string {
+	switch action {
+	case actionBan, actionUnban:
+		return sanctionBan
+	case actionMute, actionUnmute:
+		return sanctionMute
+	}
+	return ""
+}
+
+// expiresAt returns the expiry of a ban or mute imposed at t in unix
+// epoche seconds, 0 if it does not expire or nothing is imposed.
+func (mr moderationRequest) expiresAt(t time.Time) int64 {
+	if (mr.Action != actionBan && mr.Action != actionMute) || mr.Duration == 0 {
+		return 0
+	}
+	return t.Add(time.Duration(mr.Duration) * time.Second).Unix()
+}
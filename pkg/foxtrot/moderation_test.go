@@ -0,0 +1,45 @@
+package foxtrot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestModerationRequestValidate(t *testing.T) {
+	for _, mr := range []moderationRequest{
+		{Action: actionKick, User: "$Cat"},
+		{Action: actionBan, User: "$Cat", Reason: "spam"},
+		{Action: actionBan, User: "$Cat", Duration: maxBanDuration},
+		{Action: actionMute, User: "$Cat", Duration: 60},
+		{Action: actionUnmute, User: "$Cat"},
+	} {
+		require.NoError(t, mr.validate(), mr)
+	}
+	for field, mr := range map[string]moderationRequest{
+		"action":   {Action: "smite", User: "$Cat"},
+		"user":     {Action: actionKick},
+		"reason":   {Action: actionKick, User: "$Cat", Reason: strings.Repeat("x", maxReasonLen+1)},
+		"duration": {Action: actionMute, User: "$Cat"},
+	} {
+		var v validationErrors
+		require.True(t, errors.As(mr.validate(), &v), field)
+		require.Equal(t, field, v[0].Field)
+	}
+	var v validationErrors
+	require.True(t, errors.As(moderationRequest{Action: actionBan, User: "$Cat", Duration: -1}.validate(), &v))
+	require.Equal(t, "duration", v[0].Field)
+}
+
+func TestModerationExpiry(t *testing.T) {
+	at := time.Unix(1000, 0)
+	require.Equal(t, int64(1060), moderationRequest{Action: actionMute, Duration: 60}.expiresAt(at))
+	require.Equal(t, int64(0), moderationRequest{Action: actionBan}.expiresAt(at))
+	require.Equal(t, int64(0), moderationRequest{Action: actionKick, Duration: 60}.expiresAt(at))
+	require.Equal(t, sanctionBan, sanctionKind(actionUnban))
+	require.Equal(t, sanctionMute, sanctionKind(actionMute))
+	require.Equal(t, "", sanctionKind(actionKick))
+}
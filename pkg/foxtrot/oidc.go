@@ -0,0 +1,457 @@
+// This file contains an OpenID Connect relying party for single sign-on
+// with an external identity provider (IdP) using the authorization code
+// flow with PKCE (RFC 7636), see
+// https://openid.net/specs/openid-connect-core-1_0.html.
+
+package foxtrot
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"foxygo.at/s/errs"
+)
+
+var (
+	errOIDC          = errors.New("OIDC error")
+	errOIDCDiscovery = fmt.Errorf("%w: discovery", errOIDC)
+	errOIDCExchange  = fmt.Errorf("%w: code exchange", errOIDC)
+	errOIDCState     = fmt.Errorf("%w: invalid or expired state", errAuth)
+	errIDToken       = fmt.Errorf("%w: invalid ID token", errAuth)
+	errOIDCUser      = fmt.Errorf("%w: no foxtrot user for identity", errAuth)
+	errOIDCLinked    = fmt.Errorf("%w: identity linked to another user", errDBDuplicate)
+)
+
+const (
+	oidcLoginTTL     = 10 * time.Minute
+	oidcKeysMinAge   = time.Minute // minimum time between JWKS fetches for unknown key IDs
+	oidcResponseSize = 1 << 20
+)
+
+// oidcConfig configures the OIDC relying party. The IdP endpoints are
+// fetched from the issuer's discovery document.
+type oidcConfig struct {
+	issuer        string
+	clientID      string
+	clientSecret  string // empty for public clients relying on PKCE only
+	redirectURL   string // foxtrot's /api/auth/oidc/callback as registered with the IdP
+	scopes        []string
+	nameClaim     string // ID token claim used as foxtrot user name
+	autoProvision bool   // create users on first login, otherwise identities must be linked
+}
+
+// oidcLogin is a started OIDC login awaiting the IdP's callback.
+type oidcLogin struct {
+	nonce    string
+	verifier string // PKCE code verifier
+	linkName string // user to link the identity to, empty for sign-on
+}
+
+// oidcProvider fetches and caches the IdP's discovery document and
+// signing keys.
+type oidcProvider struct {
+	cfg    oidcConfig
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]*rsa.PublicKey // by key ID
+	keysFetched time.Time
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// idTokenClaims holds the ID token claims checked by foxtrot. All
+// claims are kept in raw for the configurable name claim.
+type idTokenClaims struct {
+	Iss   string   `json:"iss"`
+	Sub   string   `json:"sub"`
+	Aud   audience `json:"aud"`
+	Azp   string   `json:"azp"`
+	Exp   int64    `json:"exp"`
+	Iat   int64    `json:"iat"`
+	Nonce string   `json:"nonce"`
+
+	raw map[string]interface{}
+}
+
+func newOIDCProvider(cfg oidcConfig) *oidcProvider {
+	return &oidcProvider{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// getDiscovery returns the cached discovery document, fetching it on
+// first use so that foxtrot starts even if the IdP is unavailable.
+func (p *oidcProvider) getDiscovery(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+	d := &oidcDiscovery{}
+	discoveryURL := strings.TrimSuffix(p.cfg.issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, discoveryURL, d); err != nil {
+		return nil, errs.New(errOIDCDiscovery, err)
+	}
+	if d.Issuer != p.cfg.issuer {
+		return nil, errs.Errorf("%v: issuer mismatch '%s'", errOIDCDiscovery, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errs.Errorf("%v: missing endpoints", errOIDCDiscovery)
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// key returns the IdP's RSA signing key with given ID. The key set is
+// refetched for unknown key IDs to support key rotation, at most once
+// per oidcKeysMinAge.
+func (p *oidcProvider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(p.keysFetched) < oidcKeysMinAge {
+		return nil, errs.Errorf("%v: unknown key ID '%s'", errIDToken, kid)
+	}
+	set := jwks{}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return nil, errs.Errorf("%v: JWKS: %v", errOIDC, err)
+	}
+	p.keysFetched = time.Now()
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		if pub, err := k.rsaPublicKey(); err == nil {
+			p.keys[k.Kid] = pub
+		}
+	}
+	if k, ok := p.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, errs.Errorf("%v: unknown key ID '%s'", errIDToken, kid)
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	exp := new(big.Int).SetBytes(e)
+	if !exp.IsInt64() || exp.Int64() > 1<<31-1 || exp.Int64() < 3 {
+		return nil, errs.Errorf("%v: bad RSA exponent", errOIDC)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+}
+
+func (p *oidcProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	return p.doJSON(req, v)
+}
+
+func (p *oidcProvider) doJSON(req *http.Request, v interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() //nolint:errcheck
+	body, err := io.ReadAll(io.LimitReader(resp.Body, oidcResponseSize))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errs.Errorf("%v: %s %s: %s: %s", errOIDC, req.Method, req.URL, resp.Status, body)
+	}
+	return json.Unmarshal(body, v)
+}
+
+// authURL returns the IdP URL to redirect the user agent to for login.
+func (p *oidcProvider) authURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", errs.Errorf("%v: authorization endpoint: %v", errOIDCDiscovery, err)
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.clientID)
+	q.Set("redirect_uri", p.cfg.redirectURL)
+	q.Set("scope", strings.Join(p.cfg.scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", pkceChallenge(verifier))
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// pkceChallenge returns the S256 code challenge for verifier, see RFC
+// 7636, section 4.2.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// exchange redeems the authorization code at the IdP's token endpoint
+// and returns the raw ID token.
+func (p *oidcProvider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.cfg.redirectURL},
+		"client_id":     {p.cfg.clientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", errs.New(errOIDCExchange, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if p.cfg.clientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.clientID), url.QueryEscape(p.cfg.clientSecret))
+	}
+	resp := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	if err := p.doJSON(req, &resp); err != nil {
+		return "", errs.New(errOIDCExchange, err)
+	}
+	if resp.IDToken == "" {
+		return "", errs.Errorf("%v: no ID token", errOIDCExchange)
+	}
+	return resp.IDToken, nil
+}
+
+// verifyIDToken checks the RS256 signature and the claims of an ID
+// token, see OIDC Core, section 3.1.3.7.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token, nonce string, leeway time.Duration,
+	now time.Time) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errs.Errorf("%v: malformed", errIDToken)
+	}
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errs.New(errIDToken, err)
+	}
+	if header.Alg != "RS256" {
+		return nil, errs.Errorf("%v: unsupported algorithm '%s'", errIDToken, header.Alg)
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errs.New(errIDToken, err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return nil, errs.New(errIDToken, err)
+	}
+	c := &idTokenClaims{}
+	if err := decodeJWTPart(parts[1], c); err != nil {
+		return nil, errs.New(errIDToken, err)
+	}
+	if err := decodeJWTPart(parts[1], &c.raw); err != nil {
+		return nil, errs.New(errIDToken, err)
+	}
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c.Iss != d.Issuer:
+		return nil, errs.Errorf("%v: issuer '%s'", errIDToken, c.Iss)
+	case !c.Aud.contains(p.cfg.clientID):
+		return nil, errs.Errorf("%v: audience", errIDToken)
+	case len(c.Aud) > 1 && c.Azp != p.cfg.clientID:
+		return nil, errs.Errorf("%v: authorized party '%s'", errIDToken, c.Azp)
+	case now.Add(-leeway).Unix() >= c.Exp:
+		return nil, errs.Errorf("%v: expired", errIDToken)
+	case c.Iat > now.Add(leeway).Unix():
+		return nil, errs.Errorf("%v: issued in the future", errIDToken)
+	case c.Nonce != nonce:
+		return nil, errs.Errorf("%v: nonce mismatch", errIDToken)
+	case c.Sub == "":
+		return nil, errs.Errorf("%v: missing subject", errIDToken)
+	}
+	return c, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// startOIDC starts an OIDC login and returns the IdP URL to redirect
+// the user agent to. State, nonce and PKCE code verifier are stored
+// until the callback. If linkName is not empty, the IdP identity is
+// linked to that user on callback instead of signing on.
+func (a *authenticator) startOIDC(ctx context.Context, linkName string) (string, error) {
+	var tokens [3]string
+	for i := range tokens {
+		t, err := newRandomToken()
+		if err != nil {
+			return "", err
+		}
+		tokens[i] = t
+	}
+	state := tokens[0]
+	l := &oidcLogin{nonce: tokens[1], verifier: tokens[2], linkName: linkName}
+	authURL, err := a.oidc.authURL(ctx, state, l.nonce, l.verifier)
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(oidcLoginTTL).Unix()
+	if err := a.db.createOIDCLogin(ctx, hashToken(state), l, expiresAt); err != nil {
+		return "", err
+	}
+	return authURL, nil
+}
+
+// loginOIDC completes an OIDC login started with startOIDC given the
+// state and authorization code of the IdP's callback. The IdP identity
+// is mapped to the foxtrot user it has been linked to, by issuer and
+// subject. Unlinked identities are only signed on if auto-provisioning
+// is enabled and a new user can be created for the name claim; existing
+// users have to link identities explicitly, see startOIDC.
+func (a *authenticator) loginOIDC(ctx context.Context, state, code string) (*User, error) {
+	now := time.Now()
+	l, err := a.db.deleteOIDCLogin(ctx, hashToken(state), now.Unix())
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil, errs.New(errOIDCState, err)
+		}
+		return nil, err
+	}
+	token, err := a.oidc.exchange(ctx, code, l.verifier)
+	if err != nil {
+		return nil, err
+	}
+	c, err := a.oidc.verifyIDToken(ctx, token, l.nonce, a.jwtCfg.leeway, now)
+	if err != nil {
+		return nil, err
+	}
+	var name string
+	if l.linkName != "" {
+		name, err = a.linkOIDC(ctx, c, l.linkName)
+	} else {
+		name, err = a.db.getOIDCIdentity(ctx, c.Iss, c.Sub)
+		if errors.Is(err, errDBNotFound) {
+			name, err = a.provisionOIDC(ctx, c)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	u, err := a.db.getUser(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	u.JWT = a.newJWT(u)
+	return u, nil
+}
+
+// linkOIDC links the identity of c to user name unless it is already
+// linked to another user and returns the user name.
+func (a *authenticator) linkOIDC(ctx context.Context, c *idTokenClaims, name string) (string, error) {
+	err := a.db.createOIDCIdentity(ctx, c.Iss, c.Sub, name)
+	if err == nil || !errors.Is(err, errDBDuplicate) {
+		return name, err
+	}
+	linked, err := a.db.getOIDCIdentity(ctx, c.Iss, c.Sub)
+	if err != nil {
+		return "", err
+	}
+	if linked != name {
+		return "", errOIDCLinked
+	}
+	return name, nil
+}
+
+// provisionOIDC creates a new user named by the name claim of c, links
+// the identity of c to it and returns the user name. Existing users are
+// never linked implicitly, as anyone controlling the name claim at the
+// IdP could otherwise take over the foxtrot account of the same name.
+func (a *authenticator) provisionOIDC(ctx context.Context, c *idTokenClaims) (string, error) {
+	if !a.oidc.cfg.autoProvision {
+		return "", errs.Errorf("%v: identity not linked", errOIDCUser)
+	}
+	claim, _ := c.raw[a.oidc.cfg.nameClaim].(string)
+	name, v := a.policy.validateName(claim)
+	if len(v) != 0 {
+		return "", errs.Errorf("%v: claim '%s': %v", errOIDCUser, a.oidc.cfg.nameClaim, v)
+	}
+	if name == deletedUser {
+		return "", errs.Errorf("%v: reserved user name '%s'", errOIDCUser, name)
+	}
+	// SSO users have no password, "!" never matches any hash.
+	if err := a.db.createUser(ctx, &User{Name: name, passwordHash: "!"}); err != nil {
+		if errors.Is(err, errDBDuplicate) {
+			return "", errs.Errorf("%v: user '%s' exists, link identity from account instead", errOIDCUser, name)
+		}
+		return "", err
+	}
+	if err := a.db.createOIDCIdentity(ctx, c.Iss, c.Sub, name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,367 @@
+package foxtrot
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIdP is an in-process OpenID Connect identity provider issuing ID
+// tokens for a configurable identity without user interaction.
+type fakeIdP struct {
+	*httptest.Server
+	key          *rsa.PrivateKey
+	clientID     string
+	clientSecret string
+
+	mu       sync.Mutex
+	sub      string
+	username string
+	codes    map[string]fakeAuthRequest
+}
+
+type fakeAuthRequest struct {
+	challenge   string
+	nonce       string
+	redirectURI string
+	sub         string
+	username    string
+}
+
+func newFakeIdP(t *testing.T, clientID, clientSecret string) *fakeIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	idp := &fakeIdP{key: key, clientID: clientID, clientSecret: clientSecret, codes: map[string]fakeAuthRequest{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/authorize", idp.authorize)
+	mux.HandleFunc("/token", idp.token)
+	idp.Server = httptest.NewServer(mux)
+	return idp
+}
+
+func (idp *fakeIdP) setIdentity(sub, username string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.sub, idp.username = sub, username
+}
+
+func (idp *fakeIdP) discovery(w http.ResponseWriter, _ *http.Request) {
+	_ = json.NewEncoder(w).Encode(oidcDiscovery{
+		Issuer:                idp.URL,
+		AuthorizationEndpoint: idp.URL + "/authorize",
+		TokenEndpoint:         idp.URL + "/token",
+		JWKSURI:               idp.URL + "/jwks",
+	})
+}
+
+func (idp *fakeIdP) jwks(w http.ResponseWriter, _ *http.Request) {
+	k := jwk{
+		Kty: "RSA",
+		Kid: "key-1",
+		Use: "sig",
+		N:   base64.RawURLEncoding.EncodeToString(idp.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(idp.key.E)).Bytes()),
+	}
+	_ = json.NewEncoder(w).Encode(jwks{Keys: []jwk{k}})
+}
+
+func (idp *fakeIdP) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != idp.clientID || q.Get("response_type") != "code" ||
+		q.Get("code_challenge_method") != "S256" || !strings.Contains(q.Get("scope"), "openid") {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	idp.mu.Lock()
+	code := "code-" + q.Get("state")
+	idp.codes[code] = fakeAuthRequest{
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		redirectURI: q.Get("redirect_uri"),
+		sub:         idp.sub,
+		username:    idp.username,
+	}
+	idp.mu.Unlock()
+	redirect := q.Get("redirect_uri") + "?" + url.Values{"code": {code}, "state": {q.Get("state")}}.Encode()
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (idp *fakeIdP) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	if _, secret, _ := r.BasicAuth(); secret != idp.clientSecret {
+		http.Error(w, "invalid_client", http.StatusUnauthorized)
+		return
+	}
+	idp.mu.Lock()
+	req, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	idp.mu.Unlock()
+	if !ok || r.PostForm.Get("redirect_uri") != req.redirectURI ||
+		pkceChallenge(r.PostForm.Get("code_verifier")) != req.challenge {
+		http.Error(w, "invalid_grant", http.StatusBadRequest)
+		return
+	}
+	now := time.Now().Unix()
+	claims := map[string]interface{}{
+		"iss":                idp.URL,
+		"sub":                req.sub,
+		"aud":                idp.clientID,
+		"exp":                now + 300,
+		"iat":                now,
+		"nonce":              req.nonce,
+		"preferred_username": req.username,
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(claims, "RS256")})
+}
+
+func (idp *fakeIdP) sign(claims map[string]interface{}, alg string) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": "key-1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	b64 := base64.RawURLEncoding
+	signingInput := b64.EncodeToString(header) + "." + b64.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, sum[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + b64.EncodeToString(sig)
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp := newFakeIdP(t, "foxtrot", "s3cr3t")
+	defer idp.Close()
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cfg := &Config{
+		DSN:               ":memory:",
+		OIDCIssuer:        idp.URL,
+		OIDCClientID:      "foxtrot",
+		OIDCClientSecret:  "s3cr3t",
+		OIDCRedirectURL:   server.URL + "/api/auth/oidc/callback",
+		OIDCScopes:        []string{"openid", "profile"},
+		OIDCNameClaim:     "preferred_username",
+		OIDCAutoProvision: true,
+	}
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+
+	idp.setIdentity("sub-1", "alice")
+	body, status := httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusOK, status, body)
+	u := User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	require.Equal(t, "alice", u.Name)
+	require.NotEmpty(t, u.JWT)
+	_, status = httpPost(t, server.URL+"/api/login", `{"name": "alice", "password": "!"}`)
+	require.Equal(t, http.StatusUnauthorized, status) // no password login for SSO users
+
+	idp.setIdentity("sub-1", "alice-renamed")
+	body, status = httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusOK, status, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	require.Equal(t, "alice", u.Name) // linked by subject
+
+	// existing users are not linked by name claim
+	idp.setIdentity("sub-2", "$Fox")
+	_, status = httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusForbidden, status)
+	idp.setIdentity("sub-2", "[deleted]")
+	_, status = httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusForbidden, status)
+
+	// but explicitly by logged in users
+	foxJWT := login(t, server.URL, "$Fox", "Pa$$w0rd")
+	body, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/auth/oidc/link", "", foxJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	link := oidcLinkURL{}
+	require.NoError(t, json.Unmarshal([]byte(body), &link), body)
+	require.True(t, strings.HasPrefix(link.URL, idp.URL+"/authorize?"), link.URL)
+	body, status = httpGet(t, link.URL)
+	require.Equal(t, http.StatusOK, status, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	require.Equal(t, "$Fox", u.Name)
+	body, status = httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusOK, status, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	require.Equal(t, "$Fox", u.Name)
+
+	// identities link to one user only
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	body, status = httpDoAuth(t, http.MethodPost, server.URL+"/api/auth/oidc/link", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &link), body)
+	_, status = httpGet(t, link.URL)
+	require.Equal(t, http.StatusConflict, status)
+	_, status = httpPost(t, server.URL+"/api/auth/oidc/link", "")
+	require.Equal(t, http.StatusUnauthorized, status)
+
+	idp.setIdentity("sub-3", "")
+	body, status = httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusForbidden, status, body)
+
+	_, status = httpGet(t, server.URL+"/api/auth/oidc/callback?code=code-x&state=x")
+	require.Equal(t, http.StatusUnauthorized, status) // unknown state
+	_, status = httpGet(t, server.URL+"/api/auth/oidc/callback?error=access_denied")
+	require.Equal(t, http.StatusUnauthorized, status)
+	_, status = httpGet(t, server.URL+"/api/auth/oidc/callback")
+	require.Equal(t, http.StatusBadRequest, status)
+}
+
+func TestOIDCNoAutoProvision(t *testing.T) {
+	idp := newFakeIdP(t, "foxtrot", "")
+	defer idp.Close()
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	cfg := &Config{
+		DSN:             ":memory:",
+		OIDCIssuer:      idp.URL,
+		OIDCClientID:    "foxtrot",
+		OIDCRedirectURL: server.URL + "/api/auth/oidc/callback",
+		OIDCScopes:      []string{"openid"},
+		OIDCNameClaim:   "preferred_username",
+	}
+	_, err := NewApp(cfg, mux)
+	require.NoError(t, err)
+
+	idp.setIdentity("sub-1", "alice")
+	_, status := httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusForbidden, status)
+
+	idp.setIdentity("sub-2", "$Goat")
+	_, status = httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusForbidden, status)
+
+	goatJWT := login(t, server.URL, "$Goat", "$s3cr37")
+	body, status := httpDoAuth(t, http.MethodPost, server.URL+"/api/auth/oidc/link", "", goatJWT)
+	require.Equal(t, http.StatusOK, status, body)
+	link := oidcLinkURL{}
+	require.NoError(t, json.Unmarshal([]byte(body), &link), body)
+	body, status = httpGet(t, link.URL)
+	require.Equal(t, http.StatusOK, status, body)
+	body, status = httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusOK, status, body)
+	u := User{}
+	require.NoError(t, json.Unmarshal([]byte(body), &u), body)
+	require.Equal(t, "$Goat", u.Name)
+}
+
+func TestOIDCDisabled(t *testing.T) {
+	mux := http.NewServeMux()
+	_, err := NewApp(&Config{DSN: ":memory:"}, mux)
+	require.NoError(t, err)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	_, status := httpGet(t, server.URL+"/api/auth/oidc/login")
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpGet(t, server.URL+"/api/auth/oidc/callback?code=a&state=b")
+	require.Equal(t, http.StatusNotFound, status)
+	_, status = httpPost(t, server.URL+"/api/auth/oidc/link", "")
+	require.Equal(t, http.StatusNotFound, status)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newFakeIdP(t, "foxtrot", "")
+	defer idp.Close()
+	p := newOIDCProvider(oidcConfig{issuer: idp.URL, clientID: "foxtrot"})
+	ctx := context.Background()
+	now := time.Unix(1600000000, 0)
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   idp.URL,
+			"sub":   "sub-1",
+			"aud":   "foxtrot",
+			"exp":   now.Unix() + 60,
+			"iat":   now.Unix(),
+			"nonce": "n0nce",
+		}
+	}
+	c, err := p.verifyIDToken(ctx, idp.sign(validClaims(), "RS256"), "n0nce", 0, now)
+	require.NoError(t, err)
+	require.Equal(t, "sub-1", c.Sub)
+
+	claims := validClaims()
+	claims["aud"] = []string{"other", "foxtrot"}
+	claims["azp"] = "foxtrot"
+	_, err = p.verifyIDToken(ctx, idp.sign(claims, "RS256"), "n0nce", 0, now)
+	require.NoError(t, err)
+
+	tests := map[string]func(map[string]interface{}){
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "https://evil.example" },
+		"audience": func(c map[string]interface{}) { c["aud"] = "other" },
+		"azp":      func(c map[string]interface{}) { c["aud"] = []string{"other", "foxtrot"} },
+		"expired":  func(c map[string]interface{}) { c["exp"] = now.Unix() },
+		"iat":      func(c map[string]interface{}) { c["iat"] = now.Unix() + 10 },
+		"nonce":    func(c map[string]interface{}) { c["nonce"] = "other" },
+		"subject":  func(c map[string]interface{}) { delete(c, "sub") },
+	}
+	for name, modify := range tests {
+		modify := modify
+		t.Run(name, func(t *testing.T) {
+			claims := validClaims()
+			modify(claims)
+			_, err := p.verifyIDToken(ctx, idp.sign(claims, "RS256"), "n0nce", 0, now)
+			requireErrIs(t, err, errIDToken)
+		})
+	}
+	_, err = p.verifyIDToken(ctx, idp.sign(validClaims(), "RS256"), "n0nce", 10*time.Second, now.Add(65*time.Second))
+	require.NoError(t, err) // leeway
+
+	token := idp.sign(validClaims(), "RS256")
+	parts := strings.Split(token, ".")
+	forged := validClaims()
+	forged["sub"] = "admin"
+	payload, err := json.Marshal(forged)
+	require.NoError(t, err)
+	forgedToken := parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+	_, err = p.verifyIDToken(ctx, forgedToken, "n0nce", 0, now)
+	requireErrIs(t, err, errIDToken)
+	_, err = p.verifyIDToken(ctx, idp.sign(validClaims(), "none"), "n0nce", 0, now)
+	requireErrIs(t, err, errIDToken)
+	_, err = p.verifyIDToken(ctx, "a.b", "n0nce", 0, now)
+	requireErrIs(t, err, errIDToken)
+}
+
+func TestOIDCDiscoveryErr(t *testing.T) {
+	idp := newFakeIdP(t, "foxtrot", "")
+	defer idp.Close()
+	p := newOIDCProvider(oidcConfig{issuer: idp.URL + "/other", clientID: "foxtrot"})
+	_, err := p.authURL(context.Background(), "state", "nonce", "verifier")
+	requireErrIs(t, err, errOIDCDiscovery)
+
+	p = newOIDCProvider(oidcConfig{issuer: idp.URL, clientID: "foxtrot", redirectURL: "http://localhost/cb"})
+	u, err := p.authURL(context.Background(), "state", "nonce", "verifier")
+	require.NoError(t, err)
+	parsed, err := url.Parse(u)
+	require.NoError(t, err)
+	require.Equal(t, pkceChallenge("verifier"), parsed.Query().Get("code_challenge"))
+	require.Equal(t, "http://localhost/cb", parsed.Query().Get("redirect_uri"))
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// RFC 7636, appendix B.
+	got := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	require.Equal(t, "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM", got)
+}
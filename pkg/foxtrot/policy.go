@@ -0,0 +1,205 @@
+package foxtrot
+
+import (
+	"bufio"
+	"crypto/sha1" //nolint:gosec // SHA-1 is the format of breached password lists
+	_ "embed"     //nolint:golint // allow blank import
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"foxygo.at/s/errs"
+	"golang.org/x/text/secure/precis"
+)
+
+//go:embed data/common_passwords.txt
+var commonPasswords string
+
+var errPolicyInit = errors.New("credential policy initialisation error")
+
+// validationError describes why a single field failed validation.
+type validationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validationErrors is returned if user name or password do not satisfy
+// the credential policy. It is returned as JSON by the API.
+type validationErrors []validationError
+
+func (v validationErrors) Error() string {
+	msgs := make([]string, len(v))
+	for i, e := range v {
+		msgs[i] = e.Field + ": " + e.Message
+	}
+	return "validation failed: " + strings.Join(msgs, ", ")
+}
+
+// credentialPolicy holds the rules user names and passwords are
+// validated against. User names are always enforced with the PRECIS
+// UsernameCasePreserved profile (RFC 8265), which normalises width and
+// Unicode composition and disallows spaces and control characters.
+// Uniqueness of user names is case-insensitive, see nameKey. The zero
+// value applies the PRECIS profile only.
+type credentialPolicy struct {
+	nameMinLen     int            // in characters after normalisation
+	nameMaxLen     int            // in characters after normalisation, 0: no limit
+	namePattern    *regexp.Regexp // nil: any name allowed by PRECIS
+	passwordMinLen int            // in characters
+	breached       map[string]bool
+}
+
+func newCredentialPolicy(cfg *Config) (credentialPolicy, error) {
+	p := credentialPolicy{
+		nameMinLen:     cfg.UsernameMinLength,
+		nameMaxLen:     cfg.UsernameMaxLength,
+		passwordMinLen: cfg.PasswordMinLength,
+	}
+	if cfg.UsernamePattern != "" {
+		re, err := regexp.Compile(cfg.UsernamePattern)
+		if err != nil {
+			return p, errs.Errorf("%v: user name pattern: %v", errPolicyInit, err)
+		}
+		p.namePattern = re
+	}
+	if err := p.loadBreached(strings.NewReader(commonPasswords)); err != nil {
+		return p, err
+	}
+	if cfg.BreachedPasswords != "" {
+		f, err := os.Open(cfg.BreachedPasswords)
+		if err != nil {
+			return p, errs.Errorf("%v: breached passwords: %v", errPolicyInit, err)
+		}
+		defer f.Close() //nolint:errcheck
+		if err := p.loadBreached(f); err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// validate checks name and password against the policy and returns
+// the normalised name.
+func (p *credentialPolicy) validate(name, password string) (string, error) {
+	name, v := p.validateName(name)
+	v = append(v, p.passwordErrs(password)...)
+	if len(v) != 0 {
+		return "", v
+	}
+	return name, nil
+}
+
+func (p *credentialPolicy) validateName(name string) (string, validationErrors) {
+	if name == "" {
+		return "", validationErrors{{Field: "name", Code: "too_short", Message: "name must not be empty"}}
+	}
+	normalised, err := precis.UsernameCasePreserved.String(name)
+	if err != nil {
+		msg := "name contains disallowed characters"
+		return "", validationErrors{{Field: "name", Code: "invalid_characters", Message: msg}}
+	}
+	var v validationErrors
+	n := utf8.RuneCountInString(normalised)
+	if n < p.nameMinLen {
+		msg := fmt.Sprintf("name must be at least %d characters long", p.nameMinLen)
+		v = append(v, validationError{Field: "name", Code: "too_short", Message: msg})
+	}
+	if p.nameMaxLen != 0 && n > p.nameMaxLen {
+		msg := fmt.Sprintf("name must be at most %d characters long", p.nameMaxLen)
+		v = append(v, validationError{Field: "name", Code: "too_long", Message: msg})
+	}
+	if p.namePattern != nil && !p.namePattern.MatchString(normalised) {
+		msg := fmt.Sprintf("name must match %s", p.namePattern)
+		v = append(v, validationError{Field: "name", Code: "invalid_characters", Message: msg})
+	}
+	return normalised, v
+}
+
+func (p *credentialPolicy) validatePassword(password string) error {
+	if v := p.passwordErrs(password); len(v) != 0 {
+		return v
+	}
+	return nil
+}
+
+func (p *credentialPolicy) passwordErrs(password string) validationErrors {
+	var v validationErrors
+	if password == "" || utf8.RuneCountInString(password) < p.passwordMinLen {
+		msg := fmt.Sprintf("password must be at least %d characters long", p.passwordMinLen)
+		if p.passwordMinLen == 0 {
+			msg = "password must not be empty"
+		}
+		v = append(v, validationError{Field: "password", Code: "too_short", Message: msg})
+	}
+	if p.breached[sha1Hex(password)] {
+		msg := "password is known from data breaches"
+		v = append(v, validationError{Field: "password", Code: "breached", Message: msg})
+	}
+	return v
+}
+
+// loadBreached adds passwords read from r to the breached password
+// list. Each line holds either a plain text password or its SHA-1 hash
+// in hex, optionally followed by ':' and a count as in the "Have I Been
+// Pwned" password lists.
+func (p *credentialPolicy) loadBreached(r io.Reader) error {
+	if p.breached == nil {
+		p.breached = map[string]bool{}
+	}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if h := strings.SplitN(line, ":", 2)[0]; isSHA1Hex(h) {
+			p.breached[strings.ToUpper(h)] = true
+			continue
+		}
+		p.breached[sha1Hex(line)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return errs.Errorf("%v: read breached passwords: %v", errPolicyInit, err)
+	}
+	return nil
+}
+
+func sha1Hex(s string) string {
+	sum := sha1.Sum([]byte(s)) //nolint:gosec // SHA-1 is the format of breached password lists
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func isSHA1Hex(s string) bool {
+	if len(s) != 2*sha1.Size {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// nameKey returns the key user names are compared by for uniqueness:
+// the PRECIS UsernameCaseMapped form, or the lower cased name if it is
+// not a valid PRECIS user name.
+func nameKey(name string) string {
+	key, err := precis.UsernameCaseMapped.String(name)
+	if err != nil {
+		return strings.ToLower(name)
+	}
+	return key
+}
+
+// normaliseName returns the PRECIS UsernameCasePreserved form user names
+// are stored in, or name unchanged if it is not a valid PRECIS user name.
+func normaliseName(name string) string {
+	normalised, err := precis.UsernameCasePreserved.String(name)
+	if err != nil {
+		return name
+	}
+	return normalised
+}
@@ -0,0 +1,100 @@
+package foxtrot
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialPolicy(t *testing.T) {
+	p := credentialPolicy{nameMinLen: 2, nameMaxLen: 8, passwordMinLen: 8}
+	require.NoError(t, p.loadBreached(strings.NewReader(commonPasswords)))
+
+	name, err := p.validate("Alice", "Pa$$w0rd")
+	require.NoError(t, err)
+	require.Equal(t, "Alice", name)
+
+	name, err = p.validate("Ａｌｉｃｅ", "Pa$$w0rd") // fullwidth
+	require.NoError(t, err)
+	require.Equal(t, "Alice", name)
+
+	name, err = p.validate("José", "Pa$$w0rd") // decomposed é
+	require.NoError(t, err)
+	require.Equal(t, "José", name)
+
+	tests := map[string]struct {
+		name     string
+		password string
+		want     validationErrors
+	}{
+		"empty name":     {"", "Pa$$w0rd", validationErrors{{Field: "name", Code: "too_short"}}},
+		"short name":     {"A", "Pa$$w0rd", validationErrors{{Field: "name", Code: "too_short"}}},
+		"long name":      {"Alice-and-Bob", "Pa$$w0rd", validationErrors{{Field: "name", Code: "too_long"}}},
+		"space":          {"Al ice", "Pa$$w0rd", validationErrors{{Field: "name", Code: "invalid_characters"}}},
+		"control":        {"Al\x07ice", "Pa$$w0rd", validationErrors{{Field: "name", Code: "invalid_characters"}}},
+		"empty password": {"Alice", "", validationErrors{{Field: "password", Code: "too_short"}}},
+		"short password": {"Alice", "Pa$$w0r", validationErrors{{Field: "password", Code: "too_short"}}},
+		"breached":       {"Alice", "password123", validationErrors{{Field: "password", Code: "breached"}}},
+		"all": {"", "qwerty", validationErrors{
+			{Field: "name", Code: "too_short"},
+			{Field: "password", Code: "too_short"},
+			{Field: "password", Code: "breached"},
+		}},
+	}
+	for name, tc := range tests {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			_, err := p.validate(tc.name, tc.password)
+			require.Error(t, err)
+			v, ok := err.(validationErrors) //nolint:errorlint
+			require.True(t, ok)
+			require.Equal(t, len(tc.want), len(v), v)
+			for i := range v {
+				require.Equal(t, tc.want[i].Field, v[i].Field)
+				require.Equal(t, tc.want[i].Code, v[i].Code)
+				require.NotEmpty(t, v[i].Message)
+			}
+		})
+	}
+}
+
+func TestCredentialPolicyPattern(t *testing.T) {
+	p := credentialPolicy{namePattern: regexp.MustCompile(`^[a-z]+$`)}
+	_, err := p.validate("alice", "x")
+	require.NoError(t, err)
+	_, err = p.validate("alice1", "x")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "name must match")
+}
+
+func TestLoadBreached(t *testing.T) {
+	p := credentialPolicy{}
+	list := strings.Join([]string{
+		"hunter2",
+		"",
+		"5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8:3861493", // password
+		"7C4A8D09CA3762AF61E59520943DC26494F8941B",         // 123456
+	}, "\n")
+	require.NoError(t, p.loadBreached(strings.NewReader(list)))
+	require.Len(t, p.breached, 3)
+	for _, pw := range []string{"hunter2", "password", "123456"} {
+		require.True(t, p.breached[sha1Hex(pw)], pw)
+	}
+	require.NoError(t, p.validatePassword("correct horse battery staple"))
+}
+
+func TestNewCredentialPolicyErr(t *testing.T) {
+	_, err := newCredentialPolicy(&Config{UsernamePattern: "("})
+	requireErrIs(t, err, errPolicyInit)
+
+	_, err = newCredentialPolicy(&Config{BreachedPasswords: "MISSING.txt"})
+	requireErrIs(t, err, errPolicyInit)
+}
+
+func TestNameKey(t *testing.T) {
+	require.Equal(t, "$fox", nameKey("$Fox"))
+	require.Equal(t, nameKey("ALICE"), nameKey("ａｌｉｃｅ"))
+	require.Equal(t, "al ice", nameKey("Al Ice")) // invalid PRECIS name
+}
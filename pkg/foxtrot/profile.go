@@ -0,0 +1,53 @@
+package foxtrot
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+	_ "time/tzdata" //nolint:golint // embed time zone database for timezone validation
+	"unicode/utf8"
+)
+
+const (
+	maxDisplayNameLen = 64   // in characters
+	maxBioLen         = 1024 // in characters
+	maxStatusLen      = 128  // in characters
+	maxUserSearch     = 20   // users returned by /api/users
+)
+
+// profileUpdate holds the user profile fields to change with PATCH
+// /api/user/NAME. nil fields are left unchanged.
+type profileUpdate struct {
+	DisplayName *string `json:"displayName"`
+	Bio         *string `json:"bio"`
+	Status      *string `json:"status"`
+	Timezone    *string `json:"timezone"` // IANA time zone name, e.g. Australia/Sydney
+}
+
+func (p *profileUpdate) validate() error {
+	var v validationErrors
+	checkLen := func(field string, s *string, max int) {
+		if s != nil && utf8.RuneCountInString(*s) > max {
+			msg := fmt.Sprintf("%s must be at most %d characters long", field, max)
+			v = append(v, validationError{Field: field, Code: "too_long", Message: msg})
+		}
+	}
+	checkLen("displayName", p.DisplayName, maxDisplayNameLen)
+	checkLen("bio", p.Bio, maxBioLen)
+	checkLen("status", p.Status, maxStatusLen)
+	if p.Timezone != nil && *p.Timezone != "" {
+		if _, err := time.LoadLocation(*p.Timezone); err != nil || *p.Timezone == "Local" {
+			msg := fmt.Sprintf("unknown time zone '%s'", *p.Timezone)
+			v = append(v, validationError{Field: "timezone", Code: "invalid", Message: msg})
+		}
+	}
+	if len(v) != 0 {
+		return v
+	}
+	return nil
+}
+
+// avatarURL returns the API URL of the avatar of user name.
+func avatarURL(name string) string {
+	return "/api/user/" + url.PathEscape(name) + "/avatar"
+}
@@ -0,0 +1,33 @@
+package foxtrot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProfileUpdateValidate(t *testing.T) {
+	str := func(s string) *string { return &s }
+	valid := profileUpdate{DisplayName: str("Fox"), Timezone: str("Australia/Sydney")}
+	require.NoError(t, valid.validate())
+	require.NoError(t, (&profileUpdate{Timezone: str("")}).validate())
+
+	invalid := profileUpdate{
+		DisplayName: str(strings.Repeat("x", maxDisplayNameLen+1)),
+		Bio:         str(strings.Repeat("x", maxBioLen+1)),
+		Status:      str(strings.Repeat("x", maxStatusLen+1)),
+		Timezone:    str("Mars/Olympus_Mons"),
+	}
+	var v validationErrors
+	require.True(t, errors.As(invalid.validate(), &v))
+	require.Len(t, v, 4)
+	require.Equal(t, "timezone", v[3].Field)
+	require.Error(t, (&profileUpdate{Timezone: str("Local")}).validate())
+}
+
+func TestAvatarURL(t *testing.T) {
+	require.Equal(t, "/api/user/$Fox/avatar", avatarURL("$Fox"))
+	require.Equal(t, "/api/user/a%2Fb/avatar", avatarURL("a/b"))
+}
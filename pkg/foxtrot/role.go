@@ -0,0 +1,206 @@
+package foxtrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"foxygo.at/s/errs"
+)
+
+var (
+	errPermission = errors.New("permission denied")
+	errBanned     = fmt.Errorf("%w: banned", errPermission)
+	errRole       = errors.New("invalid role")
+)
+
+// role is a user's privilege level, either globally (admin) or in a
+// room (owner, moderator, member). Higher roles include the privileges
+// of lower ones and global admins have every privilege in every room.
+type role int
+
+const (
+	roleNone role = iota
+	roleMember
+	roleModerator
+	roleOwner
+	roleAdmin
+)
+
+var roleNames = map[role]string{
+	roleNone:      "",
+	roleMember:    "member",
+	roleModerator: "moderator",
+	roleOwner:     "owner",
+	roleAdmin:     "admin",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+func parseRole(s string) (role, error) {
+	for r, name := range roleNames {
+		if r != roleNone && name == s {
+			return r, nil
+		}
+	}
+	return roleNone, errs.Errorf("%v: '%s'", errRole, s)
+}
+
+// Role is a role granted to a user. Room is empty for the global admin
+// role and set for all other roles.
+type Role struct {
+	Role string `json:"role"`
+	Room string `json:"room,omitempty"`
+}
+
+// validate checks that Role names a known role with a room if and only
+// if it is a room role. Conversations have participants, not roles.
+func (r Role) validate() (role, error) {
+	rl, err := parseRole(r.Role)
+	if err != nil {
+		return roleNone, err
+	}
+	if (rl == roleAdmin) != (r.Room == "") {
+		return roleNone, errs.Errorf("%v: role '%s' with room '%s'", errRole, r.Role, r.Room)
+	}
+	if isConversation(r.Room) {
+		return roleNone, errs.Errorf("%v: role in conversation '%s'", errRole, r.Room)
+	}
+	return rl, nil
+}
+
+// isAdmin reports whether user name has the global admin role, either
+// by configuration or granted in the database.
+func (a *authenticator) isAdmin(ctx context.Context, name string) (bool, error) {
+	if a.admins[name] {
+		return true, nil
+	}
+	return a.db.isAdmin(ctx, name)
+}
+
+// roleOf returns the role of u in room, or roleAdmin for global admins.
+// For room "" only the admin role is considered.
+func (a *authenticator) roleOf(ctx context.Context, u *User, room string) (role, error) {
+	admin, err := a.isAdmin(ctx, u.Name)
+	if err != nil {
+		return roleNone, err
+	}
+	if admin {
+		return roleAdmin, nil
+	}
+	if room == "" {
+		return roleNone, nil
+	}
+	r, err := a.db.getRoomRole(ctx, room, u.Name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return roleNone, nil
+		}
+		return roleNone, err
+	}
+	return parseRole(r)
+}
+
+// authorize returns an errPermission error unless u has at least role
+// min in room. It is the single permission check for API handlers and
+// the WebSocket hub.
+func (a *authenticator) authorize(ctx context.Context, u *User, room string, min role) error {
+	if min == roleNone {
+		return nil
+	}
+	r, err := a.roleOf(ctx, u, room)
+	if err != nil {
+		return err
+	}
+	if r < min {
+		return errs.Errorf("%v: '%s' requires %s role in '%s'", errPermission, u.Name, min, room)
+	}
+	return nil
+}
+
+// canAccess returns an errPermission error unless u may read and write
+// room: public rooms are open to everyone, private rooms to their
+// members and admins and conversations to their participants only.
+// Banned users may not access the room at all.
+func (a *authenticator) canAccess(ctx context.Context, u *User, room *Room) error {
+	if err := a.checkBanned(ctx, u, room.Name); err != nil {
+		return err
+	}
+	if !room.Private {
+		return nil
+	}
+	if !isConversation(room.Name) {
+		return a.authorize(ctx, u, room.Name, roleMember)
+	}
+	if _, err := a.db.getRoomRole(ctx, room.Name, u.Name); err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return errs.Errorf("%v: '%s' is not a participant of '%s'", errPermission, u.Name, room.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+// checkBanned returns an errBanned error if u is banned from room.
+func (a *authenticator) checkBanned(ctx context.Context, u *User, room string) error {
+	_, err := a.db.getSanction(ctx, room, u.Name, sanctionBan, time.Now().Unix())
+	switch {
+	case err == nil:
+		return errs.Errorf("%v: '%s' from '%s'", errBanned, u.Name, room)
+	case errors.Is(err, errDBNotFound):
+		return nil
+	}
+	return err
+}
+
+// canGrant returns an errPermission error unless granter may grant or
+// revoke r: admins may grant any role, room owners may grant member and
+// moderator roles in their room.
+func (a *authenticator) canGrant(ctx context.Context, granter *User, r Role) error {
+	rl, err := r.validate()
+	if err != nil {
+		return err
+	}
+	if rl >= roleOwner {
+		return a.authorize(ctx, granter, "", roleAdmin)
+	}
+	return a.authorize(ctx, granter, r.Room, roleOwner)
+}
+
+// grantRole grants r to user name. A user has at most one role per
+// room, granting a room role replaces the previous one.
+func (a *authenticator) grantRole(ctx context.Context, name string, r Role) error {
+	if _, err := r.validate(); err != nil {
+		return err
+	}
+	return a.db.grantRole(ctx, name, r)
+}
+
+// revokeRole revokes r from user name.
+func (a *authenticator) revokeRole(ctx context.Context, name string, r Role) error {
+	if _, err := r.validate(); err != nil {
+		return err
+	}
+	return a.db.revokeRole(ctx, name, r)
+}
+
+// GrantRole grants role to user name, in room for room roles. It is
+// intended for command line administration.
+func (app *App) GrantRole(ctx context.Context, name, role, room string) error {
+	if err := app.auth.grantRole(ctx, name, Role{Role: role, Room: room}); err != nil {
+		return fmt.Errorf("grant role: %w", err)
+	}
+	return nil
+}
+
+// RevokeRole revokes role from user name, in room for room roles. It is
+// intended for command line administration.
+func (app *App) RevokeRole(ctx context.Context, name, role, room string) error {
+	if err := app.auth.revokeRole(ctx, name, Role{Role: role, Room: room}); err != nil {
+		return fmt.Errorf("revoke role: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package foxtrot
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRole(t *testing.T) {
+	for _, r := range []role{roleMember, roleModerator, roleOwner, roleAdmin} {
+		got, err := parseRole(r.String())
+		require.NoError(t, err)
+		require.Equal(t, r, got)
+	}
+	_, err := parseRole("")
+	requireErrIs(t, err, errRole)
+	_, err = parseRole("root")
+	requireErrIs(t, err, errRole)
+}
+
+func TestRoleValidate(t *testing.T) {
+	_, err := Role{Role: "admin"}.validate()
+	require.NoError(t, err)
+	_, err = Role{Role: "member", Room: "$Shed"}.validate()
+	require.NoError(t, err)
+	_, err = Role{Role: "admin", Room: "$Shed"}.validate()
+	requireErrIs(t, err, errRole)
+	_, err = Role{Role: "owner"}.validate()
+	requireErrIs(t, err, errRole)
+	_, err = Role{Role: "member", Room: conversationPrefix + "abc"}.validate()
+	requireErrIs(t, err, errRole)
+}
+
+func TestAuthorize(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	a := authenticator{db: db, admins: map[string]bool{"root": true}}
+	for _, name := range []string{"root", "admin", "owner", "mod", "member", "other"} {
+		require.NoError(t, db.createUser(ctx, &User{Name: name, passwordHash: "###"}))
+	}
+	require.NoError(t, db.createRoom(ctx, &Room{Name: "room"}))
+	require.NoError(t, a.grantRole(ctx, "admin", Role{Role: "admin"}))
+	require.NoError(t, a.grantRole(ctx, "owner", Role{Role: "owner", Room: "room"}))
+	require.NoError(t, a.grantRole(ctx, "mod", Role{Role: "moderator", Room: "room"}))
+	require.NoError(t, a.grantRole(ctx, "member", Role{Role: "member", Room: "room"}))
+
+	want := map[string]role{
+		"root":   roleAdmin,
+		"admin":  roleAdmin,
+		"owner":  roleOwner,
+		"mod":    roleModerator,
+		"member": roleMember,
+		"other":  roleNone,
+	}
+	for name, want := range want {
+		u := &User{Name: name}
+		got, err := a.roleOf(ctx, u, "room")
+		require.NoError(t, err)
+		require.Equal(t, want, got, name)
+		for _, min := range []role{roleMember, roleModerator, roleOwner, roleAdmin} {
+			err := a.authorize(ctx, u, "room", min)
+			if want >= min {
+				require.NoError(t, err, name)
+			} else {
+				requireErrIs(t, err, errPermission)
+			}
+		}
+		require.NoError(t, a.authorize(ctx, u, "room", roleNone))
+	}
+	err := a.authorize(ctx, &User{Name: "owner"}, "", roleOwner)
+	requireErrIs(t, err, errPermission) // room roles do not apply globally
+
+	owner := &User{Name: "owner"}
+	require.NoError(t, a.canGrant(ctx, owner, Role{Role: "moderator", Room: "room"}))
+	err = a.canGrant(ctx, owner, Role{Role: "owner", Room: "room"})
+	requireErrIs(t, err, errPermission)
+	err = a.canGrant(ctx, owner, Role{Role: "member", Room: "other-room"})
+	requireErrIs(t, err, errPermission)
+	require.NoError(t, a.canGrant(ctx, &User{Name: "admin"}, Role{Role: "admin"}))
+	err = a.canGrant(ctx, owner, Role{Role: "king"})
+	requireErrIs(t, err, errRole)
+
+	require.NoError(t, a.revokeRole(ctx, "admin", Role{Role: "admin"}))
+	err = a.authorize(ctx, &User{Name: "admin"}, "room", roleMember)
+	requireErrIs(t, err, errPermission)
+}
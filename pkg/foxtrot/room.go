@@ -0,0 +1,97 @@
+package foxtrot
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/secure/precis"
+)
+
+const (
+	maxRoomNameLen    = 64          // in characters
+	maxTopicLen       = 256         // in characters
+	maxDescriptionLen = 4096        // in characters
+	maxIconLen        = 512         // in characters
+	maxSlowMode       = 6 * 60 * 60 // in seconds
+	defaultRooms      = 50          // rooms returned by /api/rooms by default
+	maxRooms          = 200         // rooms returned by /api/rooms at most
+)
+
+// validateRoomName checks a room name with the same PRECIS rules as
+// user names and returns it normalised. Names must not contain '/' as
+// they are used in /api/room/NAME paths.
+func validateRoomName(name string) (string, error) {
+	if name == "" {
+		return "", validationErrors{{Field: "name", Code: "too_short", Message: "name must not be empty"}}
+	}
+	normalised, err := precis.UsernameCasePreserved.String(name)
+	if err != nil || strings.ContainsRune(normalised, '/') {
+		msg := "name contains disallowed characters"
+		return "", validationErrors{{Field: "name", Code: "invalid_characters", Message: msg}}
+	}
+	if utf8.RuneCountInString(normalised) > maxRoomNameLen {
+		msg := fmt.Sprintf("name must be at most %d characters long", maxRoomNameLen)
+		return "", validationErrors{{Field: "name", Code: "too_long", Message: msg}}
+	}
+	return normalised, nil
+}
+
+// validIcon returns whether a room icon is empty, an emoji or an
+// absolute http or https URL, so that clients can use it as image
+// source without further checks.
+func validIcon(icon string) bool {
+	if icon == "" || validateEmoji(icon) == nil {
+		return true
+	}
+	u, err := url.Parse(icon)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// roomUpdate holds the room fields to set on creation with POST
+// /api/room or to change with PATCH /api/room/NAME. nil fields are left
+// unchanged.
+type roomUpdate struct {
+	Name        *string       `json:"name"` // rename
+	Topic       *string       `json:"topic"`
+	Description *string       `json:"description"`
+	Icon        *string       `json:"icon"`
+	Settings    *RoomSettings `json:"settings"`
+	Private     *bool         `json:"private"`
+}
+
+// validate checks the non-nil fields and normalises the name.
+func (ru *roomUpdate) validate() error {
+	var v validationErrors
+	if ru.Name != nil {
+		name, err := validateRoomName(*ru.Name)
+		var nameErrs validationErrors
+		if errors.As(err, &nameErrs) {
+			v = append(v, nameErrs...)
+		}
+		ru.Name = &name
+	}
+	checkLen := func(field string, s *string, max int) {
+		if s != nil && utf8.RuneCountInString(*s) > max {
+			msg := fmt.Sprintf("%s must be at most %d characters long", field, max)
+			v = append(v, validationError{Field: field, Code: "too_long", Message: msg})
+		}
+	}
+	checkLen("topic", ru.Topic, maxTopicLen)
+	checkLen("description", ru.Description, maxDescriptionLen)
+	checkLen("icon", ru.Icon, maxIconLen)
+	if ru.Icon != nil && !validIcon(*ru.Icon) {
+		msg := "icon must be an emoji or an http or https URL"
+		v = append(v, validationError{Field: "icon", Code: "invalid", Message: msg})
+	}
+	if ru.Settings != nil && (ru.Settings.SlowMode < 0 || ru.Settings.SlowMode > maxSlowMode) {
+		msg := fmt.Sprintf("slow mode must be between 0 and %d seconds", maxSlowMode)
+		v = append(v, validationError{Field: "settings.slowMode", Code: "invalid", Message: msg})
+	}
+	if len(v) != 0 {
+		return v
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package foxtrot
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRoomName(t *testing.T) {
+	name, err := validateRoomName("$Kitchen")
+	require.NoError(t, err)
+	require.Equal(t, "$Kitchen", name)
+	name, err = validateRoomName("Ｋitchen") // fullwidth K
+	require.NoError(t, err)
+	require.Equal(t, "Kitchen", name)
+
+	for in, code := range map[string]string{
+		"":                                    "too_short",
+		"a/b":                                 "invalid_characters",
+		"a b":                                 "invalid_characters",
+		"a\x00":                               "invalid_characters",
+		strings.Repeat("x", maxRoomNameLen+1): "too_long",
+	} {
+		_, err := validateRoomName(in)
+		var v validationErrors
+		require.True(t, errors.As(err, &v), in)
+		require.Equal(t, code, v[0].Code, in)
+	}
+}
+
+func TestRoomUpdateValidate(t *testing.T) {
+	name, topic := "Ｋitchen", "Food"
+	ru := roomUpdate{Name: &name, Topic: &topic, Settings: &RoomSettings{SlowMode: 60}}
+	require.NoError(t, ru.validate())
+	require.Equal(t, "Kitchen", *ru.Name)
+	require.NoError(t, (&roomUpdate{}).validate())
+
+	name, long := "a/b", strings.Repeat("x", maxTopicLen+1)
+	ru = roomUpdate{Name: &name, Topic: &long, Settings: &RoomSettings{SlowMode: maxSlowMode + 1}}
+	var v validationErrors
+	require.True(t, errors.As(ru.validate(), &v))
+	fields := make([]string, len(v))
+	for i, e := range v {
+		fields[i] = e.Field
+	}
+	require.Equal(t, []string{"name", "topic", "settings.slowMode"}, fields)
+}
+
+func TestValidIcon(t *testing.T) {
+	for _, icon := range []string{
+		"",
+		"🍳",
+		"👨‍👩‍👧‍👦",
+		"https://example.com/kitchen.png",
+		"http://example.com/kitchen.png",
+	} {
+		require.True(t, validIcon(icon), icon)
+	}
+	for _, icon := range []string{
+		"javascript:alert(1)",
+		"data:image/svg+xml,<svg/>",
+		"//example.com/a.png",
+		"/api/user/$Fox/avatar",
+		"https://",
+		"kitchen",
+	} {
+		require.False(t, validIcon(icon), icon)
+	}
+}
@@ -0,0 +1,94 @@
+package foxtrot
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	sessionCookie = "foxtrot_session" // JWT, not accessible by JS
+	csrfCookie    = "foxtrot_csrf"    // CSRF token, read by JS and sent back in csrfHeader
+	csrfHeader    = "X-CSRF-Token"
+)
+
+var errCSRF = errors.New("missing or invalid CSRF token")
+
+// cookieSessions configures the optional cookie session mode for
+// browsers. On login the JWT is set as HttpOnly cookie instead of being
+// returned in the response body, so that it cannot be stolen by XSS.
+// State-changing requests authenticated by cookie must pass the value
+// of the CSRF cookie in the X-CSRF-Token header (double-submit cookie).
+type cookieSessions struct {
+	sameSite http.SameSite
+	insecure bool // allow cookies over plain HTTP, for development only
+}
+
+func newCookieSessions(sameSite string, insecure bool) (*cookieSessions, error) {
+	c := &cookieSessions{insecure: insecure}
+	switch sameSite {
+	case "", "lax":
+		c.sameSite = http.SameSiteLaxMode
+	case "strict":
+		c.sameSite = http.SameSiteStrictMode
+	default:
+		return nil, fmt.Errorf("unknown SameSite cookie mode '%s'", sameSite)
+	}
+	return c, nil
+}
+
+// setSession sets the session cookie holding jwt and a new CSRF token
+// cookie, both expiring at expires.
+func (c *cookieSessions) setSession(w http.ResponseWriter, jwt string, expires time.Time) error {
+	csrf, err := newRandomToken()
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, c.cookie(sessionCookie, jwt, expires, true))
+	http.SetCookie(w, c.cookie(csrfCookie, csrf, expires, false))
+	return nil
+}
+
+// clearSession removes session and CSRF cookie.
+func (c *cookieSessions) clearSession(w http.ResponseWriter) {
+	http.SetCookie(w, c.cookie(sessionCookie, "", time.Unix(0, 0), true))
+	http.SetCookie(w, c.cookie(csrfCookie, "", time.Unix(0, 0), false))
+}
+
+func (c *cookieSessions) cookie(name, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	cookie := &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: httpOnly,
+		Secure:   !c.insecure,
+		SameSite: c.sameSite,
+	}
+	if value == "" {
+		cookie.MaxAge = -1
+	}
+	return cookie
+}
+
+// sessionToken returns the JWT of the request's session cookie or ""
+// if there is none. For state-changing requests the CSRF header must
+// match the CSRF cookie.
+func (c *cookieSessions) sessionToken(r *http.Request) (string, error) {
+	session, err := r.Cookie(sessionCookie)
+	if err != nil || session.Value == "" {
+		return "", nil //nolint:nilerr // no session cookie is not an error
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return session.Value, nil
+	}
+	csrf, err := r.Cookie(csrfCookie)
+	header := r.Header.Get(csrfHeader)
+	if err != nil || csrf.Value == "" || subtle.ConstantTimeCompare([]byte(csrf.Value), []byte(header)) != 1 {
+		return "", errCSRF
+	}
+	return session.Value, nil
+}
@@ -0,0 +1,65 @@
+package foxtrot
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCookieSessions(t *testing.T) {
+	c, err := newCookieSessions("strict", false)
+	require.NoError(t, err)
+	require.Equal(t, http.SameSiteStrictMode, c.sameSite)
+	_, err = newCookieSessions("none", false)
+	require.Error(t, err)
+}
+
+func TestSessionCookies(t *testing.T) {
+	c, err := newCookieSessions("lax", false)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	require.NoError(t, c.setSession(w, "JWT", time.Now().Add(time.Hour)))
+	cookies := w.Result().Cookies() //nolint:bodyclose
+	require.Len(t, cookies, 2)
+	session, csrf := cookies[0], cookies[1]
+	require.Equal(t, sessionCookie, session.Name)
+	require.Equal(t, "JWT", session.Value)
+	require.True(t, session.HttpOnly)
+	require.True(t, session.Secure)
+	require.Equal(t, http.SameSiteLaxMode, session.SameSite)
+	require.Equal(t, csrfCookie, csrf.Name)
+	require.False(t, csrf.HttpOnly)
+	require.NotEmpty(t, csrf.Value)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	token, err := c.sessionToken(r)
+	require.NoError(t, err)
+	require.Empty(t, token)
+
+	r.AddCookie(session)
+	r.AddCookie(csrf)
+	token, err = c.sessionToken(r)
+	require.NoError(t, err)
+	require.Equal(t, "JWT", token)
+
+	r.Method = http.MethodPost
+	_, err = c.sessionToken(r)
+	require.Equal(t, errCSRF, err)
+	r.Header.Set(csrfHeader, "WRONG")
+	_, err = c.sessionToken(r)
+	require.Equal(t, errCSRF, err)
+	r.Header.Set(csrfHeader, csrf.Value)
+	token, err = c.sessionToken(r)
+	require.NoError(t, err)
+	require.Equal(t, "JWT", token)
+
+	w = httptest.NewRecorder()
+	c.clearSession(w)
+	for _, cookie := range w.Result().Cookies() { //nolint:bodyclose
+		require.Empty(t, cookie.Value)
+		require.Equal(t, -1, cookie.MaxAge)
+	}
+}
@@ -1,12 +1,12 @@
-INSERT INTO rooms (name) VALUES
-	('$Kitchen'),
-	('$Shed');
+INSERT INTO rooms (name, name_key) VALUES
+	('$Kitchen', '$kitchen'),
+	('$Shed', '$shed');
 
-INSERT INTO users (name, password_hash) VALUES
-	('$Fox', '$2a$10$V5.UzTYmeYh.bPz51WiIH.Yp2KawEqEmgF/amTTXtOHBvcjkFuIrC'),   -- Password: Pa$$w0rd
-	('$Goat', '$2a$10$Rp2rFH12j0Ovc8VUfJKEX.O2SKHDpHs1b6KBkCqluzSMOowuDagk2'),  -- Password: $s3cr37
-	('$Cat', '$2a$10$V5.UzTYmeYh.bPz51WiIH.Yp2KawEqEmgF/amTTXtOHBvcjkFuIrC'),   -- Password: Pa$$w0rd
-	('$Camel', '$2a$10$Rp2rFH12j0Ovc8VUfJKEX.O2SKHDpHs1b6KBkCqluzSMOowuDagk2'); -- Password: $s3cr37
+INSERT INTO users (name, name_key, password_hash) VALUES
+	('$Fox', '$fox', '$2a$10$V5.UzTYmeYh.bPz51WiIH.Yp2KawEqEmgF/amTTXtOHBvcjkFuIrC'),       -- Password: Pa$$w0rd
+	('$Goat', '$goat', '$2a$10$Rp2rFH12j0Ovc8VUfJKEX.O2SKHDpHs1b6KBkCqluzSMOowuDagk2'),     -- Password: $s3cr37
+	('$Cat', '$cat', '$2a$10$V5.UzTYmeYh.bPz51WiIH.Yp2KawEqEmgF/amTTXtOHBvcjkFuIrC'),       -- Password: Pa$$w0rd
+	('$Camel', '$camel', '$2a$10$Rp2rFH12j0Ovc8VUfJKEX.O2SKHDpHs1b6KBkCqluzSMOowuDagk2');   -- Password: $s3cr37
 
 INSERT INTO messages (id, content, created_at, room, author) VALUES
 	(1, 'Hi', '2020-11-22T11:11:11Z', '$Kitchen', '$Goat'),
@@ -1,23 +1,194 @@
 CREATE TABLE users (
 	name          TEXT PRIMARY KEY CHECK(name <> ''),
+	name_key      TEXT NOT NULL UNIQUE, -- case mapped name for case-insensitive uniqueness
 	password_hash TEXT NOT NULL CHECK(password_hash <> ''),
-	avatar        BLOB
+	avatar        BLOB,
+	display_name  TEXT NOT NULL DEFAULT '',
+	bio           TEXT NOT NULL DEFAULT '',
+	status        TEXT NOT NULL DEFAULT '', -- status text, e.g. "on holidays"
+	timezone      TEXT NOT NULL DEFAULT '', -- IANA time zone name
+	session_gen   INTEGER NOT NULL DEFAULT 0 -- incremented to revoke issued JWTs
+);
+
+-- Tombstone author of messages by deleted users, cannot log in.
+INSERT INTO users (name, name_key, password_hash) VALUES ('[deleted]', '[deleted]', '!');
+
+-- Smaller sizes of uploaded avatars, generated on upload. The full
+-- size avatar is stored in users.avatar.
+CREATE TABLE avatar_thumbnails (
+	name  TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	size  INTEGER NOT NULL, -- width and height in pixels
+	image BLOB NOT NULL, -- PNG
+	PRIMARY KEY(name, size)
+);
+
+-- Deleted users' last session generation so that JWTs issued to them
+-- are not valid for a new user of the same name.
+CREATE TABLE deleted_users (
+	name_key    TEXT PRIMARY KEY,
+	session_gen INTEGER NOT NULL
 );
 
 CREATE TABLE rooms (
-	name TEXT PRIMARY KEY CHECK(name <> '')
+	name         TEXT PRIMARY KEY CHECK(name <> ''),
+	name_key     TEXT NOT NULL UNIQUE, -- case mapped name for case-insensitive uniqueness
+	topic        TEXT NOT NULL DEFAULT '',
+	description  TEXT NOT NULL DEFAULT '',
+	icon         TEXT NOT NULL DEFAULT '', -- emoji or image URL
+	created_by   TEXT REFERENCES users(name) ON DELETE SET NULL,
+	created_at   TEXT NOT NULL DEFAULT '', -- rfc3339, empty for sample rooms
+	settings     TEXT NOT NULL DEFAULT '{}', -- JSON encoded RoomSettings
+	private      INTEGER NOT NULL DEFAULT 0, -- boolean, only members can read and write private rooms
+	archived_at  TEXT NOT NULL DEFAULT '', -- rfc3339, empty unless archived
+	-- Direct message conversations are private rooms listed and
+	-- accessed by their participants only.
+	conversation INTEGER NOT NULL DEFAULT 0, -- boolean
+	participants TEXT UNIQUE -- sorted, newline separated, NULL once a participant is deleted
 );
 
+-- Deleted messages are kept as tombstones without content so that
+-- their IDs remain valid history cursors.
 CREATE TABLE messages (
 	id         INTEGER PRIMARY KEY,
-	content    TEXT NOT NULL CHECK(content <> ''),
+	content    TEXT NOT NULL CHECK(content <> '' OR deleted_at <> ''),
 	created_at TEXT NOT NULL CHECK(created_at <> ''), -- rfc3339: 2019-10-25T07:55:50Z
-	room       TEXT NOT NULL REFERENCES rooms(name),
-	author     TEXT NOT NULL REFERENCES users(name)
+	room       TEXT NOT NULL REFERENCES rooms(name) ON DELETE CASCADE ON UPDATE CASCADE,
+	author     TEXT NOT NULL REFERENCES users(name),
+	edited_at  TEXT NOT NULL DEFAULT '', -- rfc3339, empty unless edited
+	deleted_at TEXT NOT NULL DEFAULT '', -- rfc3339, empty unless deleted
+	deleted_by TEXT REFERENCES users(name), -- author or moderator, NULL unless deleted
+	-- Replies reference the top-level message starting their thread.
+	-- They become top-level messages if it is removed.
+	parent     INTEGER REFERENCES messages(id) ON DELETE SET NULL
+);
+
+CREATE INDEX messages_parent ON messages(parent);
+
+-- Prior versions of edited messages.
+CREATE TABLE message_edits (
+	id          INTEGER PRIMARY KEY,
+	message     INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+	content     TEXT NOT NULL CHECK(content <> ''),
+	replaced_at TEXT NOT NULL CHECK(replaced_at <> '') -- rfc3339
+);
+
+CREATE TABLE reactions (
+	message    INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+	name       TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	emoji      TEXT NOT NULL CHECK(emoji <> ''),
+	created_at TEXT NOT NULL CHECK(created_at <> ''), -- rfc3339
+	PRIMARY KEY(message, name, emoji)
+);
+
+CREATE TABLE login_failures (
+	id         INTEGER PRIMARY KEY,
+	name       TEXT NOT NULL, -- not a reference, unknown user names are recorded too
+	ip         TEXT NOT NULL,
+	created_at TEXT NOT NULL CHECK(created_at <> '') -- rfc3339
+);
+
+CREATE TABLE password_resets (
+	token_hash TEXT PRIMARY KEY CHECK(token_hash <> ''), -- hex encoded sha256
+	name       TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	expires_at INTEGER NOT NULL -- unix epoche seconds
+);
+
+CREATE TABLE totp (
+	name      TEXT PRIMARY KEY REFERENCES users(name) ON DELETE CASCADE,
+	secret    TEXT NOT NULL CHECK(secret <> ''), -- base32
+	confirmed INTEGER NOT NULL DEFAULT 0, -- boolean, TOTP is only enforced once confirmed
+	last_step INTEGER NOT NULL DEFAULT 0 -- last used time step, codes cannot be reused
+);
+
+CREATE TABLE recovery_codes (
+	name      TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL CHECK(code_hash <> ''), -- hex encoded sha256
+	PRIMARY KEY(name, code_hash)
+);
+
+CREATE TABLE login_challenges (
+	challenge_hash TEXT PRIMARY KEY CHECK(challenge_hash <> ''), -- hex encoded sha256
+	name           TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	expires_at     INTEGER NOT NULL, -- unix epoche seconds
+	attempts       INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE oidc_logins (
+	state_hash TEXT PRIMARY KEY CHECK(state_hash <> ''), -- hex encoded sha256
+	nonce      TEXT NOT NULL,
+	verifier   TEXT NOT NULL, -- PKCE code verifier
+	link_name  TEXT NOT NULL DEFAULT '', -- user to link the identity to, '' for sign-on
+	expires_at INTEGER NOT NULL -- unix epoche seconds
+);
+
+CREATE TABLE oidc_identities (
+	issuer  TEXT NOT NULL,
+	subject TEXT NOT NULL,
+	name    TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	PRIMARY KEY(issuer, subject)
+);
+
+CREATE TABLE access_tokens (
+	id           INTEGER PRIMARY KEY,
+	name         TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	token_name   TEXT NOT NULL CHECK(token_name <> ''),
+	token_hash   TEXT NOT NULL UNIQUE CHECK(token_hash <> ''), -- hex encoded sha256
+	scopes       TEXT NOT NULL, -- space separated
+	created_at   TEXT NOT NULL CHECK(created_at <> ''), -- rfc3339
+	last_used_at TEXT, -- rfc3339, NULL if never used
+	UNIQUE(name, token_name)
+);
+
+CREATE TABLE admins (
+	name TEXT PRIMARY KEY REFERENCES users(name) ON DELETE CASCADE
+);
+
+-- Room members with their role in the room.
+CREATE TABLE room_members (
+	room      TEXT NOT NULL REFERENCES rooms(name) ON DELETE CASCADE ON UPDATE CASCADE,
+	name      TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	role      TEXT NOT NULL CHECK(role IN ('member', 'moderator', 'owner')),
+	joined_at TEXT NOT NULL DEFAULT '', -- rfc3339, empty for members granted a role by admins
+	PRIMARY KEY(room, name)
+);
+
+CREATE TABLE room_invites (
+	id         INTEGER PRIMARY KEY,
+	room       TEXT NOT NULL REFERENCES rooms(name) ON DELETE CASCADE ON UPDATE CASCADE,
+	token_hash TEXT NOT NULL UNIQUE CHECK(token_hash <> ''), -- hex encoded sha256
+	created_by TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	created_at TEXT NOT NULL CHECK(created_at <> ''), -- rfc3339
+	expires_at INTEGER NOT NULL DEFAULT 0, -- unix epoche seconds, 0: never
+	max_uses   INTEGER NOT NULL DEFAULT 0, -- 0: unlimited
+	uses       INTEGER NOT NULL DEFAULT 0
+);
+
+-- Active and expired bans and mutes of users in rooms.
+CREATE TABLE room_sanctions (
+	room       TEXT NOT NULL REFERENCES rooms(name) ON DELETE CASCADE ON UPDATE CASCADE,
+	name       TEXT NOT NULL REFERENCES users(name) ON DELETE CASCADE,
+	kind       TEXT NOT NULL CHECK(kind IN ('ban', 'mute')),
+	moderator  TEXT NOT NULL,
+	reason     TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL CHECK(created_at <> ''), -- rfc3339
+	expires_at INTEGER NOT NULL DEFAULT 0, -- unix epoche seconds, 0: never
+	PRIMARY KEY(room, name, kind)
+);
+
+-- User names are not references, entries outlive the users involved.
+CREATE TABLE moderation_log (
+	id         INTEGER PRIMARY KEY,
+	room       TEXT NOT NULL REFERENCES rooms(name) ON DELETE CASCADE ON UPDATE CASCADE,
+	moderator  TEXT NOT NULL,
+	name       TEXT NOT NULL, -- user acted on
+	action     TEXT NOT NULL CHECK(action IN ('kick', 'ban', 'unban', 'mute', 'unmute')),
+	reason     TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL CHECK(created_at <> ''), -- rfc3339
+	expires_at INTEGER NOT NULL DEFAULT 0 -- of bans and mutes, unix epoche seconds, 0: never
 );
 
 CREATE TABLE schema (
 	version TEXT PRIMARY KEY CHECK(version <> '')
 );
 
-INSERT INTO schema VALUES ('v0.0.1');
+INSERT INTO schema VALUES ('v0.0.11');
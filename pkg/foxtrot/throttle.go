@@ -0,0 +1,139 @@
+package foxtrot
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var errLoginThrottled = errors.New("too many failed login attempts")
+
+// throttleError is returned by login when further attempts for an
+// account or client IP are temporarily blocked.
+type throttleError struct {
+	retryAfter time.Duration
+}
+
+func (e *throttleError) Error() string {
+	return fmt.Sprintf("%v: retry after %v", errLoginThrottled, e.retryAfter)
+}
+
+func (e *throttleError) Is(target error) bool {
+	return target == errLoginThrottled
+}
+
+// loginThrottle tracks failed login attempts by key, e.g. account name
+// or client IP. Keys recorded with fail have to wait before the next
+// attempt after every failure, starting at backoff and doubling with
+// each consecutive failure. Keys recorded with count only have their
+// failures counted within a window of lockout duration, after which the
+// count starts over. Once a key reaches its maximum number of failures
+// it is locked out for the lockout duration. A key is forgotten after a
+// quiet period of lockout duration past its last wait or window start.
+// The zero value never throttles.
+type loginThrottle struct {
+	backoff time.Duration
+	lockout time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*throttleEntry
+}
+
+type throttleEntry struct {
+	failures int
+	since    time.Time // start of the counting window
+	until    time.Time // no attempts allowed before this time
+}
+
+// wait returns how long a client has to wait before the next login
+// attempt is allowed for any of the given keys.
+func (t *loginThrottle) wait(now time.Time, keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var wait time.Duration
+	for _, key := range keys {
+		e, ok := t.entries[key]
+		if !ok {
+			continue
+		}
+		if d := e.until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// fail records a failed login attempt for key. maxFailures of 0 means
+// key is never locked out, though backoff still applies.
+func (t *loginThrottle) fail(now time.Time, key string, maxFailures int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(now, key)
+	e.failures++
+	if maxFailures > 0 && e.failures >= maxFailures {
+		e.until = now.Add(t.lockout)
+		return
+	}
+	d := t.backoff << (e.failures - 1)
+	if d > t.lockout || d < t.backoff { // capped or overflown
+		d = t.lockout
+	}
+	e.until = now.Add(d)
+}
+
+// count records a failed login attempt for key without backoff, for
+// keys shared by many clients such as client IPs, where backoff would
+// block all of them after a few failures. The count starts over once
+// the window of lockout duration since the first counted failure has
+// passed. maxFailures of 0 means key is never locked out.
+func (t *loginThrottle) count(now time.Time, key string, maxFailures int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.entry(now, key)
+	if now.Sub(e.since) >= t.lockout {
+		e.failures = 0
+		e.since = now
+	}
+	e.failures++
+	if maxFailures > 0 && e.failures >= maxFailures {
+		e.until = now.Add(t.lockout)
+	}
+}
+
+// entry returns the entry for key, creating it if needed, after
+// sweeping quiet entries. It must be called with t.mu held.
+func (t *loginThrottle) entry(now time.Time, key string) *throttleEntry {
+	t.sweep(now)
+	if t.entries == nil {
+		t.entries = map[string]*throttleEntry{}
+	}
+	e, ok := t.entries[key]
+	if !ok {
+		e = &throttleEntry{since: now}
+		t.entries[key] = e
+	}
+	return e
+}
+
+// reset forgets all failed attempts for key, e.g. after a successful
+// login.
+func (t *loginThrottle) reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// sweep removes entries that have been quiet for the lockout duration.
+// It must be called with t.mu held.
+func (t *loginThrottle) sweep(now time.Time) {
+	for key, e := range t.entries {
+		last := e.until
+		if e.since.After(last) {
+			last = e.since
+		}
+		if now.After(last.Add(t.lockout)) {
+			delete(t.entries, key)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package foxtrot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	th := loginThrottle{backoff: time.Second, lockout: time.Minute}
+	now := time.Unix(1613555000, 0)
+
+	require.Equal(t, time.Duration(0), th.wait(now, "a"))
+	th.fail(now, "a", 4)
+	require.Equal(t, time.Second, th.wait(now, "a"))
+	require.Equal(t, time.Duration(0), th.wait(now, "b"))
+	require.Equal(t, time.Second, th.wait(now, "a", "b"))
+
+	th.fail(now, "a", 4)
+	require.Equal(t, 2*time.Second, th.wait(now, "a"))
+	th.fail(now, "a", 4)
+	require.Equal(t, 4*time.Second, th.wait(now, "a"))
+	th.fail(now, "a", 4)
+	require.Equal(t, time.Minute, th.wait(now, "a"))
+	require.Equal(t, time.Duration(0), th.wait(now.Add(time.Minute), "a"))
+
+	th.reset("a")
+	require.Equal(t, time.Duration(0), th.wait(now, "a"))
+}
+
+func TestLoginThrottleBackoffCap(t *testing.T) {
+	th := loginThrottle{backoff: time.Second, lockout: 5 * time.Second}
+	now := time.Unix(1613555000, 0)
+	for i := 0; i < 100; i++ {
+		th.fail(now, "a", 0)
+	}
+	require.Equal(t, 5*time.Second, th.wait(now, "a"))
+}
+
+func TestLoginThrottleSweep(t *testing.T) {
+	th := loginThrottle{backoff: time.Second, lockout: time.Minute}
+	now := time.Unix(1613555000, 0)
+	th.fail(now, "a", 0)
+	th.fail(now, "a", 0)
+	require.Len(t, th.entries, 1)
+
+	later := now.Add(2 * time.Minute)
+	th.fail(later, "b", 0)
+	require.Len(t, th.entries, 1)
+	th.fail(later, "a", 0)
+	require.Equal(t, time.Second, th.wait(later, "a"))
+}
+
+func TestLoginThrottleCount(t *testing.T) {
+	th := loginThrottle{backoff: time.Second, lockout: time.Minute}
+	now := time.Unix(1613555000, 0)
+
+	th.count(now, "ip", 3)
+	th.count(now.Add(time.Second), "ip", 3)
+	require.Equal(t, time.Duration(0), th.wait(now.Add(time.Second), "ip"))
+
+	// count starts over after the window
+	later := now.Add(time.Minute)
+	th.count(later, "ip", 3)
+	th.count(later, "ip", 3)
+	require.Equal(t, time.Duration(0), th.wait(later, "ip"))
+	th.count(later, "ip", 3)
+	require.Equal(t, time.Minute, th.wait(later, "ip"))
+	require.Equal(t, time.Duration(0), th.wait(later.Add(time.Minute), "ip"))
+
+	th.count(now, "unlimited", 0)
+	require.Equal(t, time.Duration(0), th.wait(now, "unlimited"))
+}
+
+func TestLoginThrottleZero(t *testing.T) {
+	th := loginThrottle{}
+	now := time.Now()
+	th.fail(now, "a", 0)
+	th.fail(now, "a", 1)
+	th.count(now, "b", 1)
+	require.Equal(t, time.Duration(0), th.wait(now, "a", "b"))
+}
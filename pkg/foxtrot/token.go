@@ -0,0 +1,134 @@
+package foxtrot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"foxygo.at/s/errs"
+)
+
+// accessTokenPrefix distinguishes personal access tokens from JWTs, so
+// that both can be passed as bearer token.
+const accessTokenPrefix = "ftp_"
+
+// Scopes of personal access tokens. Users authenticated with a JWT
+// have all scopes.
+const (
+	scopeHistoryRead   = "history:read"
+	scopeMessagesWrite = "messages:write"
+	scopeAccountWrite  = "account:write" // password, two-factor authentication and token management
+	scopeRoomsWrite    = "rooms:write"   // create, change, join and leave rooms, manage invites
+)
+
+var (
+	errAccessToken = fmt.Errorf("%w: invalid access token", errAuth)
+	errScope       = fmt.Errorf("%w: insufficient token scope", errAuth)
+
+	knownScopes = map[string]bool{
+		scopeHistoryRead:   true,
+		scopeMessagesWrite: true,
+		scopeAccountWrite:  true,
+		scopeRoomsWrite:    true,
+	}
+)
+
+// AccessToken is a long-lived, named and scoped personal access token
+// for bots and scripts. Token is only set on creation, only its hash is
+// stored.
+type AccessToken struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"createdAt"`
+	LastUsedAt string   `json:"lastUsedAt,omitempty"`
+	Token      string   `json:"token,omitempty"`
+}
+
+// validateAccessToken checks token name and scopes and returns the
+// scopes sorted and de-duplicated.
+func validateAccessToken(name string, scopes []string) ([]string, error) {
+	var v validationErrors
+	if strings.TrimSpace(name) == "" {
+		v = append(v, validationError{Field: "name", Code: "too_short", Message: "name must not be empty"})
+	}
+	set := map[string]bool{}
+	for _, s := range scopes {
+		if !knownScopes[s] {
+			msg := fmt.Sprintf("unknown scope '%s'", s)
+			v = append(v, validationError{Field: "scopes", Code: "invalid", Message: msg})
+		}
+		set[s] = true
+	}
+	if len(scopes) == 0 {
+		v = append(v, validationError{Field: "scopes", Code: "too_short", Message: "scopes must not be empty"})
+	}
+	if len(v) != 0 {
+		return nil, v
+	}
+	sorted := make([]string, 0, len(set))
+	for s := range set {
+		sorted = append(sorted, s)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// createAccessToken creates a personal access token for user name.
+func (a *authenticator) createAccessToken(ctx context.Context, name, tokenName string,
+	scopes []string) (*AccessToken, error) {
+	scopes, err := validateAccessToken(tokenName, scopes)
+	if err != nil {
+		return nil, err
+	}
+	token, err := newRandomToken()
+	if err != nil {
+		return nil, err
+	}
+	token = accessTokenPrefix + token
+	t := &AccessToken{Name: tokenName, Scopes: scopes, CreatedAt: now(), Token: token}
+	if err := a.db.createAccessToken(ctx, name, hashToken(token), t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// authenticateAccessToken returns the user the given personal access
+// token was issued to, with the token's scopes. The token's last used
+// time is updated.
+func (a *authenticator) authenticateAccessToken(ctx context.Context, token string) (*User, error) {
+	name, scopes, err := a.db.useAccessToken(ctx, hashToken(token), now())
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil, errs.New(errAccessToken, err)
+		}
+		return nil, err
+	}
+	u, err := a.db.getUser(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	u.scopes = scopes
+	return u, nil
+}
+
+// hasScope reports whether u was authenticated with the given scope.
+// Users authenticated with a JWT have all scopes and the empty scope is
+// granted to everyone.
+func (u *User) hasScope(scope string) bool {
+	if u.scopes == nil || scope == "" {
+		return true
+	}
+	for _, s := range u.scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func isAccessToken(token string) bool {
+	return strings.HasPrefix(token, accessTokenPrefix)
+}
@@ -0,0 +1,60 @@
+package foxtrot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateAccessToken(t *testing.T) {
+	scopes, err := validateAccessToken("bot", []string{"messages:write", "history:read", "messages:write"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"history:read", "messages:write"}, scopes)
+
+	_, err = validateAccessToken(" ", []string{"admin"})
+	var v validationErrors
+	require.True(t, errors.As(err, &v))
+	require.Equal(t, []string{"too_short", "invalid"}, []string{v[0].Code, v[1].Code})
+	_, err = validateAccessToken("bot", nil)
+	require.True(t, errors.As(err, &v))
+	require.Equal(t, "scopes", v[0].Field)
+}
+
+func TestAccessTokenAuthenticate(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	a := authenticator{db: db, secret: []byte("$$$$$hhh!")}
+	require.NoError(t, db.createUser(ctx, &User{Name: "alice", passwordHash: "###"}))
+
+	tok, err := a.createAccessToken(ctx, "alice", "bot", []string{scopeHistoryRead})
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(tok.Token, accessTokenPrefix))
+	_, err = a.createAccessToken(ctx, "alice", "bot", []string{scopeHistoryRead})
+	requireErrIs(t, err, errDBDuplicate)
+
+	u, err := a.authenticate(ctx, tok.Token)
+	require.NoError(t, err)
+	require.Equal(t, "alice", u.Name)
+	require.True(t, u.hasScope(scopeHistoryRead))
+	require.False(t, u.hasScope(scopeAccountWrite))
+	tokens, err := db.queryAccessTokens(ctx, "alice")
+	require.NoError(t, err)
+	require.Len(t, tokens, 1)
+	require.NotEmpty(t, tokens[0].LastUsedAt)
+	require.Empty(t, tokens[0].Token)
+
+	_, err = a.authenticate(ctx, accessTokenPrefix+"MISSING")
+	requireErrIs(t, err, errAccessToken)
+	require.NoError(t, db.deleteAccessToken(ctx, "alice", tok.ID))
+	_, err = a.authenticate(ctx, tok.Token)
+	requireErrIs(t, err, errAuth)
+
+	jwtUser, err := a.authenticate(ctx, a.newJWT(&User{Name: "alice"}))
+	require.NoError(t, err)
+	require.True(t, jwtUser.hasScope(scopeAccountWrite))
+}
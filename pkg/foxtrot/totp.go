@@ -0,0 +1,311 @@
+// This file contains a TOTP (Time-Based One-Time Password)
+// implementation as described in RFC 6238 with the defaults used by
+// common authenticator apps: HMAC-SHA1, 6 digits and a 30 second time
+// step.
+
+package foxtrot
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1" //nolint:gosec // HMAC-SHA1 is the RFC 6238 default supported by all authenticator apps
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"foxygo.at/s/errs"
+	"rsc.io/qr"
+)
+
+var (
+	errTOTP           = errors.New("TOTP error")
+	errTOTPCode       = fmt.Errorf("%w: invalid code", errTOTP)
+	errTOTPEnrolled   = fmt.Errorf("%w: already enrolled", errTOTP)
+	errTOTPNotEnabled = fmt.Errorf("%w: not enabled", errTOTP)
+	errChallenge      = fmt.Errorf("%w: invalid or expired login challenge", errAuth)
+
+	base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+const (
+	totpStep          = 30 * time.Second
+	totpDigits        = 6
+	totpSkew          = 1 // number of time steps accepted before and after the current one
+	recoveryCodeCount = 10
+	challengeTTL      = 5 * time.Minute
+	challengeAttempts = 5
+)
+
+// secondFactorError is returned by login after successful password
+// verification for users with TOTP enabled. The challenge must be
+// passed to loginTOTP together with a TOTP or recovery code to
+// complete the login.
+type secondFactorError struct {
+	challenge string
+}
+
+func (e *secondFactorError) Error() string {
+	return "second factor required"
+}
+
+// totpEnrolment holds the data needed to set up an authenticator app.
+type totpEnrolment struct {
+	Secret string `json:"secret"` // base32 encoded
+	URI    string `json:"uri"`    // otpauth:// provisioning URI
+	QRCode []byte `json:"qrCode"` // PNG of the provisioning URI, base64 encoded in JSON
+}
+
+type totpSecret struct {
+	secret    string // base32 encoded
+	confirmed bool
+	lastStep  int64 // last used time step, to prevent code reuse
+}
+
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20) // 160 bits as recommended by RFC 4226
+	if _, err := rand.Read(b); err != nil {
+		return "", errs.New(errTokenCreation, err)
+	}
+	return base32NoPad.EncodeToString(b), nil
+}
+
+// totpURI returns the provisioning URI for authenticator apps, see
+// https://github.com/google/google-authenticator/wiki/Key-Uri-Format.
+func totpURI(issuer, name, secret string) string {
+	label := name
+	q := url.Values{"secret": {secret}}
+	if issuer != "" {
+		label = issuer + ":" + name
+		q.Set("issuer", issuer)
+	}
+	u := url.URL{Scheme: "otpauth", Host: "totp", Path: "/" + label, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// totpCode returns the code for given base32 encoded secret and time
+// step counter.
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32NoPad.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", errs.Errorf("%v: bad secret: %v", errTOTP, err)
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	h := hmac.New(sha1.New, key)
+	_, _ = h.Write(msg)
+	sum := h.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000), nil
+}
+
+// validateTOTP checks code against the codes of the time steps around
+// now and returns the matching time step. Steps up to and including
+// lastStep are rejected so that a code cannot be used twice.
+func validateTOTP(secret, code string, now time.Time, lastStep int64) (int64, error) {
+	current := now.Unix() / int64(totpStep/time.Second)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		want, err := totpCode(secret, step)
+		if err != nil {
+			return 0, err
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return step, nil
+		}
+	}
+	return 0, errTOTPCode
+}
+
+// newRecoveryCode returns a random code of 16 base32 characters in
+// groups of four, e.g. ABCD-EFGH-IJKL-MNOP.
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", errs.New(errTokenCreation, err)
+	}
+	s := base32NoPad.EncodeToString(b)
+	return s[0:4] + "-" + s[4:8] + "-" + s[8:12] + "-" + s[12:16], nil
+}
+
+// normaliseRecoveryCode strips separators and white space and upper
+// cases code so that it can be compared with the stored hash.
+func normaliseRecoveryCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// enrolTOTP creates a new, unconfirmed TOTP secret for user name,
+// replacing any previous unconfirmed one. TOTP only becomes effective
+// after confirmTOTP.
+func (a *authenticator) enrolTOTP(ctx context.Context, name string) (*totpEnrolment, error) {
+	t, err := a.db.getTOTP(ctx, name)
+	if err != nil && !errors.Is(err, errDBNotFound) {
+		return nil, err
+	}
+	if t != nil && t.confirmed {
+		return nil, errTOTPEnrolled
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.db.createTOTP(ctx, name, secret); err != nil {
+		return nil, err
+	}
+	uri := totpURI(a.totpIssuer, name, secret)
+	code, err := qr.Encode(uri, qr.M)
+	if err != nil {
+		return nil, errs.Errorf("%v: QR code: %v", errTOTP, err)
+	}
+	return &totpEnrolment{Secret: secret, URI: uri, QRCode: code.PNG()}, nil
+}
+
+// confirmTOTP enables TOTP for user name if code is valid for the
+// enrolled secret. It returns recovery codes that can be used once
+// each instead of a TOTP code. Only their hashes are stored.
+func (a *authenticator) confirmTOTP(ctx context.Context, name, code string) ([]string, error) {
+	t, err := a.db.getTOTP(ctx, name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil, errs.New(errTOTPNotEnabled, err)
+		}
+		return nil, err
+	}
+	if t.confirmed {
+		return nil, errTOTPEnrolled
+	}
+	step, err := validateTOTP(t.secret, code, time.Now(), t.lastStep)
+	if err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, err
+		}
+		hashes[i] = hashToken(normaliseRecoveryCode(codes[i]))
+	}
+	if err := a.db.confirmTOTP(ctx, name, step, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// disableTOTP removes TOTP and recovery codes for user name if code is
+// a valid TOTP or recovery code.
+func (a *authenticator) disableTOTP(ctx context.Context, name, code string) error {
+	if err := a.verifySecondFactor(ctx, name, code); err != nil {
+		return err
+	}
+	return a.db.deleteTOTP(ctx, name)
+}
+
+// verifySecondFactor checks code as TOTP code or recovery code for
+// user name with TOTP enabled. Used codes are invalidated.
+func (a *authenticator) verifySecondFactor(ctx context.Context, name, code string) error {
+	t, err := a.db.getTOTP(ctx, name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return errs.New(errTOTPNotEnabled, err)
+		}
+		return err
+	}
+	if !t.confirmed {
+		return errTOTPNotEnabled
+	}
+	if len(code) == totpDigits {
+		step, err := validateTOTP(t.secret, code, time.Now(), t.lastStep)
+		if err != nil {
+			return err
+		}
+		// Fails if the code has been used concurrently.
+		if err := a.db.updateTOTPStep(ctx, name, step); err != nil {
+			if errors.Is(err, errDBNotFound) {
+				return errs.New(errTOTPCode, err)
+			}
+			return err
+		}
+		return nil
+	}
+	err = a.db.deleteRecoveryCode(ctx, name, hashToken(normaliseRecoveryCode(code)))
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return errs.New(errTOTPCode, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// totpEnabled reports whether user name has confirmed TOTP enrolment.
+func (a *authenticator) totpEnabled(ctx context.Context, name string) (bool, error) {
+	t, err := a.db.getTOTP(ctx, name)
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return t.confirmed, nil
+}
+
+// newChallenge creates a short lived login challenge for user name to
+// be completed with loginTOTP.
+func (a *authenticator) newChallenge(ctx context.Context, name string) (string, error) {
+	challenge, err := newRandomToken()
+	if err != nil {
+		return "", err
+	}
+	expiresAt := time.Now().Add(challengeTTL).Unix()
+	if err := a.db.createChallenge(ctx, hashToken(challenge), name, expiresAt); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// loginTOTP completes a login started with login for a user with TOTP
+// enabled. code is either a TOTP code or a recovery code. A challenge
+// is invalidated on success or after too many failed attempts.
+func (a *authenticator) loginTOTP(ctx context.Context, challenge, code, ip string) (*User, error) {
+	hash := hashToken(challenge)
+	name, err := a.db.getChallenge(ctx, hash, time.Now().Unix())
+	if err != nil {
+		if errors.Is(err, errDBNotFound) {
+			return nil, errs.New(errChallenge, err)
+		}
+		return nil, err
+	}
+	if err := a.verifySecondFactor(ctx, name, code); err != nil {
+		if !errors.Is(err, errTOTP) {
+			return nil, err
+		}
+		if dbErr := a.db.failChallenge(ctx, hash, challengeAttempts); dbErr != nil {
+			return nil, dbErr
+		}
+		return nil, a.loginFailed(ctx, name, ip, err)
+	}
+	if err := a.db.deleteChallenge(ctx, hash); err != nil {
+		return nil, err
+	}
+	u, err := a.db.getUser(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	a.throttle.reset("name:" + name)
+	u.JWT = a.newJWT(u)
+	return u, nil
+}
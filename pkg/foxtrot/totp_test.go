@@ -0,0 +1,157 @@
+package foxtrot
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rfc6238Secret is the SHA1 test secret of RFC 6238, appendix B,
+// "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// RFC 6238 test vectors truncated to 6 digits.
+	tests := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+	for unix, want := range tests {
+		got, err := totpCode(rfc6238Secret, unix/30)
+		require.NoError(t, err)
+		require.Equal(t, want, got, "time %d", unix)
+	}
+	_, err := totpCode("!!!", 1)
+	requireErrIs(t, err, errTOTP)
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step, err := validateTOTP(rfc6238Secret, "005924", now, 0)
+	require.NoError(t, err)
+	require.Equal(t, int64(1234567890/30), step)
+
+	_, err = validateTOTP(rfc6238Secret, "005924", now.Add(totpStep), 0)
+	require.NoError(t, err) // clock skew
+	_, err = validateTOTP(rfc6238Secret, "005924", now.Add(2*totpStep), 0)
+	requireErrIs(t, err, errTOTPCode)
+	_, err = validateTOTP(rfc6238Secret, "005924", now, step)
+	requireErrIs(t, err, errTOTPCode) // reused
+	_, err = validateTOTP(rfc6238Secret, "000000", now, 0)
+	requireErrIs(t, err, errTOTPCode)
+}
+
+func TestTOTPURI(t *testing.T) {
+	got := totpURI("foxtrot", "$fox", "ABC")
+	require.Equal(t, "otpauth://totp/foxtrot:$fox?issuer=foxtrot&secret=ABC", got)
+	got = totpURI("", "alice", "ABC")
+	require.Equal(t, "otpauth://totp/alice?secret=ABC", got)
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, err := newRecoveryCode()
+	require.NoError(t, err)
+	require.Len(t, code, 19)
+	require.Equal(t, strings.ReplaceAll(code, "-", ""), normaliseRecoveryCode(code))
+	require.Equal(t, normaliseRecoveryCode(code), normaliseRecoveryCode(strings.ToLower(code)))
+}
+
+// currentTOTP returns the TOTP code for secret step time steps after
+// the current one.
+func currentTOTP(t *testing.T, secret string, step int64) string {
+	t.Helper()
+	code, err := totpCode(secret, time.Now().Unix()/30+step)
+	require.NoError(t, err)
+	return code
+}
+
+func TestTOTPLogin(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	a := authenticator{db: db, secret: []byte("$$$$$hhh!"), hasher: fastArgon2.withDefaults(), totpIssuer: "foxtrot"}
+	require.NoError(t, a.register(ctx, &User{Name: "alice"}, "Pa$$w0rd"))
+
+	e, err := a.enrolTOTP(ctx, "alice")
+	require.NoError(t, err)
+	require.Contains(t, e.URI, "secret="+e.Secret)
+	require.True(t, strings.HasPrefix(string(e.QRCode), "\x89PNG"))
+	u, err := a.login(ctx, "alice", "Pa$$w0rd", "")
+	require.NoError(t, err) // not yet confirmed
+	require.NotEmpty(t, u.JWT)
+
+	_, err = a.confirmTOTP(ctx, "alice", "000000")
+	requireErrIs(t, err, errTOTPCode)
+	codes, err := a.confirmTOTP(ctx, "alice", currentTOTP(t, e.Secret, 0))
+	require.NoError(t, err)
+	require.Len(t, codes, recoveryCodeCount)
+	_, err = a.enrolTOTP(ctx, "alice")
+	requireErrIs(t, err, errTOTPEnrolled)
+
+	_, err = a.login(ctx, "alice", "Pa$$w0rd", "")
+	var sfe *secondFactorError
+	require.True(t, errors.As(err, &sfe))
+	_, err = a.loginTOTP(ctx, sfe.challenge, currentTOTP(t, e.Secret, 0), "")
+	requireErrIs(t, err, errAuth) // code already used for confirmation
+	u, err = a.loginTOTP(ctx, sfe.challenge, currentTOTP(t, e.Secret, 1), "")
+	require.NoError(t, err)
+	require.NoError(t, a.validateJWT(u.JWT))
+	_, err = a.loginTOTP(ctx, sfe.challenge, codes[0], "")
+	requireErrIs(t, err, errChallenge) // single use
+
+	_, err = a.login(ctx, "alice", "Pa$$w0rd", "")
+	require.True(t, errors.As(err, &sfe))
+	_, err = a.loginTOTP(ctx, sfe.challenge, strings.ToLower(codes[0]), "")
+	require.NoError(t, err)
+	_, err = a.login(ctx, "alice", "Pa$$w0rd", "")
+	require.True(t, errors.As(err, &sfe))
+	_, err = a.loginTOTP(ctx, sfe.challenge, codes[0], "")
+	requireErrIs(t, err, errAuth) // recovery code already used
+
+	err = a.changePassword(ctx, "alice", "Pa$$w0rd", "", "n3w-Pa$$w0rd", "")
+	requireErrIs(t, err, errAuth)
+	err = a.changePassword(ctx, "alice", "Pa$$w0rd", codes[0], "n3w-Pa$$w0rd", "")
+	requireErrIs(t, err, errAuth) // recovery code already used
+	require.NoError(t, a.changePassword(ctx, "alice", "Pa$$w0rd", codes[3], "n3w-Pa$$w0rd", ""))
+	_, err = a.login(ctx, "alice", "n3w-Pa$$w0rd", "")
+	require.True(t, errors.As(err, &sfe))
+
+	require.NoError(t, a.disableTOTP(ctx, "alice", codes[1]))
+	_, err = a.login(ctx, "alice", "n3w-Pa$$w0rd", "")
+	require.NoError(t, err)
+	err = a.disableTOTP(ctx, "alice", codes[2])
+	requireErrIs(t, err, errTOTPNotEnabled)
+}
+
+func TestTOTPChallengeAttempts(t *testing.T) {
+	db := mustDB()
+	defer db.close()
+
+	ctx := context.Background()
+	a := authenticator{db: db, secret: []byte("$$$$$hhh!"), hasher: fastArgon2.withDefaults()}
+	require.NoError(t, a.register(ctx, &User{Name: "alice"}, "Pa$$w0rd"))
+	e, err := a.enrolTOTP(ctx, "alice")
+	require.NoError(t, err)
+	_, err = a.confirmTOTP(ctx, "alice", currentTOTP(t, e.Secret, 0))
+	require.NoError(t, err)
+
+	_, err = a.login(ctx, "alice", "Pa$$w0rd", "")
+	var sfe *secondFactorError
+	require.True(t, errors.As(err, &sfe))
+	for i := 0; i < challengeAttempts; i++ {
+		_, err = a.loginTOTP(ctx, sfe.challenge, "000000", "")
+		requireErrIs(t, err, errAuth)
+	}
+	_, err = a.loginTOTP(ctx, sfe.challenge, currentTOTP(t, e.Secret, 1), "")
+	requireErrIs(t, err, errChallenge)
+	_, err = a.loginTOTP(ctx, "MISSING", currentTOTP(t, e.Secret, 1), "")
+	requireErrIs(t, err, errChallenge)
+}